@@ -0,0 +1,375 @@
+package main
+
+// golden check of the pure go pghash package against the original c hash
+// functions (hashfunc.c, which is copied from postgresql), both are run with
+// the same generated keys, and any different hash value or partition bound
+// is reported. this is the only place the c code still be built.
+//
+// the c numeric code prints debug lines to stdout, so the result is written
+// to stderr, run it like: hashcheck [count] > /dev/null
+//
+// it is also the generator of the golden table of src/pghash/golden_test.go,
+// the remainders are computed by the c code only, and the table rows are
+// written to stderr: hashcheck golden > /dev/null
+// the table is generated once and checked in, so go test does not need cgo
+
+// #cgo CFLAGS: -g -w
+// #define _DEFAULT_SOURCE
+// #include <stdlib.h>
+// #include <stdio.h>
+// #include <time.h>
+// #include "hashfunc.h"
+// typedef struct NumericData *Numeric;
+// Datum hash_any_extended(unsigned char* k, int keylen, uint64 seed);
+// Datum hash_uint32_extended(uint32 k, uint64 seed);
+// uint64_t hash_combine64(uint64_t a, uint64_t b);
+// Datum numeric_in(char *str);
+// Datum hash_numeric_extended(Numeric key, uint64 seed);
+//
+// static uint64 hash_bytes(char *k, int offset, int keylen, uint64 seed) {
+//   return hash_any_extended((unsigned char *) k + offset, keylen - offset, seed);
+// }
+//
+// static uint64 hash_numeric_str(char *str, uint64 seed) {
+//   Numeric n = (Numeric) numeric_in(str);
+//   uint64 h = hash_numeric_extended(n, seed);
+//   free(n);
+//   return h;
+// }
+//
+// static long pg_epoch_secs(int y, int m, int d, int hh, int mm, int ss) {
+//   struct tm t = {0};
+//   t.tm_year = y - 1900; t.tm_mon = m - 1; t.tm_mday = d;
+//   t.tm_hour = hh; t.tm_min = mm; t.tm_sec = ss;
+//   return (long) timegm(&t) - 946684800L;
+// }
+//
+// static uint64 hash_uuid_str(char *str, uint64 seed) {
+//   unsigned char b[16];
+//   for (int i = 0; i < 16; i++)
+//     sscanf(str + i * 2, "%2hhx", &b[i]);
+//   return hash_any_extended(b, 16, seed);
+// }
+import "C"
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"pghash"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+var (
+	moduluses = []int{1, 2, 3, 4, 5, 6, 7, 8, 16, 24, 64, 100, 1024}
+	failed    = 0
+	checked   = 0
+)
+
+func report(kind string, key string, what string, expect uint64, got uint64) {
+	checked++
+	if expect != got {
+		failed++
+		fmt.Fprintf(os.Stderr, "MISMATCH %s key %q %s: c %d, go %d\n", kind, key, what, expect, got)
+	}
+}
+
+func checkBounds(kind string, key string, chash uint64, gobound func(int) int) {
+	for _, m := range moduluses {
+		expect := C.hash_combine64(0, C.uint64_t(chash)) % C.uint64_t(m)
+		report(kind, key, fmt.Sprintf("bound(%d)", m), uint64(expect), uint64(gobound(m)))
+	}
+}
+
+func checkInt(key int32) {
+	s := strconv.Itoa(int(key))
+	chash := uint64(C.hash_uint32_extended(C.uint32(uint32(key)), C.uint64(pghash.HASH_PARTITION_SEED)))
+	report("int", s, "hash", chash, pghash.HashInt(key))
+	checkBounds("int", s, chash, func(m int) int {
+		return pghash.GetMatchingHashBoundsInt(key, m)
+	})
+	for _, m := range moduluses {
+		report("int", s, fmt.Sprintf("c bound(%d)", m),
+			uint64(C.get_matching_hash_bounds_int(C.int(key), C.int(m))),
+			uint64(pghash.GetMatchingHashBoundsInt(key, m)))
+	}
+}
+
+func checkBigint(key int64) {
+	s := strconv.FormatInt(key, 10)
+	for _, m := range moduluses {
+		report("bigint", s, fmt.Sprintf("c bound(%d)", m),
+			uint64(C.get_matching_hash_bounds_bigint(C.int64(key), C.int(m))),
+			uint64(pghash.GetMatchingHashBoundsBigint(key, m)))
+	}
+}
+
+func checkText(key []byte) {
+	s := string(key)
+	ckey := C.CString(s)
+	defer C.free(unsafe.Pointer(ckey))
+	chash := uint64(C.hash_bytes(ckey, 0, C.int(len(key)), C.uint64(pghash.HASH_PARTITION_SEED)))
+	report("text", s, "hash", chash, pghash.HashString(key))
+	checkBounds("text", s, chash, func(m int) int {
+		return pghash.GetMatchingHashBoundsString(key, m)
+	})
+	for _, m := range moduluses {
+		report("text", s, fmt.Sprintf("c bound(%d)", m),
+			uint64(C.get_matching_hash_bounds_string(ckey, C.int(m))),
+			uint64(pghash.GetMatchingHashBoundsString(key, m)))
+	}
+	// the unseeded form, also make sure the unaligned path is the same
+	for off := 0; off < 4 && off <= len(key); off++ {
+		report("text", s, fmt.Sprintf("unseeded hash(+%d)", off),
+			uint64(C.hash_bytes(ckey, C.int(off), C.int(len(key)), 0)),
+			pghash.HashAnyExtended(key[off:], 0))
+	}
+}
+
+func checkNumeric(key string) {
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	chash := uint64(C.hash_numeric_str(ckey, C.uint64(pghash.HASH_PARTITION_SEED)))
+
+	gohash, err := pghash.HashNumeric(key)
+	if err != nil {
+		failed++
+		fmt.Fprintf(os.Stderr, "MISMATCH numeric key %q: go fail to parse, %s\n", key, err)
+		return
+	}
+	report("numeric", key, "hash", chash, gohash)
+	checkBounds("numeric", key, chash, func(m int) int {
+		b, _ := pghash.GetMatchingHashBoundsNumeric(key, m)
+		return b
+	})
+}
+
+// date is hashed as int4 of days from 2000-01-01
+func checkDate(y, m, d int) {
+	s := fmt.Sprintf("%04d-%02d-%02d", y, m, d)
+	days := int(C.pg_epoch_secs(C.int(y), C.int(m), C.int(d), 0, 0, 0) / 86400)
+	gohash, err := pghash.HashDate(s)
+	if err != nil {
+		failed++
+		fmt.Fprintf(os.Stderr, "MISMATCH date key %q: go fail to parse, %s\n", s, err)
+		return
+	}
+	for _, m := range moduluses {
+		report("date", s, fmt.Sprintf("c bound(%d)", m),
+			uint64(C.get_matching_hash_bounds_int(C.int(days), C.int(m))),
+			uint64(pghash.MatchingHashBound(pghash.PartitionRowHash(gohash), m)))
+	}
+}
+
+// timestamp is hashed as int8 of microseconds from 2000-01-01
+func checkTimestamp(y, m, d, hh, mm, ss, usec int) {
+	s := fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d.%06d", y, m, d, hh, mm, ss, usec)
+	ts := int64(C.pg_epoch_secs(C.int(y), C.int(m), C.int(d), C.int(hh), C.int(mm), C.int(ss)))*1000000 + int64(usec)
+	gohash, err := pghash.HashTimestamp(s)
+	if err != nil {
+		failed++
+		fmt.Fprintf(os.Stderr, "MISMATCH timestamp key %q: go fail to parse, %s\n", s, err)
+		return
+	}
+	for _, m := range moduluses {
+		report("timestamp", s, fmt.Sprintf("c bound(%d)", m),
+			uint64(C.get_matching_hash_bounds_bigint(C.int64(ts), C.int(m))),
+			uint64(pghash.MatchingHashBound(pghash.PartitionRowHash(gohash), m)))
+	}
+}
+
+// uuid is hashed as its 16 bytes
+func checkUUID(b []byte) {
+	h := fmt.Sprintf("%x", b)
+	s := h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+	ckey := C.CString(h)
+	defer C.free(unsafe.Pointer(ckey))
+	gohash, err := pghash.HashUUID(s)
+	if err != nil {
+		failed++
+		fmt.Fprintf(os.Stderr, "MISMATCH uuid key %q: go fail to parse, %s\n", s, err)
+		return
+	}
+	report("uuid", s, "hash", uint64(C.hash_uuid_str(ckey, C.uint64(pghash.HASH_PARTITION_SEED))), gohash)
+}
+
+// composite key, the column hashes are combined in the key order
+func checkComposite(a int32, b []byte) {
+	s := fmt.Sprintf("(%d, %s)", a, b)
+	ckey := C.CString(string(b))
+	defer C.free(unsafe.Pointer(ckey))
+	ha := C.hash_uint32_extended(C.uint32(uint32(a)), C.uint64(pghash.HASH_PARTITION_SEED))
+	hb := C.hash_bytes(ckey, 0, C.int(len(b)), C.uint64(pghash.HASH_PARTITION_SEED))
+	chash := C.hash_combine64(C.hash_combine64(0, C.uint64_t(ha)), C.uint64_t(hb))
+	gohash := pghash.PartitionRowHash(pghash.HashInt(a), pghash.HashString(b))
+	report("composite", s, "hash", uint64(chash), gohash)
+	for _, m := range moduluses {
+		report("composite", s, fmt.Sprintf("bound(%d)", m),
+			uint64(chash%C.uint64_t(m)), uint64(pghash.MatchingHashBound(gohash, m)))
+	}
+}
+
+func randDigits(r *rand.Rand, n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		sb.WriteByte(byte('0' + r.Intn(10)))
+	}
+	return sb.String()
+}
+
+func randNumeric(r *rand.Rand) string {
+	s := ""
+	switch r.Intn(4) {
+	case 0:
+		s += "-"
+	case 1:
+		s += "+"
+	}
+	s += randDigits(r, r.Intn(20)+1)
+	if r.Intn(2) == 0 {
+		s += "." + randDigits(r, r.Intn(20))
+	}
+	if r.Intn(8) == 0 {
+		s += fmt.Sprintf("e%d", r.Intn(40)-20)
+	}
+	return s
+}
+
+var (
+	goldenModuluses = []int{3, 8, 1024}
+	goldenInts      = []int32{0, 1, -1, 4321, 2147483647, -2147483648}
+	goldenBigints   = []int64{0, 1, -1, 222222222222, -222222222222,
+		9223372036854775807, -9223372036854775808}
+	goldenTexts    = []string{"", "a", "dennytest", "bmsql_item", "中文测试", strings.Repeat("x", 100)}
+	goldenNumerics = []string{"0", "-0", "0.000", "1", "-1", "10000", "00012.3400",
+		"1e10", "1.5E-7", "-98765.4321", "12345678901234567890.0987654321"}
+	goldenDates      = [][3]int{{2000, 1, 1}, {1999, 12, 31}, {2020, 2, 29}, {1900, 3, 1}, {2099, 12, 31}}
+	goldenTimestamps = [][7]int{{2000, 1, 1, 0, 0, 0, 0}, {1969, 12, 31, 23, 59, 59, 999999},
+		{2021, 3, 2, 12, 34, 56, 789012}}
+	goldenUUIDs = []string{"00000000-0000-0000-0000-000000000000",
+		"a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", "ffffffff-ffff-ffff-ffff-ffffffffffff"}
+)
+
+func goldenRow(kind string, key string, chash uint64) {
+	for _, m := range goldenModuluses {
+		bound := C.hash_combine64(0, C.uint64_t(chash)) % C.uint64_t(m)
+		fmt.Fprintf(os.Stderr, "\t{%q, %q, %d, %d},\n", kind, key, m, uint64(bound))
+	}
+}
+
+// golden print the rows of the golden table, the hashes are all from the c code
+func golden() {
+	seed := C.uint64(pghash.HASH_PARTITION_SEED)
+	for _, k := range goldenInts {
+		goldenRow("int", strconv.Itoa(int(k)), uint64(C.hash_uint32_extended(C.uint32(uint32(k)), seed)))
+	}
+	for _, k := range goldenBigints {
+		// int8 is hashed as int4 after the high half is folded, see hashint8extended()
+		lohalf, hihalf := uint32(k), uint32(k>>32)
+		if k >= 0 {
+			lohalf ^= hihalf
+		} else {
+			lohalf ^= ^hihalf
+		}
+		goldenRow("bigint", strconv.FormatInt(k, 10), uint64(C.hash_uint32_extended(C.uint32(lohalf), seed)))
+	}
+	for _, k := range goldenTexts {
+		ckey := C.CString(k)
+		goldenRow("text", k, uint64(C.hash_bytes(ckey, 0, C.int(len(k)), seed)))
+		C.free(unsafe.Pointer(ckey))
+	}
+	for _, k := range goldenNumerics {
+		ckey := C.CString(k)
+		goldenRow("numeric", k, uint64(C.hash_numeric_str(ckey, seed)))
+		C.free(unsafe.Pointer(ckey))
+	}
+	for _, d := range goldenDates {
+		days := int32(C.pg_epoch_secs(C.int(d[0]), C.int(d[1]), C.int(d[2]), 0, 0, 0) / 86400)
+		goldenRow("date", fmt.Sprintf("%04d-%02d-%02d", d[0], d[1], d[2]),
+			uint64(C.hash_uint32_extended(C.uint32(uint32(days)), seed)))
+	}
+	for _, t := range goldenTimestamps {
+		ts := int64(C.pg_epoch_secs(C.int(t[0]), C.int(t[1]), C.int(t[2]), C.int(t[3]), C.int(t[4]), C.int(t[5])))*1000000 + int64(t[6])
+		lohalf, hihalf := uint32(ts), uint32(ts>>32)
+		if ts >= 0 {
+			lohalf ^= hihalf
+		} else {
+			lohalf ^= ^hihalf
+		}
+		goldenRow("timestamp", fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d.%06d", t[0], t[1], t[2], t[3], t[4], t[5], t[6]),
+			uint64(C.hash_uint32_extended(C.uint32(lohalf), seed)))
+	}
+	for _, k := range goldenUUIDs {
+		ckey := C.CString(strings.Replace(k, "-", "", -1))
+		goldenRow("uuid", k, uint64(C.hash_uuid_str(ckey, seed)))
+		C.free(unsafe.Pointer(ckey))
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "golden" {
+		golden()
+		return
+	}
+	count := 20000
+	if len(os.Args) > 1 {
+		c, err := strconv.Atoi(os.Args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid count", os.Args[1])
+			os.Exit(1)
+		}
+		count = c
+	}
+
+	r := rand.New(rand.NewSource(20210302))
+
+	for _, k := range []int32{0, 1, -1, 4321, 2147483647, -2147483648} {
+		checkInt(k)
+	}
+	for _, k := range []int64{0, 1, -1, 222222222222, -222222222222,
+		9223372036854775807, -9223372036854775808} {
+		checkBigint(k)
+	}
+	for _, k := range []string{"", "a", "dennytest", "bmsql_item", "0123456789ab",
+		"中文测试", strings.Repeat("x", 100)} {
+		checkText([]byte(k))
+	}
+	checkDate(2000, 1, 1)
+	checkDate(1999, 12, 31)
+	checkDate(2020, 2, 29)
+	checkTimestamp(2000, 1, 1, 0, 0, 0, 0)
+	checkTimestamp(1969, 12, 31, 23, 59, 59, 999999)
+	checkUUID(make([]byte, 16))
+
+	for _, k := range []string{"0", "-0", "0.000", "1", "-1", "10000", "00012.3400",
+		"1e10", "1.5E-7", "12345678901234567890.0987654321", " 42 "} {
+		checkNumeric(k)
+	}
+
+	for i := 0; i < count; i++ {
+		checkInt(int32(r.Uint32()))
+		checkBigint(int64(r.Uint64()))
+		b := make([]byte, r.Intn(64))
+		for j := range b {
+			b[j] = byte(r.Intn(255) + 1)
+		}
+		checkText(b)
+		checkNumeric(randNumeric(r))
+		y, mo := r.Intn(200)+1900, r.Intn(12)+1
+		d := r.Intn(time.Date(y, time.Month(mo)+1, 0, 0, 0, 0, 0, time.UTC).Day()) + 1
+		checkDate(y, mo, d)
+		checkTimestamp(y, mo, d, r.Intn(24), r.Intn(60), r.Intn(60), r.Intn(1000000))
+		u := make([]byte, 16)
+		r.Read(u)
+		checkUUID(u)
+		checkComposite(int32(r.Uint32()), b)
+	}
+
+	fmt.Fprintf(os.Stderr, "hashcheck: %d checked, %d mismatch\n", checked, failed)
+	if failed != 0 {
+		os.Exit(1)
+	}
+}
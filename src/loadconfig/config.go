@@ -1,37 +1,180 @@
 package loadconfig
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"strconv"
+	"strings"
 )
 
 type NetworkNode struct {
 	Host string `yaml:"host"`
 	Port int `yaml:"port"`
+	// the remainders (slices) on the node, when not configured for all the
+	// nodes, remainder i goes to node i % len(nodes)
+	Remainders FieldList `yaml:"remainders"`
+}
+
+// FieldList is a list of field positions, it can be configured as a single
+// number, a yaml list or a comma separated string, like 1, [1, 2] or "1, 2"
+type FieldList []int
+
+func (this *FieldList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []int
+	if err := unmarshal(&list); err == nil {
+		*this = list
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	list = make([]int, 0)
+	for _, item := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			return fmt.Errorf("invalid field list %s", s)
+		}
+		list = append(list, i)
+	}
+	*this = list
+	return nil
+}
+
+// StringList is a list of values, a single value can be configured without
+// the yaml list
+type StringList []string
+
+func (this *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*this = list
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	*this = []string{s}
+	return nil
+}
+
+// Partition is the bound of a range or list partition and the slice (the
+// index of nodes) it lives on, the values of a composite range key are listed
+// in the key order, MINVALUE and MAXVALUE are accepted in a range bound
+type Partition struct {
+	Slice int `yaml:"slice"`
+	From StringList `yaml:"from"` // range only
+	To StringList `yaml:"to"` // range only
+	Values StringList `yaml:"values"` // list only
+	Null bool `yaml:"null"` // list only, the partition accepts null
+	Default bool `yaml:"default"`
+}
+
+// FixedColumn is the position of a column in the fixed width record, start
+// from 1, decimals is the implied decimal places, like 0012345 is 123.45
+// with decimals 2
+type FixedColumn struct {
+	Start int `yaml:"start"`
+	Length int `yaml:"length"`
+	Decimals int `yaml:"decimals"`
 }
 
 type Table struct {
 	Tablename string `yaml:"tablename"`
 	Columns string `yaml:"columns"`
-	PartitionField int `yaml:"partitionField"`
-	PartitionFieldType string `yaml:"partitionFieldType"`
-	Datapath string `yaml:datapath`
+	PartitionField FieldList `yaml:"partitionField"` // multiple for composite key
+	PartitionFieldType string `yaml:"partitionFieldType"` // comma separated
+	PartitionStrategy string `yaml:"partitionStrategy"` // hash(default), range or list
+	Partitions []Partition `yaml:"partitions"` // range or list only
+	// the data files, the globs or the directories, "-" is stdin, a fifo is
+	// read as a stream
+	Datapath StringList `yaml:"datapath"`
+	// default is datapath + ".reject" for a single file, otherwise
+	// tablename + ".reject"
+	Rejectfile string `yaml:"rejectfile"`
+	// the bad rows (the partition key can not be parsed, too few fields, an
+	// unmatched quote) written to the reject file before the load fails, -1
+	// is no limit, 0 (default) fails on the first one, or no limit if only
+	// maxErrorPercent is set
+	MaxErrors *int64 `yaml:"maxErrors"`
+	// the load fails if the bad rows are more than the percent of the rows
+	// read, it is checked after all the rows are read
+	MaxErrorPercent float64 `yaml:"maxErrorPercent"`
+	// the partition table name on the node, {schema}, {table} and
+	// {remainder} are replaced, like "{schema}_{remainder}.{table}"
+	Target string `yaml:"target"`
+	// csv(default) or text, the same as the FORMAT option of COPY
+	Format string `yaml:"format"`
+	// send the rows to the nodes in the binary copy format, converted by
+	// the column types on the nodes
+	Binary bool `yaml:"binary"`
+	// the format options, the same as the COPY options, default is the
+	// postgresql default except null is "NULL" for csv, the force options
+	// are the column names and csv only
+	Delimiter string `yaml:"delimiter"`
+	Quote string `yaml:"quote"`
+	Escape string `yaml:"escape"`
+	Null *string `yaml:"null"`
+	ForceNull StringList `yaml:"forceNull"`
+	ForceNotNull StringList `yaml:"forceNotNull"`
+	// ndjson for the json lines, fixed for the fixed width records, the rows
+	// are sent in the format above
+	Input string `yaml:"input"`
+	// the json path of the columns, the column name is the path by default
+	JsonPaths map[string]string `yaml:"jsonPaths"`
+	// the json paths of the partition key, instead of the partitionField
+	PartitionPath StringList `yaml:"partitionPath"`
+	// the fixed width columns in the order of the columns
+	FixedColumns []FixedColumn `yaml:"fixedColumns"`
+	// the bytes of a fixed width record with the line end if any, the
+	// records end with the newline if not set
+	RecordLength int `yaml:"recordLength"`
+	// trim the spaces around the fixed width fields, the blank field is null anyway
+	Trim bool `yaml:"trim"`
 }
 
 type Config struct {
 	Dbname string `yaml:"dbname"`
 	Schema string `yaml:"schema"`
+	Target string `yaml:"target"` // default target template of all tables
 	User string `yaml:"user"`
 	Password string `yaml:"password"`
 	Buffersize int `yaml:"buffersize"`
-	Readers int `yaml:readers""`
+	Readers int `yaml:"readers"`
 	Slicenum int `yaml:"slicenum"`
-	Maxtuplechunk int64 `yaml:maxtuplechunk`
+	Maxtuplechunk int64 `yaml:"maxtuplechunk"`
 	Loglevel string `yaml:"loglevel"`
 	Encoding string `yaml:"encoding"`
 	Csvheader bool `yaml:"csvheader"`
 	Nodes []NetworkNode `yaml:"nodes"`
-	Tables []Table `yaml:tables`
+	// read the nodes and partition layout from the coordinator catalog
+	// instead, the nodes and slicenum are not needed then
+	Discover bool `yaml:"discover"`
+	Coordinator NetworkNode `yaml:"coordinator"`
+	// load each table on all nodes or none of them by the two phase commit,
+	// the prepared transactions are recorded in the journal, default is the
+	// config file + ".journal"
+	Atomic bool `yaml:"atomic"`
+	Journal string `yaml:"journal"`
+	// end the copy of each node and start a new one every commitrows rows or
+	// commitsize MB, each copy is committed on its own, 0 is no limit
+	CommitRows int64 `yaml:"commitrows"`
+	CommitSize int `yaml:"commitsize"`
+	// keep the bytes committed by each copy in the checkpoint file of each
+	// table, so the load can be resumed by --resume, the copy is committed
+	// every 64 MB if the commitrows and commitsize are not set
+	Checkpoint bool `yaml:"checkpoint"`
+	// retry the connection and the batch failed by a transient error of the
+	// node, waiting retrywait seconds before the first retry, doubled each
+	// time, the copy is committed every 64 MB if commitrows and commitsize
+	// are not set
+	Retries int `yaml:"retries"`
+	RetryWait int `yaml:"retrywait"`
+	Tables []Table `yaml:"tables"`
 }
 
 type SysConfig struct {
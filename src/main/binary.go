@@ -0,0 +1,270 @@
+package main
+
+// binary copy mode, the reader converts each row to the postgresql binary
+// COPY tuple by the column types on the node, and the sender streams COPY
+// ... FROM STDIN (FORMAT binary), so the nodes do not parse the text again.
+//
+// the binary stream is the header, the tuples and the trailer, each tuple is
+// the field count (int16), and each field is the length (int32, -1 for null)
+// and the data in the *_send() form of the type, all in network byte order.
+// the text is sent as it is, so it should be in the server encoding.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"pghash"
+	"strconv"
+	"strings"
+)
+
+const (
+	// the columns of the table on the node, with the type name
+	SQL_COLUMN_TYPES = `SELECT attname, format_type(atttypid, atttypmod)
+  FROM pg_attribute
+ WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped
+ ORDER BY attnum`
+)
+
+var (
+	BinaryCopyHeader = []byte("PGCOPY\n\377\r\n\000" +
+		"\000\000\000\000" + // flags
+		"\000\000\000\000") // header extension length
+	BinaryCopyTrailer = []byte{0xff, 0xff}
+)
+
+// fieldEncoder append the binary form of the text value to buf
+type fieldEncoder func(buf []byte, s []byte) ([]byte, error)
+
+type BinaryEncoder struct {
+	format Format
+	columns []string
+	types []string
+	encoders []fieldEncoder
+}
+
+// NewBinaryEncoder make the encoder of the columns, types are the type names
+// of the columns, as format_type() shows
+func NewBinaryEncoder(format Format, columns []string, types []string) (*BinaryEncoder, error) {
+	e := &BinaryEncoder{
+		format: format,
+		columns: columns,
+		types: types,
+	}
+	for i, t := range types {
+		enc := binaryFieldEncoder(baseTypeName(t))
+		if enc == nil {
+			return nil, fmt.Errorf("column %s type %s is not supported in binary mode", columns[i], t)
+		}
+		e.encoders = append(e.encoders, enc)
+	}
+	return e, nil
+}
+
+// Encode convert the row to the binary tuple, split is the row split by
+// splitRecord, or nil
+func (this *BinaryEncoder) Encode(tuple []byte, split *Fields) ([]byte, error) {
+	fields, nulls, err := getColumns(this.format, tuple, split)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != len(this.encoders) {
+		return nil, fmt.Errorf("the row has %d fields, but %d columns", len(fields), len(this.encoders))
+	}
+
+	buf := make([]byte, 2, len(tuple) + 4*len(fields) + 2)
+	binary.BigEndian.PutUint16(buf, uint16(len(fields)))
+	for i, field := range fields {
+		if nulls[i] {
+			buf = appendInt32(buf, -1)
+			continue
+		}
+		// reserve the length, and fill it after the data
+		pos := len(buf)
+		buf = appendInt32(buf, 0)
+		buf, err = this.encoders[i](buf, field)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %s", this.columns[i], err.Error())
+		}
+		binary.BigEndian.PutUint32(buf[pos:], uint32(len(buf) - pos - 4))
+	}
+	return buf, nil
+}
+
+// binaryFieldEncoder get the encoder of the type, nil if not supported
+func binaryFieldEncoder(typename string) fieldEncoder {
+	switch typename {
+	case "smallint":
+		return encodeInt(16)
+	case "integer":
+		return encodeInt(32)
+	case "bigint":
+		return encodeInt(64)
+	case "real":
+		return encodeFloat4
+	case "double precision":
+		return encodeFloat8
+	case "numeric":
+		return encodeNumeric
+	case "boolean":
+		return encodeBool
+	case "text", "character varying", "character", "name", "json":
+		return encodeText
+	case "jsonb":
+		return encodeJsonb
+	case "bytea":
+		return encodeBytea
+	case "date":
+		return encodeDate
+	case "timestamp without time zone":
+		return encodeTimestamp
+	case "uuid":
+		return encodeUUID
+	}
+	return nil
+}
+
+func appendInt16(buf []byte, v int16) []byte {
+	return append(buf, byte(v >> 8), byte(v))
+}
+
+func appendInt32(buf []byte, v int32) []byte {
+	return append(buf, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v))
+}
+
+func appendInt64(buf []byte, v int64) []byte {
+	return append(buf, byte(v >> 56), byte(v >> 48), byte(v >> 40), byte(v >> 32),
+		byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v))
+}
+
+func encodeInt(bits int) fieldEncoder {
+	return func(buf []byte, s []byte) ([]byte, error) {
+		v, err := strconv.ParseInt(strings.TrimSpace(string(s)), 10, bits)
+		if err != nil {
+			return nil, err
+		}
+		switch bits {
+		case 16:
+			return appendInt16(buf, int16(v)), nil
+		case 32:
+			return appendInt32(buf, int32(v)), nil
+		}
+		return appendInt64(buf, v), nil
+	}
+}
+
+func encodeFloat4(buf []byte, s []byte) ([]byte, error) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(s)), 32)
+	if err != nil {
+		return nil, err
+	}
+	return appendInt32(buf, int32(math.Float32bits(float32(v)))), nil
+}
+
+func encodeFloat8(buf []byte, s []byte) ([]byte, error) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(s)), 64)
+	if err != nil {
+		return nil, err
+	}
+	return appendInt64(buf, int64(math.Float64bits(v))), nil
+}
+
+func encodeNumeric(buf []byte, s []byte) ([]byte, error) {
+	n, err := pghash.ParseNumeric(string(s))
+	if err != nil {
+		return nil, err
+	}
+	return n.AppendBinary(buf), nil
+}
+
+// encodeBool accept the same input as boolin, a prefix of true, false, yes
+// and no, on, off, 1 and 0
+func encodeBool(buf []byte, s []byte) ([]byte, error) {
+	v := strings.ToLower(strings.TrimSpace(string(s)))
+	switch {
+	case v == "1" || v == "on" || (len(v) > 0 && (strings.HasPrefix("true", v) || strings.HasPrefix("yes", v))):
+		return append(buf, 1), nil
+	case v == "0" || (len(v) > 1 && strings.HasPrefix("off", v)) ||
+		(len(v) > 0 && (strings.HasPrefix("false", v) || strings.HasPrefix("no", v))):
+		return append(buf, 0), nil
+	}
+	return nil, fmt.Errorf("invalid input syntax for type boolean: \"%s\"", string(s))
+}
+
+func encodeText(buf []byte, s []byte) ([]byte, error) {
+	return append(buf, s...), nil
+}
+
+// the jsonb binary form is the version number 1 and the text
+func encodeJsonb(buf []byte, s []byte) ([]byte, error) {
+	return append(append(buf, 1), s...), nil
+}
+
+// encodeBytea decode the hex format (\x0102) or the escape format of bytea
+func encodeBytea(buf []byte, s []byte) ([]byte, error) {
+	if len(s) >= 2 && s[0] == '\\' && s[1] == 'x' {
+		var hi = -1
+		for _, c := range s[2:] {
+			if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+				if hi >= 0 {
+					return nil, fmt.Errorf("invalid hexadecimal data: odd number of digits")
+				}
+				continue
+			}
+			v := hexValue(c)
+			if v < 0 {
+				return nil, fmt.Errorf("invalid hexadecimal digit: \"%c\"", c)
+			}
+			if hi < 0 {
+				hi = v
+			} else {
+				buf = append(buf, byte(hi << 4 | v))
+				hi = -1
+			}
+		}
+		if hi >= 0 {
+			return nil, fmt.Errorf("invalid hexadecimal data: odd number of digits")
+		}
+		return buf, nil
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			buf = append(buf, s[i])
+		} else if i+1 < len(s) && s[i+1] == '\\' {
+			buf = append(buf, '\\')
+			i++
+		} else if i+3 < len(s) && s[i+1] >= '0' && s[i+1] <= '3' &&
+			s[i+2] >= '0' && s[i+2] <= '7' && s[i+3] >= '0' && s[i+3] <= '7' {
+			buf = append(buf, (s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3]-'0'))
+			i += 3
+		} else {
+			return nil, fmt.Errorf("invalid input syntax for type bytea")
+		}
+	}
+	return buf, nil
+}
+
+func encodeDate(buf []byte, s []byte) ([]byte, error) {
+	d, err := pghash.ParseDate(string(s))
+	if err != nil {
+		return nil, err
+	}
+	return appendInt32(buf, d), nil
+}
+
+func encodeTimestamp(buf []byte, s []byte) ([]byte, error) {
+	ts, err := pghash.ParseTimestamp(string(s))
+	if err != nil {
+		return nil, err
+	}
+	return appendInt64(buf, ts), nil
+}
+
+func encodeUUID(buf []byte, s []byte) ([]byte, error) {
+	u, err := pghash.ParseUUID(string(s))
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, u...), nil
+}
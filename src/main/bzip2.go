@@ -0,0 +1,230 @@
+package main
+
+// split the bzip2 file by the blocks, as pbzip2 and lbzip2 do. the blocks
+// are not byte aligned, each block starts with the 48 bits magic 0x314159265359
+// and the block crc, the stream ends with the magic 0x177245385090 and the
+// combined crc of the blocks. the block magic is searched at every bit
+// position, and a run of the blocks is copied bit by bit to a new stream,
+// with the end of stream magic and the combined crc, then it can be read by
+// compress/bzip2 alone.
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	BZIP2_BLOCK_MAGIC uint64 = 0x314159265359
+	BZIP2_EOS_MAGIC uint64 = 0x177245385090
+	BZIP2_MAX_ORIG_PTR = 900000
+)
+
+// bzip2MagicPattern is the magic at a bit shift in the 7 bytes window, the
+// full bytes are searched by bytes.Index first, then the partial bytes are
+// checked by the mask
+type bzip2MagicPattern struct {
+	magic uint64
+	shift uint
+	full []byte // the full bytes
+	fullStart int // the position of the full bytes in the window
+	value uint64 // the 56 bits window value and mask
+	mask uint64
+}
+
+func newBzip2MagicPatterns(magic uint64) []*bzip2MagicPattern {
+	patterns := make([]*bzip2MagicPattern, 0, 8)
+	for s := uint(0); s < 8; s++ {
+		p := &bzip2MagicPattern{
+			magic: magic,
+			shift: s,
+			value: magic << (8 - s),
+			mask: ((uint64(1) << 48) - 1) << (8 - s),
+		}
+		window := make([]byte, 8)
+		for i := 0; i < 7; i++ {
+			window[i] = byte(p.value >> (48 - 8*uint(i)))
+		}
+		if s == 0 {
+			p.full, p.fullStart = window[0:6], 0
+		} else {
+			p.full, p.fullStart = window[1:6], 1
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// window56 get the 56 bits at the position of buf
+func window56(buf []byte) uint64 {
+	var v uint64
+	for i := 0; i < 7; i++ {
+		v <<= 8
+		if i < len(buf) {
+			v |= uint64(buf[i])
+		}
+	}
+	return v
+}
+
+// readBits read n (<= 57) bits at the bit position of the file
+func readBits(fd *os.File, bitpos int64, n uint) (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := fd.ReadAt(buf, bitpos / 8); err != nil && err != io.EOF {
+		return 0, err
+	}
+	v := uint64(0)
+	for _, b := range buf {
+		v = v << 8 | uint64(b)
+	}
+	return (v << uint(bitpos % 8)) >> (64 - n), nil
+}
+
+// findBzip2Blocks get all the blocks in the file (all the streams), the
+// block size is up to the next block or the end of stream magic
+func findBzip2Blocks(fd *os.File, size int64) ([]*Segment, error) {
+	type mark struct {
+		pos int64
+		eos bool
+	}
+	marks := make([]mark, 0)
+	patterns := append(newBzip2MagicPatterns(BZIP2_BLOCK_MAGIC), newBzip2MagicPatterns(BZIP2_EOS_MAGIC)...)
+
+	const blocksize = 8 * 1024 * 1024
+	const overlap = 8
+	buf := make([]byte, blocksize + overlap)
+	for offset := int64(0); offset < size; offset += blocksize {
+		n, err := fd.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		data := buf[:n]
+		for _, p := range patterns {
+			for from := 0; ; {
+				i := bytes.Index(data[from:], p.full)
+				if i < 0 {
+					break
+				}
+				q := from + i - p.fullStart
+				from += i + 1
+				// the window starts in this block, the overlap is for the
+				// match crossing the block end
+				if q < 0 || q >= blocksize {
+					continue
+				}
+				if window56(data[q:]) & p.mask != p.value {
+					continue
+				}
+				marks = append(marks, mark{(offset + int64(q)) * 8 + int64(p.shift), p.magic == BZIP2_EOS_MAGIC})
+			}
+		}
+	}
+	sort.Slice(marks, func(i, j int) bool { return marks[i].pos < marks[j].pos })
+
+	segments := make([]*Segment, 0)
+	for i, m := range marks {
+		if m.eos {
+			continue
+		}
+		if i+1 >= len(marks) {
+			return nil, nil
+		}
+		// magic, crc, randomised bit and the origPtr, the false magic in the
+		// compressed data is very unlikely to pass
+		crc, err := readBits(fd, m.pos + 48, 32)
+		if err != nil {
+			return nil, err
+		}
+		flags, err := readBits(fd, m.pos + 80, 25)
+		if err != nil {
+			return nil, err
+		}
+		if flags >> 24 != 0 || flags & 0xffffff >= BZIP2_MAX_ORIG_PTR {
+			continue
+		}
+		segments = append(segments, &Segment{offset: m.pos, size: marks[i+1].pos - m.pos, crc: uint32(crc)})
+	}
+	return segments, nil
+}
+
+// bitWriter write the bits to the writer, msb first
+type bitWriter struct {
+	w *bufio.Writer
+	acc uint64
+	n uint
+}
+
+func (this *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		k := n
+		if k > 32 {
+			k = 32
+		}
+		n -= k
+		this.acc = this.acc << k | ((v >> n) & (uint64(1) << k - 1))
+		this.n += k
+		for this.n >= 8 {
+			this.n -= 8
+			this.w.WriteByte(byte(this.acc >> this.n))
+		}
+	}
+}
+
+// flush the last bits with zero padding
+func (this *bitWriter) flush() error {
+	if this.n > 0 {
+		this.w.WriteByte(byte(this.acc << (8 - this.n)))
+		this.n = 0
+	}
+	return this.w.Flush()
+}
+
+// newBzip2BlockReader make a bzip2 stream of the blocks
+func newBzip2BlockReader(fd *os.File, blocks []*Segment) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		w := &bitWriter{w: bufio.NewWriterSize(pw, 1024*1024)}
+		w.w.WriteString("BZh9")
+		var combined uint32
+		for _, b := range blocks {
+			if err := copyBits(w, fd, b.offset, b.size); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			combined = (combined << 1 | combined >> 31) ^ b.crc
+		}
+		w.writeBits(BZIP2_EOS_MAGIC, 48)
+		w.writeBits(uint64(combined), 32)
+		pw.CloseWithError(w.flush())
+	}()
+	return pr
+}
+
+// copyBits copy n bits at the bit position of the file to the writer
+func copyBits(w *bitWriter, fd *os.File, bitpos int64, n int64) error {
+	skip := uint(bitpos % 8)
+	r := bufio.NewReaderSize(io.NewSectionReader(fd, bitpos / 8, (int64(skip) + n + 7) / 8), 1024*1024)
+	first := true
+	for n > 0 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		bits := uint(8)
+		v := uint64(c)
+		if first {
+			bits -= skip
+			v &= uint64(1) << bits - 1
+			first = false
+		}
+		if int64(bits) > n {
+			v >>= bits - uint(n)
+			bits = uint(n)
+		}
+		w.writeBits(v, bits)
+		n -= int64(bits)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+// the checkpointed load, the copy of each node is committed in batches, and
+// the bytes of each chunk committed on each node are kept in the checkpoint
+// file of the table, so a crashed or failed load can be resumed by
+//
+//   main load.yml --resume
+//
+// the baskets of a reader have the rows of one chunk, and a basket knows the
+// offset in the chunk up to which all the rows for its node are in the
+// basket or the ones before it (upto), the baskets of a chunk go to a node in
+// order, so after a batch is committed on the node, the rows of the chunk up
+// to the last upto are on the node, and none after it.
+//
+// a batch is a transaction, the xid of it is saved to the checkpoint before
+// the commit, the resumed load checks the status of the xid on the node, so
+// the batch committed just before a crash is not loaded again.
+//
+// on resume, the rows up to the committed offset of all nodes are skipped,
+// the rows after it are routed, and dropped if they are committed on their
+// node already. a chunk committed on all nodes is not read again, its head
+// and tail are kept in the checkpoint for joining the records around it, the
+// joined records are the last entry of the chunks.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the committed state of a chunk, the offsets are relative to the chunk
+// start, of the decompressed data
+type CheckpointChunk struct {
+	Path string `json:"path"` // empty for the joined records
+	Offset int64 `json:"offset"`
+	Size int64 `json:"size"`
+	Committed []int64 `json:"committed"` // the bytes committed on each node
+	Rows []int64 `json:"rows"` // the rows committed on each node
+	Read bool `json:"read"` // the chunk is read, the end, head and tail are known
+	End int64 `json:"end"` // the end of the last record of the chunk
+	// the raw bytes, a chunk may start or end in a multibyte character or
+	// the data is not utf-8, so they are not strings in the json (base64)
+	Head []byte `json:"head"`
+	Tail []byte `json:"tail"`
+	Boundary bool `json:"boundary"`
+}
+
+// the progress of a batch of a node, index by the chunk
+type BatchProgress struct {
+	Xid string `json:"xid"`
+	Upto map[int]int64 `json:"upto"`
+	Rows map[int]int64 `json:"rows"`
+}
+
+func NewBatchProgress() *BatchProgress {
+	return &BatchProgress{Upto: make(map[int]int64), Rows: make(map[int]int64)}
+}
+
+// add the rows of the basket to the batch
+func (this *BatchProgress) add(b *TupleBasket) {
+	if b.chunk < 0 {
+		return
+	}
+	if b.upto > this.Upto[b.chunk] {
+		this.Upto[b.chunk] = b.upto
+	}
+	this.Rows[b.chunk] += int64(b.rows)
+}
+
+func (this *BatchProgress) empty() bool {
+	return len(this.Upto) == 0
+}
+
+type Checkpoint struct {
+	path string
+	mux sync.Mutex
+	Table string `json:"table"`
+	Nodes []string `json:"nodes"`
+	Chunks []*CheckpointChunk `json:"chunks"`
+	Pending []*BatchProgress `json:"pending"` // the batch being committed of each node
+	Done bool `json:"done"`
+}
+
+// checkpointPath the checkpoint file of the job
+func checkpointPath(jobid int, table string) string {
+	return fmt.Sprintf("%s.%s.%d.checkpoint", g_configfile, table, jobid)
+}
+
+// NewCheckpoint the checkpoint of the chunks of the job, nothing committed
+func NewCheckpoint(path string, tinfo *TableInfo, chunks []*Chunk) *Checkpoint {
+	cp := &Checkpoint{path: path, Table: tinfo.name}
+	for _, dbi := range tinfo.dbinfos {
+		cp.Nodes = append(cp.Nodes, dbi.address())
+	}
+	cp.Pending = make([]*BatchProgress, len(cp.Nodes))
+	for _, chunk := range chunks {
+		cp.Chunks = append(cp.Chunks, &CheckpointChunk{Path: chunk.source.path, Offset: chunk.offset,
+			Size: chunk.chunksize, Committed: make([]int64, len(cp.Nodes)), Rows: make([]int64, len(cp.Nodes))})
+	}
+	cp.Chunks = append(cp.Chunks, &CheckpointChunk{Committed: make([]int64, len(cp.Nodes)),
+		Rows: make([]int64, len(cp.Nodes))})
+	return cp
+}
+
+// LoadCheckpoint read the checkpoint of the last run, it should be of the
+// same chunks and nodes
+func LoadCheckpoint(path string, tinfo *TableInfo, chunks []*Chunk) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s, %s", path, err.Error())
+	}
+	cp.path = path
+	expect := NewCheckpoint(path, tinfo, chunks)
+	if cp.Table != expect.Table || strings.Join(cp.Nodes, ",") != strings.Join(expect.Nodes, ",") {
+		return nil, fmt.Errorf("checkpoint %s is of table %s on %s", path, cp.Table, strings.Join(cp.Nodes, ","))
+	}
+	if len(cp.Chunks) != len(expect.Chunks) || len(cp.Pending) != len(cp.Nodes) {
+		return nil, fmt.Errorf("checkpoint %s has %d chunks, not %d, resume with the same files, readers "+
+			"and io read size", path, len(cp.Chunks)-1, len(chunks))
+	}
+	for i, c := range cp.Chunks {
+		e := expect.Chunks[i]
+		if c.Path != e.Path || c.Offset != e.Offset || c.Size != e.Size ||
+			len(c.Committed) != len(cp.Nodes) || len(c.Rows) != len(cp.Nodes) {
+			return nil, fmt.Errorf("checkpoint %s chunk %d is %s at %d of %d bytes, resume with the same "+
+				"files, readers and io read size", path, i, c.Path, c.Offset, c.Size)
+		}
+	}
+	return cp, nil
+}
+
+// save write the checkpoint to a temporary file and rename it, so the file
+// is always complete, it is called with the lock
+func (this *Checkpoint) save() error {
+	data, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := this.path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("fail to write checkpoint %s, %s", tmp, err.Error())
+	}
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err == nil {
+		err = os.Rename(tmp, this.path)
+	}
+	if err != nil {
+		return fmt.Errorf("fail to write checkpoint %s, %s", this.path, err.Error())
+	}
+	if dir, err := os.Open(filepath.Dir(this.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// apply the committed batch of the node
+func (this *Checkpoint) apply(node int, batch *BatchProgress) {
+	for i, upto := range batch.Upto {
+		c := this.Chunks[i]
+		if upto > c.Committed[node] {
+			c.Committed[node] = upto
+		}
+		c.Rows[node] += batch.Rows[i]
+	}
+}
+
+// prepare save the xid of the batch of the node before it is committed
+func (this *Checkpoint) prepare(node int, batch *BatchProgress, xid string) error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	batch.Xid = xid
+	this.Pending[node] = batch
+	return this.save()
+}
+
+// commit the batch of the node is committed
+func (this *Checkpoint) commit(node int, batch *BatchProgress) error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.Pending[node] = nil
+	this.apply(node, batch)
+	return this.save()
+}
+
+// resolve the batches being committed when the last run stopped, a batch is
+// committed if its transaction is committed on the node
+func (this *Checkpoint) resolve(senders []*Sender) error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+
+	for node, batch := range this.Pending {
+		if batch == nil {
+			continue
+		}
+		if _, err := strconv.ParseInt(batch.Xid, 10, 64); err != nil {
+			return fmt.Errorf("invalid xid %q of the pending batch", batch.Xid)
+		}
+		status, err := senders[node].query("SELECT txid_status(" + batch.Xid + ")")
+		if err != nil {
+			return err
+		}
+		switch status {
+		case "committed":
+			this.apply(node, batch)
+		case "in progress":
+			return fmt.Errorf("the batch of xid %s is still in progress on %s", batch.Xid, this.Nodes[node])
+		}
+		logger.Info("%s the pending batch of xid %s on %s is %s", this.Table, batch.Xid, this.Nodes[node],
+			status)
+		this.Pending[node] = nil
+	}
+	return this.save()
+}
+
+// read keep the end, head and tail of the chunk which is read, they are
+// saved with the next commit
+func (this *Checkpoint) read(index int, end int64, head string, tail string, boundary bool) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	c := this.Chunks[index]
+	c.Read, c.End, c.Head, c.Tail, c.Boundary = true, end, []byte(head), []byte(tail), boundary
+}
+
+// skip the bytes of the chunk committed on each node, the remain is the
+// head and tail of the chunk if it is committed on all nodes, then it is not
+// read again
+func (this *Checkpoint) skip(index int) ([]int64, *ChunkRemainer) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	c := this.Chunks[index]
+	committed := append([]int64{}, c.Committed...)
+	if !c.Read {
+		return committed, nil
+	}
+	for _, n := range committed {
+		if n < c.End {
+			return committed, nil
+		}
+	}
+	return committed, &ChunkRemainer{index, string(c.Head), string(c.Tail), c.Boundary}
+}
+
+// finish the load of the table is done
+func (this *Checkpoint) finish() error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.Done = true
+	return this.save()
+}
+
+// String the rows committed on each node
+func (this *Checkpoint) String() string {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	rows := make([]int64, len(this.Nodes))
+	for _, c := range this.Chunks {
+		for i, n := range c.Rows {
+			rows[i] += n
+		}
+	}
+	nodes := make([]string, len(this.Nodes))
+	for i, node := range this.Nodes {
+		nodes[i] = fmt.Sprintf("%s %d", node, rows[i])
+	}
+	return "rows committed: " + strings.Join(nodes, ", ")
+}
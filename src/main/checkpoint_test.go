@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// checkpointTable the csv file partitioned by the first column on 3 nodes
+func checkpointTable(path string) *TableInfo {
+	f := NewCSVFormat()
+	return &TableInfo{name: "t", datapath: []string{path}, partitionField: []int{1},
+		partitionFieldType: []string{"integer"}, format: f, input: f, dbinfos: make([]DBInfo, 3)}
+}
+
+// checkpointJob make the checkpointed job of the table, the checkpoint is in
+// the dir
+func checkpointJob(t *testing.T, dir string, path string, resume bool) *Job {
+	j, err := checkpointJobError(dir, checkpointTable(path), resume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(j.closeSources)
+	if err := j.findChunkStates(); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+// checkpointJobError make and validate the job, the error of the checkpoint
+// is returned
+func checkpointJobError(dir string, tinfo *TableInfo, resume bool) (*Job, error) {
+	saved := []interface{}{g_configfile, g_checkpoint, g_resume}
+	g_configfile, g_checkpoint, g_resume = dir+"/load.yml", true, resume
+	defer func() {
+		g_configfile, g_checkpoint, g_resume = saved[0].(string), saved[1].(bool), saved[2].(bool)
+	}()
+	var jwg sync.WaitGroup
+	j, err := NewJob(0, tinfo, &jwg)
+	if err != nil {
+		return j, err
+	}
+	if err := j.validate(); err != nil {
+		j.closeSources()
+		return j, err
+	}
+	return j, nil
+}
+
+// drainBaskets read the job, and get the baskets of each node in the queue
+// order
+func drainBaskets(j *Job) [][]*TupleBasket {
+	runReaders(j)
+	baskets := make([][]*TupleBasket, len(j.nodedq))
+	for i, q := range j.nodedq {
+		for q.size() > 0 {
+			b, _ := q.popQ(context.Background())
+			baskets[i] = append(baskets[i], b)
+		}
+	}
+	return baskets
+}
+
+// TestCheckpointResume commit some batches of the nodes, and crash with a
+// batch being committed, the resumed load sends each row not committed once
+func TestCheckpointResume(t *testing.T) {
+	var data strings.Builder
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&data, "%d,name %d\n", i, i)
+	}
+	path := writeTemp(t, data.String())
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setReaders(t, 4, 16)
+	g_DataQueueSize = 64
+
+	j := checkpointJob(t, dir, path, false)
+	if len(j.chunks) < 3 {
+		t.Fatalf("%d chunks", len(j.chunks))
+	}
+	joined := len(j.chunks)
+
+	// the first chunk is committed on all nodes, the second on node 0, and
+	// the joined records on node 1, the third chunk of node 2 is being
+	// committed when it crashes, it is not committed on the node
+	commit := func(node int, chunk int) bool {
+		return chunk == 0 || (chunk == 1 && node == 0) || (chunk == joined && node == 1)
+	}
+	committed := make([][]string, 3)
+	for node, baskets := range drainBaskets(j) {
+		batch := NewBatchProgress()
+		pending := NewBatchProgress()
+		for _, b := range baskets {
+			if commit(node, b.chunk) {
+				batch.add(b)
+				committed[node] = append(committed[node], basketRecords(t, j.tableinfo.format, b)...)
+			} else if node == 2 && b.chunk == 2 {
+				pending.add(b)
+			}
+			b.release()
+		}
+		if err := j.checkpoint.prepare(node, batch, fmt.Sprintf("%d", 100+node)); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.checkpoint.commit(node, batch); err != nil {
+			t.Fatal(err)
+		}
+		if !pending.empty() {
+			if err := j.checkpoint.prepare(node, pending, "200"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	saved := j.checkpoint
+
+	// the checkpoint exists, the load should be resumed
+	if _, err := checkpointJobError(dir, checkpointTable(path), false); err == nil {
+		t.Errorf("the load is not resumed, no error")
+	}
+
+	j = checkpointJob(t, dir, path, true)
+	cp := j.checkpoint
+	if cp == nil || cp == saved {
+		t.Fatal("the checkpoint is not loaded")
+	}
+	if !reflect.DeepEqual(cp.Chunks, saved.Chunks) {
+		t.Errorf("loaded chunks %+v, want %+v", cp.Chunks, saved.Chunks)
+	}
+	if cp.Pending[2] == nil || cp.Pending[2].Xid != "200" || cp.Pending[0] != nil {
+		t.Errorf("loaded pending batches %+v", cp.Pending)
+	}
+	if skip, remain := cp.skip(0); remain == nil {
+		t.Errorf("chunk 0 committed on all nodes is read again, %v", skip)
+	}
+	if skip, remain := cp.skip(1); remain != nil || skip[0] == 0 || skip[1] != 0 {
+		t.Errorf("chunk 1 skip %v, remain %v", skip, remain)
+	}
+	// the pending batch is not known to be committed, as it is aborted
+	cp.Pending[2] = nil
+
+	for node, baskets := range drainBaskets(j) {
+		records := append([]string{}, committed[node]...)
+		for _, b := range baskets {
+			records = append(records, basketRecords(t, j.tableinfo.format, b)...)
+			b.release()
+		}
+		sort.Strings(records)
+		for i := 1; i < len(records); i++ {
+			if records[i] == records[i-1] {
+				t.Errorf("node %d: %q is loaded twice", node, records[i])
+			}
+		}
+		for i := 0; i < 300; i++ {
+			record := fmt.Sprintf("%d,name %d\n", i, i)
+			slice, _ := j.partitionKey.Route([]byte(record), nil)
+			found := sort.SearchStrings(records, record)
+			if (slice == node) != (found < len(records) && records[found] == record) {
+				t.Errorf("node %d: %q is lost or on the wrong node", node, record)
+			}
+		}
+	}
+}
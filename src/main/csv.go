@@ -0,0 +1,377 @@
+package main
+
+// csv record and field scanning, follows the way postgresql COPY parses the
+// csv, the record ends at a newline outside the quotes, so a quoted field can
+// contain the delimiter and newlines, a quote in a quoted field is escaped by
+// the escape character (doubled quote by default, as RFC 4180).
+//
+// to find the record boundary, the scanner runs a small state machine, the
+// same as CopyReadLineText does:
+//   CSV_STATE_OUT:     out of the quotes
+//   CSV_STATE_IN:      in the quotes
+//   CSV_STATE_IN_ESC:  in the quotes, and the last char is an escape char
+// the escape is only special in the quotes, and when it is the same as the
+// quote, the quote is just a toggle.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"loadconfig"
+	"strings"
+)
+
+const (
+	CSV_STATE_OUT int = iota
+	CSV_STATE_IN
+	CSV_STATE_IN_ESC
+)
+
+var (
+	ErrUnterminatedQuote = errors.New("unterminated CSV quoted field")
+)
+
+type CSVFormat struct {
+	delim byte
+	quote byte
+	escape byte
+	null string
+	forceNull []string // column names
+	forceNotNull []string
+	// the field positions (start from 1) of the force columns, set by
+	// bindColumns
+	forceNullFields map[int]bool
+	forceNotNullFields map[int]bool
+}
+
+// NewCSVFormat make the default format, "NULL" is the null string
+func NewCSVFormat() *CSVFormat {
+	return &CSVFormat{
+		delim: ',',
+		quote: '"',
+		escape: '"',
+		null: "NULL",
+	}
+}
+
+// NewCSVFormatFromConfig make the format by the table settings, and check
+// them the same way as the COPY command does
+func NewCSVFormatFromConfig(t *loadconfig.Table) (*CSVFormat, error) {
+	f := NewCSVFormat()
+	var err error
+	if t.Delimiter != "" {
+		if f.delim, err = formatChar("delimiter", t.Delimiter); err != nil {
+			return nil, err
+		}
+	}
+	if t.Quote != "" {
+		if f.quote, err = formatChar("quote", t.Quote); err != nil {
+			return nil, err
+		}
+		f.escape = f.quote
+	}
+	if t.Escape != "" {
+		if f.escape, err = formatChar("escape", t.Escape); err != nil {
+			return nil, err
+		}
+	}
+	if t.Null != nil {
+		f.null = *t.Null
+	}
+	f.forceNull = t.ForceNull
+	f.forceNotNull = t.ForceNotNull
+
+	if f.delim == '\n' || f.delim == '\r' {
+		return nil, fmt.Errorf("delimiter cannot be newline or carriage return")
+	}
+	if strings.ContainsAny(f.null, "\r\n") {
+		return nil, fmt.Errorf("null representation cannot use newline or carriage return")
+	}
+	if f.delim == f.quote {
+		return nil, fmt.Errorf("delimiter and quote must be different")
+	}
+	if strings.IndexByte(f.null, f.delim) >= 0 {
+		return nil, fmt.Errorf("delimiter must not appear in the null specification")
+	}
+	if strings.IndexByte(f.null, f.quote) >= 0 {
+		return nil, fmt.Errorf("quote must not appear in the null specification")
+	}
+	return f, nil
+}
+
+func formatChar(name string, s string) (byte, error) {
+	if len(s) != 1 {
+		return 0, fmt.Errorf("%s must be a single one-byte character", name)
+	}
+	return s[0], nil
+}
+
+// bindColumns find the field positions of the force columns, it is called
+// when the columns of the table are known
+func (this *CSVFormat) bindColumns(columns []string) error {
+	var err error
+	this.forceNullFields, err = columnFields(columns, this.forceNull)
+	if err != nil {
+		return fmt.Errorf("force null %s", err.Error())
+	}
+	this.forceNotNullFields, err = columnFields(columns, this.forceNotNull)
+	if err != nil {
+		return fmt.Errorf("force not null %s", err.Error())
+	}
+	return nil
+}
+
+func columnFields(columns []string, names []string) (map[int]bool, error) {
+	fields := make(map[int]bool)
+	for _, name := range names {
+		pos := columnPosition(columns, unquoteIdent(name))
+		if pos < 0 {
+			return nil, fmt.Errorf("column %s not in the columns", name)
+		}
+		fields[pos] = true
+	}
+	return fields, nil
+}
+
+// isNull check whether the field is null, the same as COPY, the unquoted
+// null string is null, the force not null column is never null, and the
+// quoted null string is also null for the force null column
+func (this *CSVFormat) isNull(field int, value []byte, quoted bool) bool {
+	if this.forceNotNullFields[field] || string(value) != this.null {
+		return false
+	}
+	return !quoted || this.forceNullFields[field]
+}
+
+// CopyOptions make the options of the COPY command for the format
+func (this *CSVFormat) CopyOptions() string {
+	options := []string{
+		"FORMAT csv",
+		"DELIMITER " + QuoteLiteral(string(this.delim)),
+		"QUOTE " + QuoteLiteral(string(this.quote)),
+		"ESCAPE " + QuoteLiteral(string(this.escape)),
+		"NULL " + QuoteLiteral(this.null),
+	}
+	if len(this.forceNull) > 0 {
+		options = append(options, "FORCE_NULL (" + strings.Join(this.forceNull, ", ") + ")")
+	}
+	if len(this.forceNotNull) > 0 {
+		options = append(options, "FORCE_NOT_NULL (" + strings.Join(this.forceNotNull, ", ") + ")")
+	}
+	return strings.Join(options, ", ")
+}
+
+// AppendRecord the field is quoted if it has the delimiter, the quote or the
+// newline, or it looks like the null string or the end-of-data marker, the
+// quote and the escape char in the quoted field are escaped
+func (this *CSVFormat) AppendRecord(buf []byte, fields [][]byte, nulls []bool) []byte {
+	for i, field := range fields {
+		if i > 0 {
+			buf = append(buf, this.delim)
+		}
+		if nulls[i] {
+			buf = append(buf, this.null...)
+			continue
+		}
+		if string(field) != this.null && string(field) != "\\." &&
+			bytes.IndexByte(field, this.delim) < 0 && bytes.IndexByte(field, this.quote) < 0 &&
+			bytes.IndexAny(field, "\r\n") < 0 {
+			buf = append(buf, field...)
+			continue
+		}
+		buf = append(buf, this.quote)
+		for _, c := range field {
+			if c == this.quote || c == this.escape {
+				buf = append(buf, this.escape)
+			}
+			buf = append(buf, c)
+		}
+		buf = append(buf, this.quote)
+	}
+	return append(buf, '\n')
+}
+
+// the escape char only takes effect when it is different from the quote
+func (this *CSVFormat) lineEscape() (byte, bool) {
+	return this.escape, this.escape != this.quote
+}
+
+// step move the scanner state by one char
+func (this *CSVFormat) step(state int, c byte) int {
+	escape, hasEscape := this.lineEscape()
+	switch state {
+	case CSV_STATE_OUT:
+		if c == this.quote {
+			return CSV_STATE_IN
+		}
+	case CSV_STATE_IN:
+		if hasEscape && c == escape {
+			return CSV_STATE_IN_ESC
+		} else if c == this.quote {
+			return CSV_STATE_OUT
+		}
+	case CSV_STATE_IN_ESC:
+		// the escaped char (quote or another escape) is literal
+		return CSV_STATE_IN
+	}
+	return state
+}
+
+// FindRecordEnd find the newline out of the quotes
+func (this *CSVFormat) FindRecordEnd(buf []byte, state *int) int {
+	s := *state
+	for i := 0; i < len(buf); i++ {
+		c := buf[i]
+		if s == CSV_STATE_OUT {
+			// fast path, jump to the next special char
+			j := indexAnyOf2(buf[i:], '\n', this.quote)
+			if j < 0 {
+				break
+			}
+			i += j
+			c = buf[i]
+			if c == '\n' {
+				*state = CSV_STATE_OUT
+				return i
+			}
+		}
+		s = this.step(s, c)
+	}
+	*state = s
+	return -1
+}
+
+// ScanStates is used to find the real state at the start of each chunk in
+// parallel
+func (this *CSVFormat) ScanStates(buf []byte, states *[FORMAT_STATE_NUM]int) {
+	if len(buf) == 0 {
+		return
+	}
+	// only the pending escape is consumed if there is neither quote nor
+	// escape char
+	escape, _ := this.lineEscape()
+	if bytes.IndexByte(buf, this.quote) < 0 && bytes.IndexByte(buf, escape) < 0 {
+		for i := range states {
+			if states[i] == CSV_STATE_IN_ESC {
+				states[i] = CSV_STATE_IN
+			}
+		}
+		return
+	}
+	for _, c := range buf {
+		for i := range states {
+			states[i] = this.step(states[i], c)
+		}
+	}
+}
+
+// GetNextField parse the field at the start of c, return the unquoted field,
+// whether any part of the field is quoted, and the data after the delimiter
+// (nil if it is the last field), the same as CopyReadAttributesCSV
+func (this *CSVFormat) GetNextField(c []byte) ([]byte, bool, []byte, error) {
+	c = stripLineEnd(c)
+
+	// fast path, no quote in the field
+	i := bytes.IndexByte(c, this.delim)
+	field := c
+	if i >= 0 {
+		field = c[:i]
+	}
+	if bytes.IndexByte(field, this.quote) < 0 {
+		if i >= 0 {
+			return field, false, c[i+1:], nil
+		}
+		return field, false, nil, nil
+	}
+
+	out := make([]byte, 0, len(field))
+	quoted := false
+	p := 0
+	for {
+		// out of the quotes
+		for p < len(c) && c[p] != this.delim && c[p] != this.quote {
+			out = append(out, c[p])
+			p++
+		}
+		if p >= len(c) {
+			return out, quoted, nil, nil
+		}
+		if c[p] == this.delim {
+			return out, quoted, c[p+1:], nil
+		}
+
+		// in the quotes
+		quoted = true
+		p++
+		for {
+			if p >= len(c) {
+				return nil, quoted, nil, ErrUnterminatedQuote
+			}
+			ch := c[p]
+			p++
+			if ch == this.escape && p < len(c) && (c[p] == this.escape || c[p] == this.quote) {
+				out = append(out, c[p])
+				p++
+				continue
+			}
+			if ch == this.quote {
+				break
+			}
+			out = append(out, ch)
+		}
+	}
+}
+
+// GetFieldByIndex get the index-th field (start from 1) of the record
+func (this *CSVFormat) GetFieldByIndex(c []byte, index int) ([]byte, bool, error) {
+	var field []byte
+	var quoted bool
+	var err error
+	rest := c
+	for i := 0; i < index; i++ {
+		if rest == nil {
+			return nil, false, fmt.Errorf("too few fields, field %d not found", index)
+		}
+		field, quoted, rest, err = this.GetNextField(rest)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return field, quoted, nil
+}
+
+func (this *CSVFormat) GetFields(c []byte) ([][]byte, []bool, error) {
+	fields := make([][]byte, 0)
+	nulls := make([]bool, 0)
+	rest := c
+	for i := 1; rest != nil; i++ {
+		field, quoted, next, err := this.GetNextField(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		fields = append(fields, field)
+		nulls = append(nulls, this.isNull(i, field, quoted))
+		rest = next
+	}
+	return fields, nulls, nil
+}
+
+func (this *CSVFormat) GetField(c []byte, index int) ([]byte, bool, error) {
+	field, quoted, err := this.GetFieldByIndex(c, index)
+	if err != nil {
+		return nil, false, err
+	}
+	return field, this.isNull(index, field, quoted), nil
+}
+
+func indexAnyOf2(buf []byte, a byte, b byte) int {
+	i := bytes.IndexByte(buf, a)
+	if i < 0 {
+		return bytes.IndexByte(buf, b)
+	}
+	j := bytes.IndexByte(buf[:i], b)
+	if j >= 0 {
+		return j
+	}
+	return i
+}
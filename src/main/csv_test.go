@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"loadconfig"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type recordEndCase struct {
+	buf string
+	state int
+	end int
+	after int
+}
+
+func TestCSVFindRecordEnd(t *testing.T) {
+	quote := []recordEndCase{
+		{"a,b\nc", CSV_STATE_OUT, 3, CSV_STATE_OUT},
+		{"\"a,b\",c\n", CSV_STATE_OUT, 7, CSV_STATE_OUT},
+		{"\"a\nb\",c\n", CSV_STATE_OUT, 7, CSV_STATE_OUT},
+		{"\"a\"\"\nb\"\n", CSV_STATE_OUT, 7, CSV_STATE_OUT},
+		{"\"a\n", CSV_STATE_OUT, -1, CSV_STATE_IN},
+		{"\"\"", CSV_STATE_OUT, -1, CSV_STATE_OUT},
+		// the chunk starts in the quotes
+		{"b\n\",c\nd", CSV_STATE_IN, 5, CSV_STATE_OUT},
+		{"x\n", CSV_STATE_IN, -1, CSV_STATE_IN},
+		{"", CSV_STATE_IN, -1, CSV_STATE_IN},
+	}
+	// the escape is only special in the quotes
+	backslash := []recordEndCase{
+		{"\"a\\\"\nb\"\n", CSV_STATE_OUT, 7, CSV_STATE_OUT},
+		{"\"a\\\\\"\n", CSV_STATE_OUT, 5, CSV_STATE_OUT},
+		{"a\\\n", CSV_STATE_OUT, 2, CSV_STATE_OUT},
+		{"\"\\", CSV_STATE_OUT, -1, CSV_STATE_IN_ESC},
+		// the chunk starts right after the escape
+		{"\"\n\"\n", CSV_STATE_IN_ESC, 3, CSV_STATE_OUT},
+	}
+	for escape, cases := range map[byte][]recordEndCase{'"': quote, '\\': backslash} {
+		f := NewCSVFormat()
+		f.escape = escape
+		for _, c := range cases {
+			state := c.state
+			end := f.FindRecordEnd([]byte(c.buf), &state)
+			if end != c.end || state != c.after {
+				t.Errorf("escape %c: FindRecordEnd(%q, %d) = %d, state %d, want %d, state %d",
+					escape, c.buf, c.state, end, state, c.end, c.after)
+			}
+		}
+	}
+}
+
+func TestCSVScanStates(t *testing.T) {
+	f := NewCSVFormat()
+	f.escape = '\\'
+	cases := []struct {
+		buf string
+		want [FORMAT_STATE_NUM]int
+	}{
+		{"", [FORMAT_STATE_NUM]int{CSV_STATE_OUT, CSV_STATE_IN, CSV_STATE_IN_ESC}},
+		{"abc\n", [FORMAT_STATE_NUM]int{CSV_STATE_OUT, CSV_STATE_IN, CSV_STATE_IN}},
+		{"a\"b", [FORMAT_STATE_NUM]int{CSV_STATE_IN, CSV_STATE_OUT, CSV_STATE_OUT}},
+		{"\\", [FORMAT_STATE_NUM]int{CSV_STATE_OUT, CSV_STATE_IN_ESC, CSV_STATE_IN}},
+		{"\"\"", [FORMAT_STATE_NUM]int{CSV_STATE_OUT, CSV_STATE_IN, CSV_STATE_OUT}},
+	}
+	for _, c := range cases {
+		states := [FORMAT_STATE_NUM]int{CSV_STATE_OUT, CSV_STATE_IN, CSV_STATE_IN_ESC}
+		f.ScanStates([]byte(c.buf), &states)
+		if states != c.want {
+			t.Errorf("ScanStates(%q) = %v, want %v", c.buf, states, c.want)
+		}
+	}
+}
+
+func TestCSVGetFields(t *testing.T) {
+	f := NewCSVFormat()
+	cases := []struct {
+		record string
+		fields []string
+		nulls []bool
+	}{
+		{"a,b,c\n", []string{"a", "b", "c"}, []bool{false, false, false}},
+		{"a,,\r\n", []string{"a", "", ""}, []bool{false, false, false}},
+		{"\"a,b\",c\n", []string{"a,b", "c"}, []bool{false, false}},
+		{"\"say \"\"hi\"\"\",\"\"\"\"\n", []string{"say \"hi\"", "\""}, []bool{false, false}},
+		{"\"line1\nline2\",x\n", []string{"line1\nline2", "x"}, []bool{false, false}},
+		{"ab\"c\"d,e\n", []string{"abcd", "e"}, []bool{false, false}},
+		{"NULL,\"NULL\",\"\"\n", []string{"NULL", "NULL", ""}, []bool{true, false, false}},
+		{"x\n", []string{"x"}, []bool{false}},
+	}
+	for _, c := range cases {
+		fields, nulls, err := f.GetFields([]byte(c.record))
+		if err != nil {
+			t.Errorf("GetFields(%q) %s", c.record, err.Error())
+			continue
+		}
+		got := make([]string, len(fields))
+		for i, field := range fields {
+			got[i] = string(field)
+		}
+		if !reflect.DeepEqual(got, c.fields) || !reflect.DeepEqual(nulls, c.nulls) {
+			t.Errorf("GetFields(%q) = %q %v, want %q %v", c.record, got, nulls, c.fields, c.nulls)
+		}
+		for i := range c.fields {
+			field, null, err := f.GetField([]byte(c.record), i+1)
+			if err != nil || string(field) != c.fields[i] || null != c.nulls[i] {
+				t.Errorf("GetField(%q, %d) = %q %v %v", c.record, i+1, field, null, err)
+			}
+		}
+	}
+
+	for _, record := range []string{"\"a\n", "a,\"b\"\"\n"} {
+		if _, _, err := f.GetFields([]byte(record)); err != ErrUnterminatedQuote {
+			t.Errorf("GetFields(%q) error %v, want %v", record, err, ErrUnterminatedQuote)
+		}
+	}
+	if _, _, err := f.GetField([]byte("a,b\n"), 3); err == nil {
+		t.Errorf("GetField of the missing field, no error")
+	}
+}
+
+func TestCSVAppendRecord(t *testing.T) {
+	f := NewCSVFormat()
+	cases := []struct {
+		fields []string
+		nulls []bool
+		record string
+	}{
+		{[]string{"a", "b"}, []bool{false, false}, "a,b\n"},
+		{[]string{"a,b", "say \"hi\""}, []bool{false, false}, "\"a,b\",\"say \"\"hi\"\"\"\n"},
+		{[]string{"x\ny", "\r"}, []bool{false, false}, "\"x\ny\",\"\r\"\n"},
+		{[]string{"", "NULL", "\\."}, []bool{true, false, false}, "NULL,\"NULL\",\"\\.\"\n"},
+		{[]string{""}, []bool{false}, "\n"},
+	}
+	for _, c := range cases {
+		fields := make([][]byte, len(c.fields))
+		for i, field := range c.fields {
+			fields[i] = []byte(field)
+		}
+		record := string(f.AppendRecord(nil, fields, c.nulls))
+		if record != c.record {
+			t.Errorf("AppendRecord(%q) = %q, want %q", c.fields, record, c.record)
+			continue
+		}
+		// read back the same fields, the empty record is a single field
+		got, nulls, err := f.GetFields([]byte(record))
+		if err != nil {
+			t.Errorf("GetFields(%q) %s", record, err.Error())
+			continue
+		}
+		for i := range got {
+			if nulls[i] != c.nulls[i] || (!nulls[i] && string(got[i]) != c.fields[i]) {
+				t.Errorf("AppendRecord(%q) read back %q %v", c.fields, got, nulls)
+			}
+		}
+	}
+}
+
+// csvRecords the records have the quoted delimiters, the doubled quotes and
+// the newlines in the quotes, the last one has no newline
+var csvRecords = []string{
+	"1,plain,x\n",
+	"2,\"a,b\",\"quoted, delimiter\"\n",
+	"3,\"say \"\"hi\"\"\",\"\"\"\"\n",
+	"4,\"line1\nline2\",\"\n\n\"\n",
+	"5,\"\",\n",
+	"6,\"crlf\r\ninside\",end\r\n",
+	"7,\"ends with \"\"\",\"\"\"\n,\"\"\"\n",
+	"8,last",
+}
+
+// readTable read the data files of the table by the readers, and join the
+// heads and tails of the chunks, the records of all the nodes are returned
+// sorted, and the state found at the start of each chunk is checked with
+// the state scanned from the file start
+func readTable(t *testing.T, tinfo *TableInfo) []string {
+	var jwg sync.WaitGroup
+	j, err := NewJob(0, tinfo, &jwg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.closeSources()
+	if err := j.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.findChunkStates(); err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range j.chunks {
+		if chunk.whole || chunk.source.compression != COMPRESSION_NONE {
+			continue
+		}
+		head := make([]byte, chunk.offset)
+		if _, err := chunk.source.fd.ReadAt(head, 0); err != nil {
+			t.Fatal(err)
+		}
+		states := [FORMAT_STATE_NUM]int{}
+		for s := range states {
+			states[s] = s
+		}
+		tinfo.input.ScanStates(head, &states)
+		if chunk.state != states[FORMAT_STATE_START] {
+			t.Fatalf("%d readers, chunk %d at %d, state %d, want %d", g_readernum, chunk.index,
+				chunk.offset, chunk.state, states[FORMAT_STATE_START])
+		}
+	}
+
+	runReaders(j)
+
+	records := make([]string, 0)
+	for _, q := range j.nodedq {
+		for q.size() > 0 {
+			b, _ := q.popQ(context.Background())
+			records = append(records, basketRecords(t, tinfo.format, b)...)
+			b.release()
+		}
+	}
+	sort.Strings(records)
+	return records
+}
+
+// runReaders read all the chunks of the job, and join the heads and tails,
+// the baskets are left in the queues of the nodes
+func runReaders(j *Job) {
+	tinfo := j.tableinfo
+	chunks := make(chan *Chunk, len(j.chunks))
+	for _, chunk := range j.chunks {
+		chunks <- chunk
+	}
+	close(chunks)
+	for i := 0; i < g_readernum; i++ {
+		j.rwg.Add(1)
+		r := NewReader(i, &j.rwg, j.nodedq, j.remainHolder)
+		r.setPartitionKey(j.partitionKey)
+		r.setRejectFile(j.reject)
+		r.setFormat(tinfo.input)
+		if tinfo.input != tinfo.format {
+			r.setOutputFormat(tinfo.format)
+		}
+		r.setCheckpoint(j.checkpoint)
+		r.startReader(chunks, nil)
+	}
+	j.rwg.Wait()
+	j.AnalyzeChunkHeadAndTail()
+}
+
+// basketRecords split the records of the basket
+func basketRecords(t *testing.T, f Format, b *TupleBasket) []string {
+	records := make([]string, 0)
+	out := b.Bytes()
+	for len(out) > 0 {
+		state := FORMAT_STATE_START
+		end := f.FindRecordEnd(out, &state)
+		if end < 0 {
+			t.Fatalf("%d readers, the record is not ended, %q", g_readernum, out)
+		}
+		records = append(records, string(out[:end+1]))
+		out = out[end+1:]
+	}
+	return records
+}
+
+// writeTemp write the data to a temp file, it is removed by the cleanup
+func writeTemp(t *testing.T, data string) string {
+	f, err := ioutil.TempFile("", "loader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	return f.Name()
+}
+
+// setReaders set the readers and the buffer size, the queues hold all the
+// baskets of the readers, since they are drained after the readers end
+func setReaders(t *testing.T, readers int, bufsize int) {
+	saved := []int{g_readernum, g_bufsize, g_DataQueueSize}
+	g_readernum, g_bufsize, g_DataQueueSize = readers, bufsize, readers+1
+	t.Cleanup(func() { g_readernum, g_bufsize, g_DataQueueSize = saved[0], saved[1], saved[2] })
+}
+
+// TestCSVChunks the file is split at every offset, so the chunks start in and
+// out of the quotes, and right after the escape
+func TestCSVChunks(t *testing.T) {
+	for _, escape := range []string{"\"", "\\"} {
+		records := csvRecords
+		if escape == "\\" {
+			records = append([]string{"9,\"esc \\\" and \\\\\",\"\\\"\n\\\"\"\n"}, records...)
+		}
+		data := strings.Join(records, "")
+		path := writeTemp(t, data)
+		want := append([]string{}, records...)
+		want[len(want)-1] += "\n"
+		sort.Strings(want)
+
+		for readers := 1; readers <= len(data); readers++ {
+			setReaders(t, readers, 1+readers%7)
+			f := NewCSVFormat()
+			f.escape = escape[0]
+			tinfo := &TableInfo{name: "t", datapath: []string{path}, partitionField: []int{2},
+				partitionFieldType: []string{"text"}, format: f, input: f, dbinfos: make([]DBInfo, 3)}
+			got := readTable(t, tinfo)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("escape %s, %d readers\n got %q\nwant %q", escape, readers, got, want)
+			}
+		}
+	}
+}
+
+func strptr(s string) *string {
+	return &s
+}
+
+// TestCSVFormatOptions the delimiter, quote, escape and null of the table
+func TestCSVFormatOptions(t *testing.T) {
+	cases := []struct {
+		table loadconfig.Table
+		record string
+		fields []string
+		nulls []bool
+		options string
+	}{
+		{
+			loadconfig.Table{Delimiter: "|", Quote: "'", Escape: `\`},
+			`1|'a|b'|'it\'s'|'x\\y'|'l1` + "\n" + `l2'|NULL` + "\n",
+			[]string{"1", "a|b", "it's", `x\y`, "l1\nl2", "NULL"},
+			[]bool{false, false, false, false, false, true},
+			`FORMAT csv, DELIMITER '|', QUOTE '''', ESCAPE E'\\', NULL 'NULL'`,
+		},
+		{
+			// the escape is the quote by default
+			loadconfig.Table{Quote: "'"},
+			`'it''s','"a"'` + "\n",
+			[]string{"it's", `"a"`},
+			[]bool{false, false},
+			`FORMAT csv, DELIMITER ',', QUOTE '''', ESCAPE '''', NULL 'NULL'`,
+		},
+		{
+			// only the unquoted null marker is null
+			loadconfig.Table{Delimiter: "\t", Null: strptr(`\N`)},
+			`\N` + "\t" + `"\N"` + "\t\t" + `""` + "\n",
+			[]string{`\N`, `\N`, "", ""},
+			[]bool{true, false, false, false},
+			"FORMAT csv, DELIMITER '\t', QUOTE '\"', ESCAPE '\"', NULL E'\\\\N'",
+		},
+		{
+			loadconfig.Table{Null: strptr("")},
+			`,"",x` + "\n",
+			[]string{"", "", "x"},
+			[]bool{true, false, false},
+			`FORMAT csv, DELIMITER ',', QUOTE '"', ESCAPE '"', NULL ''`,
+		},
+		{
+			// the quoted null marker of the force null column is null, and
+			// the force not null column is never null
+			loadconfig.Table{Null: strptr(""), ForceNull: []string{"b"}, ForceNotNull: []string{"c"}},
+			`,"",` + "\n",
+			[]string{"", "", ""},
+			[]bool{true, true, false},
+			`FORMAT csv, DELIMITER ',', QUOTE '"', ESCAPE '"', NULL '', FORCE_NULL (b), FORCE_NOT_NULL (c)`,
+		},
+	}
+	columns := []string{"a", "b", "c", "d", "e", "f"}
+	for i, c := range cases {
+		f, err := NewCSVFormatFromConfig(&c.table)
+		if err != nil {
+			t.Errorf("case %d: %s", i, err.Error())
+			continue
+		}
+		if err := f.bindColumns(columns[:len(c.fields)]); err != nil {
+			t.Errorf("case %d: %s", i, err.Error())
+			continue
+		}
+		if options := f.CopyOptions(); options != c.options {
+			t.Errorf("case %d: CopyOptions() = %s, want %s", i, options, c.options)
+		}
+		state := FORMAT_STATE_START
+		if end := f.FindRecordEnd([]byte(c.record), &state); end != len(c.record)-1 {
+			t.Errorf("case %d: FindRecordEnd(%q) = %d, want %d", i, c.record, end, len(c.record)-1)
+		}
+		fields, nulls, err := f.GetFields([]byte(c.record))
+		if err != nil {
+			t.Errorf("case %d: GetFields(%q) %s", i, c.record, err.Error())
+			continue
+		}
+		got := make([]string, len(fields))
+		for i, field := range fields {
+			got[i] = string(field)
+		}
+		if !reflect.DeepEqual(got, c.fields) || !reflect.DeepEqual(nulls, c.nulls) {
+			t.Errorf("case %d: GetFields(%q) = %q %v, want %q %v", i, c.record, got, nulls, c.fields, c.nulls)
+		}
+
+		// the fields written by the format are read back the same
+		record := f.AppendRecord(nil, fields, nulls)
+		fields2, nulls2, err := f.GetFields(record)
+		if err != nil || !reflect.DeepEqual(fields2, fields) || !reflect.DeepEqual(nulls2, nulls) {
+			t.Errorf("case %d: AppendRecord(%q) = %q, read back %q %v %v", i, c.fields, record,
+				fields2, nulls2, err)
+		}
+	}
+}
+
+// TestCSVFormatConflicts the options are checked as the COPY does
+func TestCSVFormatConflicts(t *testing.T) {
+	cases := []loadconfig.Table{
+		{Delimiter: `"`},
+		{Delimiter: "|", Quote: "|"},
+		{Delimiter: "||"},
+		{Quote: "ab"},
+		{Escape: `\\`},
+		{Delimiter: "\n"},
+		{Delimiter: "\r"},
+		{Null: strptr("a,b")},
+		{Null: strptr(`"x"`)},
+		{Null: strptr("a\r\n")},
+		{Delimiter: "|", Null: strptr("|")},
+	}
+	for _, c := range cases {
+		if _, err := NewCSVFormatFromConfig(&c); err == nil {
+			t.Errorf("%+v is not rejected", c)
+		}
+	}
+
+	// the force columns should be loaded
+	f, err := NewCSVFormatFromConfig(&loadconfig.Table{ForceNull: []string{"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.bindColumns([]string{"a", "b"}); err == nil {
+		t.Errorf("the force null column not in the columns is not rejected")
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"sync"
-	"bytes"
+	"sync/atomic"
 )
 
 
@@ -16,64 +18,136 @@ func (this *TupleData) data() []byte {
 
 
 // no need to add lock for basket, since the basket access only by one go
+// the data of the basket is a slab of the pool, it is taken at the first
+// write, and handed to the sender as a whole, then released to the pool
 type TupleBasket struct {
-	//p []*TupleData
-	blk *bytes.Buffer
+	buf []byte
 	last bool
-	readpos int
+	// for the checkpoint, the chunk of the rows (-1 if not known), the rows
+	// of the chunk for the node up to the offset are in this basket or the
+	// ones before it, see checkpoint.go
+	chunk int
+	upto int64
+	rows int
 }
 
 
 func (this *TupleBasket) Write(t []byte) {
-	this.blk.Write(t)
+	if this.buf == nil {
+		this.buf = g_slabs.get()
+	}
+	this.buf = append(this.buf, t...)
 }
 
-func (this *TupleBasket) Read(d []byte) (n int, err error) {
-	return this.blk.Read(d)
+func (this *TupleBasket) Bytes() []byte {
+	return this.buf
 }
 
 func (this *TupleBasket) Len() int {
-	return this.blk.Len()
+	return len(this.buf)
 }
 
+// Free the bytes left in the slab, a tuple larger than it is written to the
+// next basket, unless the basket is empty
+func (this *TupleBasket) Free() int {
+	return cap(this.buf) - len(this.buf)
+}
 
-type DataQueue struct {
-	q []*TupleBasket
-	mux sync.Mutex
+// release give the slab back to the pool after it is written to the sender
+func (this *TupleBasket) release() {
+	if this.buf != nil {
+		g_slabs.put(this.buf)
+		this.buf = nil
+	}
 }
 
 
-func (this *DataQueue) putQ(tb *TupleBasket) {
-	this.mux.Lock()
-	this.q = append(this.q, tb)
-	this.mux.Unlock()
+// SlabPool is the free list of the basket slabs, all of them are
+// g_BasketTupleSize bytes, the slab grown by a large tuple is not reused,
+// the slabs in use are counted for the memory high water
+type SlabPool struct {
+	allocated int64 // the slabs allocated
+	inuse int64 // the slabs taken and not released
+	highwater int64 // the max slabs in use
+	pool sync.Pool
 }
 
+func NewSlabPool() *SlabPool {
+	p := &SlabPool{}
+	p.pool.New = func() interface{} {
+		atomic.AddInt64(&p.allocated, 1)
+		return make([]byte, 0, g_BasketTupleSize)
+	}
+	return p
+}
 
-func (this *DataQueue) popQ() (*TupleBasket) {
-	this.mux.Lock()
-	if len(this.q) == 0 {
-		this.mux.Unlock()
+func (this *SlabPool) get() []byte {
+	n := atomic.AddInt64(&this.inuse, 1)
+	for {
+		high := atomic.LoadInt64(&this.highwater)
+		if n <= high || atomic.CompareAndSwapInt64(&this.highwater, high, n) {
+			break
+		}
+	}
+	return this.pool.Get().([]byte)
+}
+
+func (this *SlabPool) put(slab []byte) {
+	atomic.AddInt64(&this.inuse, -1)
+	if cap(slab) == g_BasketTupleSize {
+		this.pool.Put(slab[:0])
+	}
+}
+
+// String the memory metrics of the slabs
+func (this *SlabPool) String() string {
+	mb := float64(g_BasketTupleSize) / 1024 / 1024
+	high := atomic.LoadInt64(&this.highwater)
+	return fmt.Sprintf("basket slabs: %d allocated, high water %d slabs (%.1f MB), %d in use",
+		atomic.LoadInt64(&this.allocated), high, float64(high)*mb, atomic.LoadInt64(&this.inuse))
+}
+
+
+// DataQueue is the bounded queue of the baskets of a node, the readers are
+// blocked when it is full, so they never run ahead of the sender more than
+// the queue size, and the go through goroutine is blocked when it is empty,
+// both return when the context of the job is cancelled
+type DataQueue struct {
+	q chan *TupleBasket
+}
+
+
+func (this *DataQueue) putQ(ctx context.Context, tb *TupleBasket) error {
+	select {
+	case this.q <- tb:
 		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+
+func (this *DataQueue) popQ(ctx context.Context) (*TupleBasket, error) {
+	select {
+	case tb := <-this.q:
+		return tb, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	tb := this.q[0]
-	this.q = this.q[1:]
-	this.mux.Unlock()
-	return tb
 }
 
 
 func (this *DataQueue) size() int {
-	this.mux.Lock()
-	s := len(this.q)
-	this.mux.Unlock()
-	return s
+	return len(this.q)
 }
 
 
-func NewDataQueue() *DataQueue {
+func NewDataQueue(size int) *DataQueue {
+	if size < 1 {
+		size = 1
+	}
 	dc := new(DataQueue)
-	dc.q = make([]*TupleBasket, 0)
+	dc.q = make(chan *TupleBasket, size)
 	return dc
 }
 
@@ -81,7 +155,7 @@ func NewDataQueue() *DataQueue {
 func NewTupleBasket() (*TupleBasket) {
 	tb := new(TupleBasket)
 	tb.last = false
-	tb.blk = &bytes.Buffer{}
+	tb.chunk = -1
 	return tb
 }
 
@@ -0,0 +1,176 @@
+package main
+
+// throughput of the basket queues between the readers and the go through
+// goroutines, the polling queue is the old DataQueue (the mutex protected
+// slice, the reader sleeps 100ms while the queue is full, and the go through
+// goroutine sleeps 10ms while it is empty), it is kept here only as the
+// baseline of DataQueue, the package is main, so the files are listed to
+// test it, run it like:
+//
+//   go test -vet=off -run XXX -bench Queue -benchtime 2000000x *.go
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	benchReaders = 5
+	benchNodes = 4
+	benchRowSize = 100
+	benchBasketSize = 64 * 1024
+)
+
+type benchQueue interface {
+	putQ(ctx context.Context, tb *TupleBasket) error
+	popQ(ctx context.Context) (*TupleBasket, error)
+}
+
+// pollingQueue the old DataQueue, the put and pop never block, the callers
+// poll it with the sleeps
+type pollingQueue struct {
+	q []*TupleBasket
+	mux sync.Mutex
+	limit int
+}
+
+func (this *pollingQueue) size() int {
+	this.mux.Lock()
+	s := len(this.q)
+	this.mux.Unlock()
+	return s
+}
+
+func (this *pollingQueue) putQ(ctx context.Context, tb *TupleBasket) error {
+	// the last basket is not limited, the same as the old loader
+	for !tb.last && this.size() >= this.limit {
+		time.Sleep(100 * time.Millisecond)
+	}
+	this.mux.Lock()
+	this.q = append(this.q, tb)
+	this.mux.Unlock()
+	return nil
+}
+
+func (this *pollingQueue) popQ(ctx context.Context) (*TupleBasket, error) {
+	for {
+		this.mux.Lock()
+		if len(this.q) > 0 {
+			tb := this.q[0]
+			this.q = this.q[1:]
+			this.mux.Unlock()
+			return tb, nil
+		}
+		this.mux.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// benchQueues load b.N rows through the queues, the readers write the rows to
+// the baskets of the nodes by the hash of the row number, the go through
+// goroutine of each node drops the baskets after the delay, like a slow node
+func benchQueues(b *testing.B, queues []benchQueue, delay time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the small slabs so a basket is sent every few hundred rows, the slabs
+	// of other sizes are not put back to the pool
+	size := g_BasketTupleSize
+	g_BasketTupleSize = benchBasketSize
+	defer func() { g_BasketTupleSize = size }()
+
+	row := bytes.Repeat([]byte{'x'}, benchRowSize-1)
+	row = append(row, '\n')
+	b.SetBytes(benchRowSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var gwg sync.WaitGroup
+	for _, q := range queues {
+		gwg.Add(1)
+		go func(q benchQueue) {
+			defer gwg.Done()
+			for {
+				tb, err := q.popQ(ctx)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				if delay > 0 {
+					time.Sleep(delay)
+				}
+				tb.release()
+				if tb.last {
+					return
+				}
+			}
+		}(q)
+	}
+
+	var rwg sync.WaitGroup
+	for r := 0; r < benchReaders; r++ {
+		rwg.Add(1)
+		go func(r int) {
+			defer rwg.Done()
+			baskets := make([]*TupleBasket, len(queues))
+			for i := range baskets {
+				baskets[i] = NewTupleBasket()
+			}
+			for i := r; i < b.N; i += benchReaders {
+				node := int(uint32(i) * 2654435761 % uint32(len(queues)))
+				tb := baskets[node]
+				if tb.Len() > 0 && tb.Free() < len(row) {
+					queues[node].putQ(ctx, tb)
+					tb = NewTupleBasket()
+					baskets[node] = tb
+				}
+				tb.Write(row)
+			}
+			for i, tb := range baskets {
+				queues[i].putQ(ctx, tb)
+			}
+		}(r)
+	}
+	rwg.Wait()
+	for _, q := range queues {
+		tb := NewTupleBasket()
+		tb.last = true
+		q.putQ(ctx, tb)
+	}
+	gwg.Wait()
+}
+
+func benchDataQueue(b *testing.B, delay time.Duration) {
+	queues := make([]benchQueue, benchNodes)
+	for i := range queues {
+		queues[i] = NewDataQueue(g_DataQueueSize)
+	}
+	benchQueues(b, queues, delay)
+}
+
+func benchPollingQueue(b *testing.B, delay time.Duration) {
+	queues := make([]benchQueue, benchNodes)
+	for i := range queues {
+		queues[i] = &pollingQueue{limit: g_DataQueueSize}
+	}
+	benchQueues(b, queues, delay)
+}
+
+func BenchmarkDataQueue(b *testing.B) {
+	benchDataQueue(b, 0)
+}
+
+func BenchmarkDataQueueSlowNode(b *testing.B) {
+	benchDataQueue(b, time.Millisecond)
+}
+
+func BenchmarkPollingQueue(b *testing.B) {
+	benchPollingQueue(b, 0)
+}
+
+func BenchmarkPollingQueueSlowNode(b *testing.B) {
+	benchPollingQueue(b, time.Millisecond)
+}
@@ -0,0 +1,439 @@
+package main
+
+// discover the partition layout of the tables from the coordinator catalog,
+// instead of configuring the nodes, slice number and partition key by hand.
+// for each table, the partition key is read from pg_partitioned_table, the
+// partitions from pg_inherits with their bound (pg_get_expr), and for the
+// foreign partitions, the remote host, port, dbname, user and the remote
+// table are read from the foreign server, user mapping and foreign table
+// options. every partition becomes a slice of the table.
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"loadconfig"
+	"strconv"
+	"strings"
+)
+
+const (
+	// the partition key columns of the table, in the key order, with the
+	// collation of the key ("default" is the lc_collate of the database)
+	SQL_PARTITION_KEY = `SELECT p.partstrat, k.attnum, coalesce(a.attname, ''),
+       coalesce(format_type(a.atttypid, a.atttypmod), ''),
+       coalesce(CASE WHEN co.collname = 'default'
+                     THEN (SELECT datcollate FROM pg_database WHERE datname = current_database())
+                     ELSE co.collname END, '')
+  FROM pg_partitioned_table p
+  CROSS JOIN LATERAL unnest(p.partattrs::int2[], p.partcollation::oid[])
+       WITH ORDINALITY AS k(attnum, collid, ord)
+  LEFT JOIN pg_attribute a ON a.attrelid = p.partrelid AND a.attnum = k.attnum
+  LEFT JOIN pg_collation co ON co.oid = k.collid
+ WHERE p.partrelid = $1::regclass
+ ORDER BY k.ord`
+
+	// the partitions of the table, with the foreign server and user mapping
+	// options if it is a foreign table
+	SQL_PARTITIONS = `SELECT quote_ident(n.nspname), quote_ident(c.relname), c.relkind::text,
+       pg_get_expr(c.relpartbound, c.oid),
+       coalesce(array_to_string(s.srvoptions, chr(1)), ''),
+       coalesce(array_to_string(ft.ftoptions, chr(1)), ''),
+       coalesce((SELECT array_to_string(um.umoptions, chr(1))
+                   FROM pg_user_mappings um
+                  WHERE um.srvid = s.oid AND um.usename IN (current_user, 'public')
+                  ORDER BY um.usename = 'public' LIMIT 1), '')
+  FROM pg_inherits i
+  JOIN pg_class c ON c.oid = i.inhrelid
+  JOIN pg_namespace n ON n.oid = c.relnamespace
+  LEFT JOIN pg_foreign_table ft ON ft.ftrelid = c.oid
+  LEFT JOIN pg_foreign_server s ON s.oid = ft.ftserver
+ WHERE i.inhparent = $1::regclass
+ ORDER BY c.relname`
+
+	// the columns of the table, quoted as they are configured, since they
+	// are put to the copy statement
+	SQL_COLUMNS = `SELECT quote_ident(attname) FROM pg_attribute
+ WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped
+ ORDER BY attnum`
+)
+
+// partition bound parsed from the pg_get_expr output
+type discoveredBound struct {
+	isDefault bool
+	modulus int
+	remainder int
+	from []string
+	to []string
+	values []string
+	null bool // the list partition accepts null
+}
+
+type Discoverer struct {
+	conn *pgconn.PgConn
+	host string // the coordinator
+	port int
+	user string
+	password string
+	dbname string
+}
+
+func NewDiscoverer(host string, port int, user string, password string, dbname string) (*Discoverer, error) {
+	d := &Discoverer{
+		host: host,
+		port: port,
+		user: user,
+		password: password,
+		dbname: dbname,
+	}
+	connstr := fmt.Sprintf(
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		host, port, user, password, dbname)
+	conn, err := pgconn.Connect(context.Background(), connstr)
+	if err != nil {
+		return nil, err
+	}
+	d.conn = conn
+	return d, nil
+}
+
+func (this *Discoverer) Close() {
+	this.conn.Close(context.Background())
+}
+
+func (this *Discoverer) query(sql string, params ...string) ([][][]byte, error) {
+	values := make([][]byte, len(params))
+	for i, p := range params {
+		values[i] = []byte(p)
+	}
+	result := this.conn.ExecParams(context.Background(), sql, values, nil, nil, nil).Read()
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return result.Rows, nil
+}
+
+// Discover fill the partition key, strategy, bounds and slices of the table
+func (this *Discoverer) Discover(tinfo *TableInfo) error {
+	// the names are configured as the identifiers, the same as in the copy
+	// statement, and the names of the partitions are quoted by the catalog
+	relname := tinfo.schema + "." + tinfo.name
+
+	if len(tinfo.columns) == 0 {
+		rows, err := this.query(SQL_COLUMNS, relname)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			tinfo.columns = append(tinfo.columns, string(row[0]))
+		}
+	}
+
+	rows, err := this.query(SQL_PARTITION_KEY, relname)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("%s is not a partitioned table", relname)
+	}
+
+	switch string(rows[0][0]) {
+	case "h":
+		tinfo.partitionStrategy = "hash"
+	case "r":
+		tinfo.partitionStrategy = "range"
+	case "l":
+		tinfo.partitionStrategy = "list"
+	default:
+		return fmt.Errorf("unknown partition strategy %s", rows[0][0])
+	}
+
+	tinfo.partitionField = make([]int, 0)
+	tinfo.partitionFieldType = make([]string, 0)
+	for _, row := range rows {
+		if string(row[1]) == "0" {
+			return fmt.Errorf("%s partitioned by expression is not supported", relname)
+		}
+		pos := columnPosition(tinfo.columns, string(row[2]))
+		if pos < 1 {
+			return fmt.Errorf("partition key %s not in the columns of %s", row[2], relname)
+		}
+		typename := baseTypeName(string(row[3]))
+		if tinfo.partitionStrategy == "range" && !bytewiseCollation(typename, string(row[4])) {
+			return fmt.Errorf("range partition key %s of %s uses the collation %s, "+
+				"the text range key is compared bytewise, only the \"C\" collation is supported",
+				row[2], relname, row[4])
+		}
+		tinfo.partitionField = append(tinfo.partitionField, pos)
+		tinfo.partitionFieldType = append(tinfo.partitionFieldType, typename)
+	}
+
+	rows, err = this.query(SQL_PARTITIONS, relname)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("%s has no partition", relname)
+	}
+
+	tinfo.dbinfos = make([]DBInfo, 0)
+	tinfo.partitions = tinfo.partitions[:0]
+	modulus := 0
+	for _, row := range rows {
+		schema, name, kind := string(row[0]), string(row[1]), string(row[2])
+		if kind == "p" {
+			return fmt.Errorf("sub partition %s.%s is not supported", schema, name)
+		}
+		bound, err := parsePartitionBound(string(row[3]))
+		if err != nil {
+			return fmt.Errorf("partition %s.%s: %s", schema, name, err.Error())
+		}
+
+		dbi := DBInfo{
+			host: this.host,
+			port: this.port,
+			user: this.user,
+			password: this.password,
+			dbname: this.dbname,
+			schema: schema,
+			tablename: name,
+		}
+		if kind == "f" {
+			this.applyForeignOptions(&dbi, string(row[4]), string(row[5]), string(row[6]))
+		}
+
+		if tinfo.partitionStrategy == "hash" {
+			if modulus == 0 {
+				modulus = bound.modulus
+				tinfo.dbinfos = make([]DBInfo, modulus)
+			} else if modulus != bound.modulus {
+				return fmt.Errorf("partitions of %s have different modulus %d and %d",
+					relname, modulus, bound.modulus)
+			}
+			dbi.remainder = bound.remainder
+			tinfo.dbinfos[bound.remainder] = dbi
+			continue
+		}
+
+		dbi.remainder = len(tinfo.dbinfos)
+		tinfo.dbinfos = append(tinfo.dbinfos, dbi)
+		tinfo.partitions = append(tinfo.partitions, loadconfig.Partition{
+			Slice: dbi.remainder,
+			From: bound.from,
+			To: bound.to,
+			Values: bound.values,
+			Null: bound.null,
+			Default: bound.isDefault,
+		})
+	}
+
+	if tinfo.partitionStrategy == "hash" && len(rows) != modulus {
+		return fmt.Errorf("%s has %d partitions, but the modulus is %d", relname, len(rows), modulus)
+	}
+	return nil
+}
+
+// the foreign server options give the host, port and dbname, the user mapping
+// gives the user and password, the foreign table options give the remote
+// table name, the missing ones are the same as postgres_fdw(libpq) defaults
+func (this *Discoverer) applyForeignOptions(dbi *DBInfo, srvoptions string, ftoptions string, umoptions string) {
+	dbi.host = "localhost"
+	dbi.port = 5432
+	dbi.dbname = ""
+	for k, v := range parseOptions(srvoptions) {
+		switch k {
+		case "host":
+			dbi.host = v
+		case "port":
+			if port, err := strconv.Atoi(v); err == nil {
+				dbi.port = port
+			}
+		case "dbname":
+			dbi.dbname = v
+		}
+	}
+	for k, v := range parseOptions(umoptions) {
+		switch k {
+		case "user":
+			dbi.user = v
+		case "password":
+			dbi.password = v
+		}
+	}
+	if len(dbi.dbname) == 0 {
+		dbi.dbname = dbi.user
+	}
+	for k, v := range parseOptions(ftoptions) {
+		switch k {
+		case "schema_name":
+			dbi.schema = QuoteIdentifier(v)
+		case "table_name":
+			dbi.tablename = QuoteIdentifier(v)
+		}
+	}
+}
+
+// parse the "key=value" options joined by \x01
+func parseOptions(s string) map[string]string {
+	options := make(map[string]string)
+	if len(s) == 0 {
+		return options
+	}
+	for _, item := range strings.Split(s, "\x01") {
+		i := strings.IndexByte(item, '=')
+		if i < 0 {
+			continue
+		}
+		options[item[:i]] = item[i+1:]
+	}
+	return options
+}
+
+// the position of the column in the loading columns, start from 1, the
+// columns are the identifiers as configured, and name is the column name as
+// in the catalog (attname), so "OrderId" matches OrderId but orderid does not
+func columnPosition(columns []string, name string) int {
+	for i, c := range columns {
+		if unquoteIdent(c) == name {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// the range bounds of text are compared bytewise (see partbound.go), which
+// is the order of the "C" collation only, other types have no collation
+func bytewiseCollation(typename string, collation string) bool {
+	t, err := parsePartitionFieldType(typename)
+	if err != nil || t != PARTITION_FIELD_TYPE_TEXT {
+		return true
+	}
+	switch collation {
+	case "", "C", "POSIX", "ucs_basic", "pg_c_utf8":
+		return true
+	}
+	return false
+}
+
+// strip the type modifier, like "character varying(20)" or "numeric(10,2)"
+func baseTypeName(t string) string {
+	if i := strings.IndexByte(t, '('); i >= 0 {
+		t = strings.TrimSpace(t[:i] + " " + strings.TrimSpace(t[strings.IndexByte(t, ')')+1:]))
+	}
+	return t
+}
+
+// parsePartitionBound parse the partition bound expression, like
+//   FOR VALUES WITH (modulus 4, remainder 1)
+//   FOR VALUES FROM ('2021-01-01', MINVALUE) TO ('2021-02-01', MINVALUE)
+//   FOR VALUES IN ('a', 'b')
+//   DEFAULT
+func parsePartitionBound(expr string) (*discoveredBound, error) {
+	b := &discoveredBound{}
+	expr = strings.TrimSpace(expr)
+	if strings.ToUpper(expr) == "DEFAULT" {
+		b.isDefault = true
+		return b, nil
+	}
+
+	upper := strings.ToUpper(expr)
+	var err error
+	switch {
+	case strings.HasPrefix(upper, "FOR VALUES WITH"):
+		items, _, _, err := parseBoundList(expr[len("FOR VALUES WITH"):])
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			kv := strings.Fields(item)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid hash bound %s", expr)
+			}
+			v, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid hash bound %s", expr)
+			}
+			if strings.EqualFold(kv[0], "modulus") {
+				b.modulus = v
+			} else if strings.EqualFold(kv[0], "remainder") {
+				b.remainder = v
+			}
+		}
+		if b.modulus < 1 || b.remainder < 0 || b.remainder >= b.modulus {
+			return nil, fmt.Errorf("invalid hash bound %s", expr)
+		}
+	case strings.HasPrefix(upper, "FOR VALUES FROM"):
+		var rest string
+		b.from, _, rest, err = parseBoundList(expr[len("FOR VALUES FROM"):])
+		if err != nil {
+			return nil, err
+		}
+		rest = strings.TrimSpace(rest)
+		if !strings.HasPrefix(strings.ToUpper(rest), "TO") {
+			return nil, fmt.Errorf("invalid range bound %s", expr)
+		}
+		b.to, _, _, err = parseBoundList(rest[2:])
+		if err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(upper, "FOR VALUES IN"):
+		var nulls int
+		b.values, nulls, _, err = parseBoundList(expr[len("FOR VALUES IN"):])
+		if err != nil {
+			return nil, err
+		}
+		b.null = nulls > 0
+	default:
+		return nil, fmt.Errorf("unknown partition bound %s", expr)
+	}
+	return b, nil
+}
+
+// parseBoundList parse a parenthesized, comma separated list of the bound
+// values, the quoted literal is unquoted, the unquoted NULL is not in the
+// values but counted, the rest after ")" is returned
+func parseBoundList(s string) ([]string, int, string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) == 0 || s[0] != '(' {
+		return nil, 0, "", fmt.Errorf("invalid bound list %s", s)
+	}
+	items := make([]string, 0)
+	nulls := 0
+	var item strings.Builder
+	quoted, literal := false, false
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted && c == '\'':
+			if i+1 < len(s) && s[i+1] == '\'' {
+				item.WriteByte('\'')
+				i++
+			} else {
+				quoted = false
+			}
+		case quoted:
+			item.WriteByte(c)
+		case c == '\'':
+			quoted, literal = true, true
+			item.Reset()
+		case c == ',' || c == ')':
+			v := item.String()
+			if !literal {
+				v = strings.TrimSpace(v)
+			}
+			if literal || strings.ToUpper(v) != "NULL" {
+				items = append(items, v)
+			} else {
+				nulls++
+			}
+			item.Reset()
+			literal = false
+			if c == ')' {
+				return items, nulls, s[i+1:], nil
+			}
+		default:
+			item.WriteByte(c)
+		}
+	}
+	return nil, 0, "", fmt.Errorf("unterminated bound list %s", s)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestColumnPosition(t *testing.T) {
+	columns := []string{"id", ` "OrderId"`, "Name", `"a""b"`, "Amount "}
+	cases := []struct {
+		name string
+		pos int
+	}{
+		{"id", 1},
+		{"OrderId", 2},
+		{"orderid", -1},
+		// the unquoted name is folded to lower case
+		{"name", 3},
+		{"Name", -1},
+		{`a"b`, 4},
+		{"amount", 5},
+		{"missing", -1},
+	}
+	for _, c := range cases {
+		if pos := columnPosition(columns, c.name); pos != c.pos {
+			t.Errorf("columnPosition(%q) = %d, want %d", c.name, pos, c.pos)
+		}
+	}
+
+	// the force columns are the identifiers too
+	fields, err := columnFields(columns, []string{`"OrderId"`, "NAME"})
+	if err != nil || !reflect.DeepEqual(fields, map[int]bool{2: true, 3: true}) {
+		t.Errorf("columnFields = %v, %v", fields, err)
+	}
+	if _, err := columnFields(columns, []string{"OrderId"}); err == nil {
+		t.Errorf("columnFields(OrderId) no error")
+	}
+}
+
+func TestParsePartitionBound(t *testing.T) {
+	cases := []struct {
+		expr string
+		bound discoveredBound
+	}{
+		{"DEFAULT", discoveredBound{isDefault: true}},
+		{" default ", discoveredBound{isDefault: true}},
+		{"FOR VALUES WITH (modulus 4, remainder 1)", discoveredBound{modulus: 4, remainder: 1}},
+		{"FOR VALUES WITH (MODULUS 1, REMAINDER 0)", discoveredBound{modulus: 1, remainder: 0}},
+		{"FOR VALUES FROM ('2021-01-01') TO ('2021-02-01')",
+			discoveredBound{from: []string{"2021-01-01"}, to: []string{"2021-02-01"}}},
+		{"FOR VALUES FROM (MINVALUE, 10) TO ('a, b', MAXVALUE)",
+			discoveredBound{from: []string{"MINVALUE", "10"}, to: []string{"a, b", "MAXVALUE"}}},
+		{"FOR VALUES FROM ('it''s') TO ('(x)')",
+			discoveredBound{from: []string{"it's"}, to: []string{"(x)"}}},
+		{"FOR VALUES IN ('a', 'b')", discoveredBound{values: []string{"a", "b"}}},
+		// the quoted 'NULL' is a value, the unquoted NULL is the null key
+		{"FOR VALUES IN (NULL, 'NULL', '')", discoveredBound{values: []string{"NULL", ""}, null: true}},
+		{"FOR VALUES IN (NULL)", discoveredBound{values: []string{}, null: true}},
+		{"FOR VALUES IN (1, -2)", discoveredBound{values: []string{"1", "-2"}}},
+	}
+	for _, c := range cases {
+		b, err := parsePartitionBound(c.expr)
+		if err != nil {
+			t.Errorf("parsePartitionBound(%q): %s", c.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(*b, c.bound) {
+			t.Errorf("parsePartitionBound(%q) = %+v, want %+v", c.expr, *b, c.bound)
+		}
+	}
+
+	for _, expr := range []string{
+		"",
+		"FOR VALUES WITH (modulus 4, remainder 4)",
+		"FOR VALUES WITH (modulus 0, remainder 0)",
+		"FOR VALUES WITH (modulus x, remainder 0)",
+		"FOR VALUES FROM (1)",
+		"FOR VALUES FROM (1) TO (2",
+		"FOR VALUES IN ('a)",
+		"FOR VALUES IN 'a'",
+	} {
+		if b, err := parsePartitionBound(expr); err == nil {
+			t.Errorf("parsePartitionBound(%q) = %+v, no error", expr, *b)
+		}
+	}
+}
+
+func TestBytewiseCollation(t *testing.T) {
+	cases := []struct {
+		typename string
+		collation string
+		bytewise bool
+	}{
+		{"integer", "", true},
+		{"date", "", true},
+		{"text", "C", true},
+		{"text", "POSIX", true},
+		{"character varying", "ucs_basic", true},
+		{"text", "pg_c_utf8", true},
+		{"text", "en_US.UTF-8", false},
+		{"varchar", "und-x-icu", false},
+	}
+	for _, c := range cases {
+		if got := bytewiseCollation(c.typename, c.collation); got != c.bytewise {
+			t.Errorf("bytewiseCollation(%q, %q) = %v, want %v", c.typename, c.collation, got, c.bytewise)
+		}
+	}
+}
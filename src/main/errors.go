@@ -0,0 +1,82 @@
+package main
+
+// the first error of a job fails the job, the context of the job is
+// cancelled, so the readers stop, and the copies in flight are aborted by
+// CopyFail (the pipe of the copy is closed with the error), then each node
+// rolls back the rows of the job. the other jobs go on, the failed jobs are
+// summarized at the end and the loader exits with 1.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the max bytes of the row in the error
+const ERROR_ROW_SIZE = 256
+
+// JobError is where the job fails, the node, the file and the row are empty
+// if they are not known
+type JobError struct {
+	stage string // open, config, checkpoint, scan, connect, prepare, read, route, convert, reject or copy
+	node string // the node of the copy, host:port
+	path string // the data file
+	row []byte // the row which fails
+	err error
+}
+
+func (this *JobError) Error() string {
+	var b strings.Builder
+	b.WriteString(this.stage)
+	if this.node != "" {
+		fmt.Fprintf(&b, " on %s", this.node)
+	}
+	if this.path != "" {
+		fmt.Fprintf(&b, " of %s", this.path)
+	}
+	fmt.Fprintf(&b, ": %s", this.err.Error())
+	if this.row != nil {
+		fmt.Fprintf(&b, ", row: %q", this.row)
+	}
+	return b.String()
+}
+
+func (this *JobError) Unwrap() error {
+	return this.err
+}
+
+// Summary the error in lines, for the summary of the failed jobs
+func (this *JobError) Summary(indent string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%sstage: %s\n", indent, this.stage)
+	if this.node != "" {
+		fmt.Fprintf(&b, "%snode:  %s\n", indent, this.node)
+	}
+	if this.path != "" {
+		fmt.Fprintf(&b, "%sfile:  %s\n", indent, this.path)
+	}
+	if this.row != nil {
+		fmt.Fprintf(&b, "%srow:   %q\n", indent, this.row)
+	}
+	fmt.Fprintf(&b, "%serror: %s\n", indent, this.err.Error())
+	return b.String()
+}
+
+// newRowError the error of the row, the row is copied without the line end,
+// and cut if it is too long
+func newRowError(stage string, path string, row []byte, err error) *JobError {
+	row = stripLineEnd(row)
+	if len(row) > ERROR_ROW_SIZE {
+		row = append(append([]byte{}, row[:ERROR_ROW_SIZE]...), "..."...)
+	} else {
+		row = append([]byte{}, row...)
+	}
+	return &JobError{stage: stage, path: path, row: row, err: err}
+}
+
+// errorSummary the summary of the error of a job
+func errorSummary(err error, indent string) string {
+	if e, ok := err.(*JobError); ok {
+		return e.Summary(indent)
+	}
+	return fmt.Sprintf("%serror: %s\n", indent, err.Error())
+}
@@ -0,0 +1,207 @@
+package main
+
+// the fixed width input, the records have no delimiter, each column is at a
+// fixed position of the record, the fields are sliced by the positions, and
+// the record is written in the COPY format of the table (csv or text) for the
+// senders, the partitionField is the index of the fixed columns.
+//
+// with the recordLength, every record has the same bytes (the line end is
+// counted if any), so the file is split at the exact record boundaries, and
+// the chunks have no head and tail. without it, the records end with the
+// newline, and a short line has the empty fields at the end.
+//
+// the blank field (all spaces) and the field out of a short line are null,
+// even without the trim, which only removes the spaces around the others.
+// the implied decimal field is the digits with the sign at the start or the
+// end, like 0012345- is -123.45 with 2 decimals.
+
+import (
+	"bytes"
+	"fmt"
+	"loadconfig"
+)
+
+type FixedColumn struct {
+	start int // start from 0
+	length int
+	decimals int
+}
+
+type FixedFormat struct {
+	columns []FixedColumn
+	recordLength int // 0 if the records end with the newline
+	trim bool
+}
+
+func NewFixedFormatFromConfig(t *loadconfig.Table) (*FixedFormat, error) {
+	if len(t.FixedColumns) == 0 {
+		return nil, fmt.Errorf("fixedColumns are required for the fixed input")
+	}
+	if t.RecordLength < 0 {
+		return nil, fmt.Errorf("invalid recordLength %d", t.RecordLength)
+	}
+	f := &FixedFormat{recordLength: t.RecordLength, trim: t.Trim}
+	for i, c := range t.FixedColumns {
+		if c.Start < 1 || c.Length < 1 || c.Decimals < 0 {
+			return nil, fmt.Errorf("invalid fixed column %d, start %d, length %d, decimals %d",
+				i+1, c.Start, c.Length, c.Decimals)
+		}
+		if f.recordLength > 0 && c.Start+c.Length-1 > f.recordLength {
+			return nil, fmt.Errorf("fixed column %d is out of the record length %d", i+1, f.recordLength)
+		}
+		f.columns = append(f.columns, FixedColumn{c.Start - 1, c.Length, c.Decimals})
+	}
+	return f, nil
+}
+
+// FindRecordEnd the state is the bytes of the record scanned before, the
+// record ends at the last byte of the record length, or at the newline
+func (this *FixedFormat) FindRecordEnd(buf []byte, state *int) int {
+	if this.recordLength == 0 {
+		return bytes.IndexByte(buf, '\n')
+	}
+	need := this.recordLength - *state
+	if len(buf) < need {
+		*state += len(buf)
+		return -1
+	}
+	*state = FORMAT_STATE_START
+	return need - 1
+}
+
+// ScanStates the chunks of the fixed length records are whole, and the
+// newline always ends the record
+func (this *FixedFormat) ScanStates(buf []byte, states *[FORMAT_STATE_NUM]int) {
+}
+
+func (this *FixedFormat) bindColumns(columns []string) error {
+	if len(columns) > 0 && len(columns) != len(this.columns) {
+		return fmt.Errorf("%d columns but %d fixed columns", len(columns), len(this.columns))
+	}
+	return nil
+}
+
+// record get the record without the line end, and check the record length
+func (this *FixedFormat) record(c []byte) ([]byte, error) {
+	if this.recordLength == 0 {
+		return stripLineEnd(c), nil
+	}
+	if len(c) != this.recordLength {
+		return nil, fmt.Errorf("the record length is %d, not %d", len(c), this.recordLength)
+	}
+	return c, nil
+}
+
+// field slice the field of the column, the part out of the record is empty,
+// and the blank field is null whether it is trimmed or not
+func (this *FixedFormat) field(record []byte, column *FixedColumn) ([]byte, bool, error) {
+	var value []byte
+	if column.start < len(record) {
+		end := column.start + column.length
+		if end > len(record) {
+			end = len(record)
+		}
+		value = record[column.start:end]
+	}
+	trimmed := bytes.Trim(value, " ")
+	if len(trimmed) == 0 {
+		return nil, true, nil
+	}
+	if this.trim || column.decimals > 0 {
+		value = trimmed
+	}
+	if column.decimals > 0 {
+		decimal, err := impliedDecimal(value, column.decimals)
+		return decimal, false, err
+	}
+	return value, false, nil
+}
+
+// impliedDecimal put the decimal point to the digits, the sign can be at the
+// start or the end
+func impliedDecimal(value []byte, decimals int) ([]byte, error) {
+	digits := value
+	negative := false
+	if c := digits[0]; c == '-' || c == '+' {
+		negative, digits = c == '-', digits[1:]
+	} else if c := digits[len(digits)-1]; c == '-' || c == '+' {
+		negative, digits = c == '-', digits[:len(digits)-1]
+	}
+	if len(digits) == 0 {
+		return nil, fmt.Errorf("invalid implied decimal %s", string(value))
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return nil, fmt.Errorf("invalid implied decimal %s", string(value))
+		}
+	}
+	digits = bytes.TrimLeft(digits, "0")
+	for len(digits) <= decimals {
+		digits = append([]byte{'0'}, digits...)
+	}
+	point := len(digits) - decimals
+	buf := make([]byte, 0, len(digits)+2)
+	if negative {
+		buf = append(buf, '-')
+	}
+	buf = append(buf, digits[:point]...)
+	buf = append(buf, '.')
+	return append(buf, digits[point:]...), nil
+}
+
+func (this *FixedFormat) GetField(c []byte, index int) ([]byte, bool, error) {
+	if index < 1 || index > len(this.columns) {
+		return nil, false, fmt.Errorf("too few fields, field %d not found", index)
+	}
+	record, err := this.record(c)
+	if err != nil {
+		return nil, false, err
+	}
+	return this.field(record, &this.columns[index-1])
+}
+
+func (this *FixedFormat) GetFields(c []byte) ([][]byte, []bool, error) {
+	record, err := this.record(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := make([][]byte, len(this.columns))
+	nulls := make([]bool, len(this.columns))
+	for i := range this.columns {
+		if fields[i], nulls[i], err = this.field(record, &this.columns[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return fields, nulls, nil
+}
+
+// AppendRecord pad the fields to the columns, the implied decimal is not
+// written back, the fixed input is only read, the records are sent in the
+// COPY format of the table
+func (this *FixedFormat) AppendRecord(buf []byte, fields [][]byte, nulls []bool) []byte {
+	record := bytes.Repeat([]byte{' '}, this.recordLength)
+	for i, column := range this.columns {
+		end := column.start + column.length
+		if end > len(record) {
+			record = append(record, bytes.Repeat([]byte{' '}, end-len(record))...)
+		}
+		if i < len(fields) && !nulls[i] {
+			copy(record[column.start:end], fields[i])
+		}
+	}
+	buf = append(buf, record...)
+	if this.recordLength == 0 {
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+func (this *FixedFormat) CopyOptions() string {
+	return "fixed"
+}
+
+// isSkipped the blank line is skipped, and the blank rest at the file end
+// which is shorter than a record, like the last newline
+func (this *FixedFormat) isSkipped(tuple []byte) bool {
+	return isBlank(tuple) && (this.recordLength == 0 || len(tuple) != this.recordLength)
+}
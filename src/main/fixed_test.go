@@ -0,0 +1,177 @@
+package main
+
+import (
+	"loadconfig"
+	"reflect"
+	"testing"
+)
+
+func TestFixedImpliedDecimal(t *testing.T) {
+	cases := []struct {
+		value string
+		decimals int
+		decimal string
+	}{
+		{"12345", 2, "123.45"},
+		{"0012345", 2, "123.45"},
+		// the sign at the start or the end
+		{"-0012345", 2, "-123.45"},
+		{"0012345-", 2, "-123.45"},
+		{"+12345", 2, "123.45"},
+		{"12345+", 2, "123.45"},
+		// the zeros are padded before the point
+		{"5", 2, "0.05"},
+		{"5-", 3, "-0.005"},
+		{"45", 2, "0.45"},
+		{"0000", 2, "0.00"},
+		{"0", 1, "0.0"},
+		{"100", 2, "1.00"},
+		{"123456789012345678901234567890", 4, "12345678901234567890123456.7890"},
+	}
+	for _, c := range cases {
+		decimal, err := impliedDecimal([]byte(c.value), c.decimals)
+		if err != nil || string(decimal) != c.decimal {
+			t.Errorf("impliedDecimal(%q, %d) = %q, %v, want %q", c.value, c.decimals, decimal, err, c.decimal)
+		}
+	}
+
+	for _, value := range []string{"-", "+", "12a45", "1-2", "--1", "-1-", "1 2", "1.5"} {
+		if decimal, err := impliedDecimal([]byte(value), 2); err == nil {
+			t.Errorf("impliedDecimal(%q) = %q, no error", value, decimal)
+		}
+	}
+}
+
+func fixedFormat(t *testing.T, length int, trim bool) *FixedFormat {
+	f, err := NewFixedFormatFromConfig(&loadconfig.Table{
+		FixedColumns: []loadconfig.FixedColumn{
+			{Start: 1, Length: 4},
+			{Start: 5, Length: 6},
+			{Start: 11, Length: 6, Decimals: 2},
+		},
+		RecordLength: length,
+		Trim: trim,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFixedGetFields(t *testing.T) {
+	null := "<null>"
+	cases := []struct {
+		length int
+		trim bool
+		record string
+		fields []string
+	}{
+		{0, false, "0001name  012345\n", []string{"0001", "name  ", "123.45"}},
+		{0, true, "0001name  012345\n", []string{"0001", "name", "123.45"}},
+		{0, true, "  1  ab   0012-\r\n", []string{"1", "ab", "-0.12"}},
+		// the decimal field is always trimmed
+		{0, false, "0001 x    00001 \n", []string{"0001", " x    ", "0.01"}},
+		// the fields out of a short line are null
+		{0, false, "0001na\n", []string{"0001", "na", null}},
+		{0, false, "01\n", []string{"01", null, null}},
+		// the blank field is null with or without the trim
+		{0, true, "0001      000000\n", []string{"0001", null, "0.00"}},
+		{0, false, "0001      000000\n", []string{"0001", null, "0.00"}},
+		{0, false, "    name        \n", []string{null, "name  ", null}},
+		{16, false, "0003 y          ", []string{"0003", " y    ", null}},
+		{16, true, "0002name2 -00005", []string{"0002", "name2", "-0.05"}},
+		{16, false, "0002name2 1     ", []string{"0002", "name2 ", "0.01"}},
+	}
+	for _, c := range cases {
+		f := fixedFormat(t, c.length, c.trim)
+		fields, nulls, err := f.GetFields([]byte(c.record))
+		if err != nil {
+			t.Errorf("GetFields(%q): %s", c.record, err)
+			continue
+		}
+		got := make([]string, len(fields))
+		for i := range fields {
+			got[i] = string(fields[i])
+			if nulls[i] {
+				got[i] = null
+			}
+		}
+		if !reflect.DeepEqual(got, c.fields) {
+			t.Errorf("length %d, trim %v, GetFields(%q) = %q, want %q", c.length, c.trim, c.record, got, c.fields)
+		}
+		for i := range c.fields {
+			field, isNull, err := f.GetField([]byte(c.record), i+1)
+			if err != nil || isNull != nulls[i] || string(field) != string(fields[i]) {
+				t.Errorf("GetField(%q, %d) = %q, %v, %v", c.record, i+1, field, isNull, err)
+			}
+		}
+	}
+
+	f := fixedFormat(t, 16, false)
+	for _, record := range []string{"0002name2 1    ", "0002name2 1     \n", "0002name2 00a.00"} {
+		if _, _, err := f.GetFields([]byte(record)); err == nil {
+			t.Errorf("GetFields(%q) no error", record)
+		}
+	}
+	if _, _, err := f.GetField([]byte("0002name2 1     "), 4); err == nil {
+		t.Errorf("GetField(4) no error")
+	}
+}
+
+func TestFixedFindRecordEnd(t *testing.T) {
+	f := fixedFormat(t, 0, false)
+	state := FORMAT_STATE_START
+	if end := f.FindRecordEnd([]byte("0001 x\n0002"), &state); end != 6 {
+		t.Errorf("FindRecordEnd of the line = %d", end)
+	}
+
+	// the record length is counted across the buffers by the state, the
+	// line end is a byte of the record
+	f = fixedFormat(t, 16, false)
+	data := []byte("0001name1 00001\n0002name2 00002\n00")
+	var ends []int
+	for pos := 0; pos < len(data); {
+		end := pos + 5
+		if end > len(data) {
+			end = len(data)
+		}
+		for buf := data[pos:end]; len(buf) > 0; {
+			l := f.FindRecordEnd(buf, &state)
+			if l < 0 {
+				break
+			}
+			ends = append(ends, pos+l)
+			pos, buf = pos+l+1, buf[l+1:]
+		}
+		pos = end
+	}
+	if !reflect.DeepEqual(ends, []int{15, 31}) || state != 2 {
+		t.Errorf("record ends %v, state %d", ends, state)
+	}
+
+	if !f.isSkipped([]byte(" \n")) || f.isSkipped([]byte("                ")) {
+		t.Errorf("the blank rest shorter than a record is skipped, not a blank record")
+	}
+}
+
+func TestFixedConfig(t *testing.T) {
+	for _, c := range []loadconfig.Table{
+		{},
+		{FixedColumns: []loadconfig.FixedColumn{{Start: 0, Length: 1}}},
+		{FixedColumns: []loadconfig.FixedColumn{{Start: 1, Length: 0}}},
+		{FixedColumns: []loadconfig.FixedColumn{{Start: 1, Length: 2, Decimals: -1}}},
+		{FixedColumns: []loadconfig.FixedColumn{{Start: 1, Length: 2}}, RecordLength: -1},
+		{FixedColumns: []loadconfig.FixedColumn{{Start: 4, Length: 2}}, RecordLength: 4},
+	} {
+		if _, err := NewFixedFormatFromConfig(&c); err == nil {
+			t.Errorf("NewFixedFormatFromConfig(%+v) no error", c)
+		}
+	}
+	f := fixedFormat(t, 0, false)
+	if err := f.bindColumns([]string{"a", "b"}); err == nil {
+		t.Errorf("bind 2 columns to 3 fixed columns, no error")
+	}
+	if err := f.bindColumns([]string{"a", "b", "c"}); err != nil {
+		t.Errorf("bindColumns: %s", err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+// the input format of the data file, it is the same as the FORMAT option of
+// COPY, the rows are passed through to the COPY on the nodes as they are, so
+// the format only needs to find the record end, and get the partition key
+// fields, the same way as postgresql parses them
+//
+//   csv:  see csv.go
+//   text: see text.go, the output of COPY ... TO in text format
+//
+// the data files can also be read in another input format, and converted to
+// the format above, see json.go and fixed.go
+
+import (
+	"bytes"
+	"fmt"
+	"loadconfig"
+	"strings"
+)
+
+// the max number of the record scan states of all formats
+const FORMAT_STATE_NUM = 3
+
+// the record scan state at the start of a record, the same for all formats
+const FORMAT_STATE_START = 0
+
+type Format interface {
+	// FindRecordEnd scan the buffer from the state, return the position of
+	// the newline which ends the record, or -1 if not found, the state is
+	// updated to the state at the end of the scanned data
+	FindRecordEnd(buf []byte, state *int) int
+
+	// ScanStates scan the data from every possible start state, and get the
+	// state at the end for each of them, the states array is updated in
+	// place
+	ScanStates(buf []byte, states *[FORMAT_STATE_NUM]int)
+
+	// GetField get the index-th field (start from 1) of the record, the
+	// value is the field after unquote or unescape, null is true if the
+	// field is null
+	GetField(c []byte, index int) ([]byte, bool, error)
+
+	// GetFields get all the fields of the record, and whether they are null
+	GetFields(c []byte) ([][]byte, []bool, error)
+
+	// bindColumns is called when the columns of the table are known
+	bindColumns(columns []string) error
+
+	// AppendRecord write the fields as a record of the format with the
+	// newline, the same as COPY ... TO does, it is for the sources which are
+	// not text, like parquet
+	AppendRecord(buf []byte, fields [][]byte, nulls []bool) []byte
+
+	// CopyOptions make the options of the COPY command for the format
+	CopyOptions() string
+}
+
+func NewFormatFromConfig(t *loadconfig.Table) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(t.Format)) {
+	case "", "csv":
+		return NewCSVFormatFromConfig(t)
+	case "text":
+		return NewTextFormatFromConfig(t)
+	}
+	return nil, fmt.Errorf("unsupport format %s", t.Format)
+}
+
+// NewInputFormatFromConfig get the format the data files are read in, it is
+// the COPY format of the table, except the json lines and the fixed width
+func NewInputFormatFromConfig(t *loadconfig.Table, format Format) (Format, error) {
+	input := strings.ToLower(strings.TrimSpace(t.Input))
+	json := input == "ndjson" || input == "jsonl"
+	if !json && (len(t.JsonPaths) > 0 || len(t.PartitionPath) > 0) {
+		return nil, fmt.Errorf("jsonPaths and partitionPath are for the ndjson input")
+	}
+	if input != "fixed" && (len(t.FixedColumns) > 0 || t.RecordLength > 0) {
+		return nil, fmt.Errorf("fixedColumns and recordLength are for the fixed input")
+	}
+	switch {
+	case input == "":
+		return format, nil
+	case json:
+		if len(t.PartitionField) > 0 && len(t.PartitionPath) > 0 {
+			return nil, fmt.Errorf("set partitionField or partitionPath, not both")
+		}
+		return NewJSONFormatFromConfig(t)
+	case input == "fixed":
+		return NewFixedFormatFromConfig(t)
+	}
+	return nil, fmt.Errorf("unsupport input %s", t.Input)
+}
+
+// hasHeader whether the first record of the file is the header, the json
+// lines and the fixed width records have no header
+func hasHeader(input Format) bool {
+	switch input.(type) {
+	case *JSONFormat, *FixedFormat:
+		return false
+	}
+	return g_has_csv_header
+}
+
+// hasStates the record end depends on the state at the chunk start, like a
+// newline in a quoted csv field, the json string escapes the newline, and the
+// fixed width records end at any newline
+func hasStates(input Format) bool {
+	switch input.(type) {
+	case *JSONFormat, *FixedFormat:
+		return false
+	}
+	return true
+}
+
+// isSkipped check the record which is not loaded, the end-of-data marker,
+// or the blank line of the json lines and the fixed width records
+func isSkipped(input Format, tuple []byte) bool {
+	switch f := input.(type) {
+	case *JSONFormat:
+		return isBlank(tuple)
+	case *FixedFormat:
+		return f.isSkipped(tuple)
+	}
+	return isEndOfData(tuple)
+}
+
+// Fields the fields of a record split once, by the index of GetField, the
+// columns are first, so the record is not parsed again for the partition key
+// and the columns
+type Fields struct {
+	values [][]byte
+	nulls []bool
+	columns int // the fields of the columns, the rest are the key paths
+}
+
+// getColumns get the fields of the columns, from the split record if it is
+// not nil
+func getColumns(input Format, tuple []byte, split *Fields) ([][]byte, []bool, error) {
+	if split != nil {
+		return split.values[:split.columns], split.nulls[:split.columns], nil
+	}
+	return input.GetFields(tuple)
+}
+
+// splitRecord parse the json object once for the partition key and the
+// columns, nil for the other formats, their fields are found in the record
+// for each of them
+func splitRecord(input Format, tuple []byte) (*Fields, error) {
+	if f, ok := input.(*JSONFormat); ok {
+		return f.split(tuple)
+	}
+	return nil, nil
+}
+
+// convertRecord write the record of the input format in the COPY format
+func convertRecord(input Format, format Format, tuple []byte, split *Fields) ([]byte, error) {
+	fields, nulls, err := getColumns(input, tuple, split)
+	if err != nil {
+		return nil, err
+	}
+	return format.AppendRecord(make([]byte, 0, len(tuple)), fields, nulls), nil
+}
+
+// isEndOfData check whether the record is the end-of-data marker "\.", it
+// ends the COPY, so it is never sent to the nodes
+func isEndOfData(tuple []byte) bool {
+	tuple = bytes.TrimRight(tuple, "\r\n")
+	return len(tuple) == 2 && tuple[0] == '\\' && tuple[1] == '.'
+}
+
+// the record without the line end
+func stripLineEnd(c []byte) []byte {
+	if n := len(c); n > 0 && c[n-1] == '\n' {
+		c = c[:n-1]
+		if n := len(c); n > 0 && c[n-1] == '\r' {
+			c = c[:n-1]
+		}
+	}
+	return c
+}
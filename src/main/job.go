@@ -22,27 +22,82 @@ package main
 // each reader start from a offset from a file, it maybe the middle of the tuple
 // line, or end of the reader will left some data uncomplete tuple, just just
 // handle it by head and tail, and rejoin them at last.
+//
+// a csv record can have newlines in the quoted field, so a newline after the
+// offset is not always a record end, before the readers start, all the chunks
+// are scanned by g_readernum workers to find the quote state at the start of
+// each chunk (see Format.ScanStates), then the reader knows where the first
+// record end of its chunk is. the json lines and the fixed width records are
+// not scanned, and the text state of a plain file is read from the
+// backslashes before the chunk.
+//
+// a table can have many data files, the chunks of all the files are made by
+// the total size, so a reader takes about the same bytes no matter how the
+// files are sized, the readers take the chunks from a queue, and the head
+// and tail of the chunks are joined within the file only.
 
 
-
-// #cgo CFLAGS: -g -Wall
-// #cgo LDFLAGS: -L./ -lhash
-// #include "hashfunc.h"
-import "C"
 import (
+	"bytes"
+	"context"
 	"sync"
 	"os"
 	"fmt"
-	"strconv"
-	"time"
 	"io"
 	"strings"
+	"sync/atomic"
 )
 
+// Chunk is a part of the file, for the compressed file, it is a run of the
+// segments, and the offset and size are of the compressed data
 type Chunk struct {
+	index int // the index of the chunks of the job
 	chunksize int64
 	bufsize int
 	offset int64
+	state int // the csv scan state at the chunk start
+	source *DataSource
+	segments []*Segment
+	rowGroup int // the row group of the parquet file
+	whole bool // the chunk has the whole records, like the parquet row group
+}
+
+// open get the decompressed data of the chunk
+func (this *Chunk) open() (io.ReadCloser, error) {
+	return this.source.openChunk(this)
+}
+
+// ChunkStat is the decompressed size and the newlines of a chunk, they are
+// counted only when a row after the chunk in the file is rejected
+type ChunkStat struct {
+	once sync.Once
+	size int64
+	lines int64
+	err error
+}
+
+// count read the chunk and count the bytes and the newlines, only once
+func (this *ChunkStat) count(chunk *Chunk) {
+	this.once.Do(func() {
+		r, err := chunk.open()
+		if err != nil {
+			this.err = err
+			return
+		}
+		defer r.Close()
+		buffer := make([]byte, chunk.bufsize)
+		for {
+			n, err := r.Read(buffer)
+			this.size += int64(n)
+			this.lines += int64(bytes.Count(buffer[:n], []byte{'\n'}))
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				this.err = err
+				return
+			}
+		}
+	})
 }
 
 type Job struct {
@@ -56,36 +111,142 @@ type Job struct {
 	chunks []*Chunk
 	tableinfo *TableInfo
 	remainHolder *ChunkRemainHolder
-	filesize int64
+	sources []*DataSource
+	filesize int64 // the total size of the files
 	jobid int
+	slicenum int
 	displayName string
+	partitionKey *PartitionKey
+	reject *RejectFile
+	binary *BinaryEncoder
+	checkpoint *Checkpoint // nil if the load is not checkpointed
+	rows int64 // the rows committed on all nodes
+	joined int64 // the records joined by the heads and tails of the chunks
+	chunkstats []*ChunkStat // for the positions of the rejected rows
+	// the readers and the go through goroutines waiting on the queues
+	// return when it is cancelled
+	ctx context.Context
+	cancel context.CancelFunc
+	err error // the first error of the job, nil if it is done
+	errOnce sync.Once
+}
+
+// fail keep the first error of the job, and cancel the job, the readers stop
+// and the copies are aborted
+func (this *Job) fail(err error) {
+	this.errOnce.Do(func() {
+		this.err = err
+		logger.Error("%s failed, %s", this.displayName, err.Error())
+		this.cancel()
+	})
+}
+
+// closeSources close the data files of the job
+func (this *Job) closeSources() {
+	for _, source := range this.sources {
+		source.Close()
+	}
+}
+
+// closeSenders close the connections of the senders not started
+func (this *Job) closeSenders() {
+	for _, sender := range this.senderlist {
+		sender.FinishWork()
+	}
 }
 
 func (this *Job) process() {
-	logger.Info("%s start...", this.displayName)
-	recordFile := this.tableinfo.datapath
-	fd, err := os.Open(recordFile)
-	if err != nil {
-		logger.Fatal("job process fail for", err)
+	if len(this.sources) == 1 {
+		logger.Info("%s start... %s", this.displayName, this.sources[0])
+	} else {
+		logger.Info("%s start... %d files, %d bytes", this.displayName, len(this.sources), this.filesize)
+	}
+	defer func() {
+		this.closeSources()
+		this.cancel()
+		this.jwg.Done()
+	}()
+
+	if this.checkpoint != nil && this.checkpoint.Done {
+		logger.Info("%s is loaded by the last run, %s", this.displayName, this.checkpoint)
+		return
+	}
+
+	if err := this.findChunkStates(); err != nil {
+		this.fail(err)
+		return
 	}
-	defer fd.Close()
 
 	// setup sender connections
-	for i, _ := range g_dbinfos {
-		sender := NewSender(&g_dbinfos[i], i)
-		sender.SetTable(this.tableinfo.schema, this.tableinfo.name, this.tableinfo.columns...)
-		sender.PrepareCopyTransaction()
+	for i, _ := range this.tableinfo.dbinfos {
+		dbi := &this.tableinfo.dbinfos[i]
+		sender := NewSender(dbi, i)
+		sender.SetTable(dbi.targetSchema(this.tableinfo), dbi.targetTable(this.tableinfo),
+			this.tableinfo.columns...)
+		sender.SetFormat(this.tableinfo.format)
+		sender.SetBinary(this.tableinfo.binary)
+		sender.SetContext(this.ctx)
+		sender.SetAtomic(g_atomic)
+		sender.SetTransaction(this.checkpoint != nil || (g_retries > 0 && !g_atomic))
+		sender.SetBatch(g_commitrows, g_commitsize)
+		if err := sender.PrepareCopyTransaction(); err != nil {
+			this.fail(&JobError{stage: "connect", node: dbi.address(), err: err})
+			this.closeSenders()
+			return
+		}
 		this.senderlist = append(this.senderlist, sender)
 	}
+
+	// the batches being committed when the last run stopped
+	if this.checkpoint != nil {
+		if err := this.checkpoint.resolve(this.senderlist); err != nil {
+			this.fail(&JobError{stage: "resume", err: err})
+			this.closeSenders()
+			return
+		}
+	}
+
+	if this.tableinfo.binary {
+		if err := this.setupBinaryEncoder(); err != nil {
+			this.fail(&JobError{stage: "prepare", node: this.tableinfo.dbinfos[0].address(), err: err})
+			this.closeSenders()
+			return
+		}
+	}
 	
-	// start reader goroutines
+	// start reader goroutines, they take the chunks from the queue, and the
+	// files can not be split are cut to the blocks by the stream readers
+	chunks := make(chan *Chunk, len(this.chunks))
+	for _, chunk := range this.chunks {
+		chunks <- chunk
+	}
+	close(chunks)
+	var blocks chan *Block
+	for _, source := range this.sources {
+		if !source.Splittable() {
+			blocks = make(chan *Block, g_readernum * 2)
+			break
+		}
+	}
 	for i:=0; i<g_readernum; i++ {
 		this.rwg.Add(1)
 		r := NewReader(i, &this.rwg, this.nodedq, this.remainHolder)
-		r.setPartitionField(this.tableinfo.partitionField, this.tableinfo.partitionFieldType)
-		r.startReader(this.chunks, i, fd)
+		r.setPartitionKey(this.partitionKey)
+		r.setRejectFile(this.reject)
+		r.setFormat(this.tableinfo.input)
+		if this.tableinfo.input != this.tableinfo.format {
+			r.setOutputFormat(this.tableinfo.format)
+		}
+		r.setBinaryEncoder(this.binary)
+		r.setContext(this.ctx)
+		r.setFailure(this.fail)
+		r.setCheckpoint(this.checkpoint)
+		r.startReader(chunks, blocks)
 		this.readerlist = append(this.readerlist, r)
 	}
+	if blocks != nil {
+		go this.runStreamReaders(blocks)
+	}
 	
 	// start sender goroutines
 	for i:=0; i<len(this.senderlist); i++ {
@@ -100,8 +261,20 @@ func (this *Job) process() {
 
 	// when the reading work is done, check the chunk header and tail data,
 	// analyze them and try to join them all
-	this.AnalyzeChunkHeadAndTail()
+	if this.ctx.Err() == nil {
+		this.AnalyzeChunkHeadAndTail()
+	}
+	// before the last basket, the table is one copy with maxErrorPercent,
+	// so it is not committed if it fails
+	if this.ctx.Err() == nil {
+		this.checkErrors()
+	}
 	this.FinishAllReadWork()
+
+	// commit or roll back on all nodes before the connections are closed
+	if g_atomic {
+		this.twoPhaseCommit()
+	}
 	
 	this.WaitSendersStop()
 
@@ -111,36 +284,354 @@ func (this *Job) process() {
 	// wait for go through gorotine work down
 	this.gwg.Wait()
 
-	// wait for job work down, currently not actually used
-	this.jwg.Done()
-	
+	this.reject.Close()
+	if n := this.reject.Count(); n > 0 {
+		logger.Warn("%s %d rows rejected, %d bad rows, see %s", this.displayName, n, this.reject.Errors(),
+			this.reject.path)
+	}
+	if this.err != nil {
+		logger.Error("%s aborted", this.displayName)
+		return
+	}
+	if this.checkpoint != nil {
+		if err := this.checkpoint.finish(); err != nil {
+			this.fail(&JobError{stage: "checkpoint", err: err})
+			return
+		}
+		logger.Info("%s %s", this.displayName, this.checkpoint)
+	}
 	logger.Info("%s end...", this.displayName)
 }
 
-func (this *Job) validate() {
-	
+// checkErrors fail the job if the bad rows are more than the max error
+// percent of the rows read
+func (this *Job) checkErrors() {
+	percent := this.tableinfo.maxerrorpercent
+	errors := this.reject.Errors()
+	if percent <= 0 || errors == 0 {
+		return
+	}
+	rows := atomic.LoadInt64(&this.joined)
+	for _, r := range this.readerlist {
+		rows += r.count
+	}
+	if float64(errors) * 100 > percent * float64(rows) {
+		this.fail(&JobError{stage: "reject", err: fmt.Errorf("%d bad rows of %d rows, more than maxErrorPercent %g%%",
+			errors, rows, percent)})
+	}
 }
 
+// committedNodes the nodes the copy is done, for a failed job, the copy may
+// be done on some nodes before the failure
+func (this *Job) committedNodes() []string {
+	nodes := make([]string, 0)
+	for _, sender := range this.senderlist {
+		if sender.committed {
+			nodes = append(nodes, sender.dbi.address())
+		}
+	}
+	return nodes
+}
 
+// setupBinaryEncoder make the binary encoder by the column types of the
+// table on the first node, the tables on all nodes should be the same
+func (this *Job) setupBinaryEncoder() error {
+	types, err := this.senderlist[0].ColumnTypes()
+	if err != nil {
+		return fmt.Errorf("fail to get the column types, %s", err.Error())
+	}
+	columns := this.tableinfo.columns
+	if len(columns) == 0 {
+		return fmt.Errorf("columns should be provided in binary mode")
+	}
+	coltypes := make([]string, len(columns))
+	for i, col := range columns {
+		t, ok := types[unquoteIdent(col)]
+		if !ok {
+			return fmt.Errorf("column %s not found on the node", col)
+		}
+		coltypes[i] = t
+	}
+	this.binary, err = NewBinaryEncoder(this.tableinfo.input, columns, coltypes)
+	return err
+}
+
+// validate bind the columns and make the partition key, the job fails before
+// it starts if the table is not configured right
+func (this *Job) validate() error {
+	tinfo := this.tableinfo
+	for _, source := range this.sources {
+		if source.parquet == nil {
+			continue
+		}
+		if tinfo.input != tinfo.format {
+			return &JobError{stage: "config", path: source.path,
+				err: fmt.Errorf("a parquet file, not %s", tinfo.input.CopyOptions())}
+		}
+		if err := source.parquet.bind(tinfo.columns, tinfo.format); err != nil {
+			return &JobError{stage: "config", path: source.path, err: err}
+		}
+	}
+	if err := tinfo.format.bindColumns(tinfo.columns); err != nil {
+		return &JobError{stage: "config", err: err}
+	}
+	if tinfo.input != tinfo.format {
+		if err := tinfo.input.bindColumns(tinfo.columns); err != nil {
+			return &JobError{stage: "config", err: err}
+		}
+	}
+	// the partition key named by the json paths are the fields after the
+	// columns
+	if json, ok := tinfo.input.(*JSONFormat); ok && len(json.keyPaths) > 0 {
+		tinfo.partitionField = json.keyFields()
+	}
+	key, err := NewPartitionKey(tinfo, this.slicenum)
+	if err != nil {
+		return &JobError{stage: "config", err: err}
+	}
+	this.partitionKey = key
+	if g_checkpoint {
+		return this.setupCheckpoint()
+	}
+	return nil
+}
+
+// setupCheckpoint make the checkpoint of the job, or load the one of the
+// last run to resume the load, the file is written at the first commit
+func (this *Job) setupCheckpoint() error {
+	for _, source := range this.sources {
+		if !source.Splittable() {
+			return &JobError{stage: "checkpoint", path: source.path,
+				err: fmt.Errorf("read as a stream, it can not be checkpointed")}
+		}
+	}
+	path := checkpointPath(this.jobid, this.tableinfo.name)
+	if g_resume {
+		cp, err := LoadCheckpoint(path, this.tableinfo, this.chunks)
+		if err == nil {
+			logger.Info("%s resume from %s, %s", this.displayName, path, cp)
+			this.checkpoint = cp
+			this.reject.Append()
+			return nil
+		} else if !os.IsNotExist(err) {
+			return &JobError{stage: "checkpoint", err: err}
+		}
+		// nothing is committed by the last run
+	} else if _, err := os.Stat(path); err == nil {
+		return &JobError{stage: "checkpoint", err: fmt.Errorf("checkpoint %s exists, the last load is not "+
+			"finished, run with --resume, or remove it to load again", path)}
+	}
+	this.checkpoint = NewCheckpoint(path, this.tableinfo, this.chunks)
+	return nil
+}
+
+
+// makeChunks split the files to the chunks of about the same size, the size
+// is the total size of the files divided by the number of readers, a small
+// file is one chunk, the fixed length records are split at the record
+// boundaries
 func (this *Job) makeChunks() {
-	chunksize := ((this.filesize-1) / int64(g_readernum)) + 1
-	left := this.filesize
+	var total int64
+	for _, source := range this.sources {
+		if source.Splittable() {
+			total += source.size
+		}
+	}
+	if total > 0 {
+		chunksize := (total-1) / int64(g_readernum) + 1
+		for _, source := range this.sources {
+			if !source.Splittable() || source.size == 0 {
+				continue
+			}
+			n := int((source.size-1) / chunksize + 1)
+			var chunks []*Chunk
+			if fixed, ok := this.tableinfo.input.(*FixedFormat); ok && fixed.recordLength > 0 {
+				chunks = source.MakeRecordChunks(n, g_bufsize, int64(fixed.recordLength))
+			} else {
+				chunks = source.MakeChunks(n, g_bufsize)
+			}
+			for _, chunk := range chunks {
+				chunk.index = len(this.chunks)
+				this.chunks = append(this.chunks, chunk)
+			}
+		}
+	}
+	this.remainHolder = NewChunkRemainHolder(len(this.chunks))
+	for range this.chunks {
+		this.chunkstats = append(this.chunkstats, &ChunkStat{})
+	}
+}
+
+// locate resolve the position in the chunk to the file, by the sizes and the
+// newlines of the chunks before it in the file, the fixed length records of
+// the plain file are numbered by the offset
+func (this *Job) locate(pos RowPosition) RowPosition {
+	var offset, lines int64
+	length := int64(0)
+	if fixed, ok := this.tableinfo.input.(*FixedFormat); ok {
+		length = int64(fixed.recordLength)
+	}
+	parquet := false
+	for _, source := range this.sources {
+		if source.path == pos.path {
+			parquet = source.parquet != nil
+		}
+	}
+	for k := pos.chunk - 1; k >= 0 && this.chunks[k].source.path == pos.path; k-- {
+		chunk := this.chunks[k]
+		if length > 0 && chunk.source.compression == COMPRESSION_NONE {
+			offset += chunk.chunksize
+			continue
+		}
+		stat := this.chunkstats[k]
+		stat.count(chunk)
+		if stat.err != nil {
+			logger.Warn("%s fail to locate the row in %s, %s", this.displayName, pos.path, stat.err.Error())
+			return RowPosition{path: pos.path, chunk: -1, offset: -1}
+		}
+		offset += stat.size
+		lines += stat.lines
+	}
+	pos.chunk, pos.offset, pos.line = -1, offset + pos.offset, lines + pos.line + 1
+	if length > 0 {
+		pos.line = pos.offset / length + 1
+	}
+	if parquet {
+		// the offset is of the rows decoded, the line is the row
+		pos.offset = -1
+	}
+	return pos
+}
+
+// runStreamReaders read the files which can not be split, each by a stream
+// reader, at most g_readernum files at the same time, the blocks channel is
+// closed when all of them are done
+func (this *Job) runStreamReaders(blocks chan *Block) {
+	streams := make(chan *DataSource, len(this.sources))
+	for _, source := range this.sources {
+		if !source.Splittable() {
+			streams <- source
+		}
+	}
+	close(streams)
+
+	var wg sync.WaitGroup
 	for i := 0; i < g_readernum; i++ {
-		chunk := new(Chunk)
-		if left > chunksize {
-			chunk.chunksize = chunksize
-		} else {
-			chunk.chunksize = left
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for source := range streams {
+				if this.ctx.Err() != nil {
+					break
+				}
+				stream, err := source.Open()
+				if err != nil {
+					this.fail(&JobError{stage: "open", path: source.path, err: err})
+					break
+				}
+				err = NewStreamReader(source.path, this.tableinfo.input, g_bufsize).Run(this.ctx, stream, blocks)
+				if err != nil && this.ctx.Err() == nil {
+					this.fail(&JobError{stage: "read", path: source.path, err: err})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(blocks)
+}
+
+
+// findChunkStates scan every chunk from all the possible states in parallel,
+// then chain the chunks from the file start to get the real state at the
+// start of each chunk, the last chunk of a file is not scanned. the formats
+// without the state (json, fixed) are not scanned, and the state of the text
+// format only depends on the backslashes right before the chunk, they are
+// read from the plain file instead
+func (this *Job) findChunkStates() error {
+	format := this.tableinfo.input
+	if !hasStates(format) {
+		return nil
+	}
+	_, text := format.(*TextFormat)
+	ends := make([][FORMAT_STATE_NUM]int, len(this.chunks))
+	errs := make([]error, len(this.chunks))
+	scans := make(chan int, len(this.chunks))
+	for i, chunk := range this.chunks {
+		if chunk.whole || i+1 == len(this.chunks) || this.chunks[i+1].source != chunk.source {
+			continue
+		}
+		if text && chunk.source.compression == COMPRESSION_NONE {
+			continue
 		}
-		left -= chunksize
-		chunk.bufsize = g_bufsize
-		chunk.offset = chunksize * int64(i)
-		this.chunks = append(this.chunks, chunk)
+		scans <- i
+	}
+	close(scans)
+
+	// at most g_readernum chunks are read at the same time
+	var wg sync.WaitGroup
+	for w := 0; w < g_readernum; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buffer []byte
+			for i := range scans {
+				chunk := this.chunks[i]
+				if len(buffer) != chunk.bufsize {
+					buffer = make([]byte, chunk.bufsize)
+				}
+				errs[i] = this.scanChunk(chunk, &ends[i], buffer)
+			}
+		}()
 	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return &JobError{stage: "scan", path: this.chunks[i].source.path, err: err}
+		}
+	}
+
+	state := FORMAT_STATE_START
+	for i, chunk := range this.chunks {
+		if i == 0 || this.chunks[i-1].source != chunk.source || chunk.whole {
+			state = FORMAT_STATE_START
+		} else if text && chunk.source.compression == COMPRESSION_NONE {
+			s, err := textStateAt(chunk.source.fd, chunk.offset)
+			if err != nil {
+				return &JobError{stage: "scan", path: chunk.source.path, err: err}
+			}
+			state = s
+		}
+		chunk.state = state
+		state = ends[i][state]
+	}
+	return nil
 }
 
+// scanChunk get the state at the chunk end from each possible start state
+func (this *Job) scanChunk(chunk *Chunk, states *[FORMAT_STATE_NUM]int, buffer []byte) error {
+	for s := range states {
+		states[s] = s
+	}
+	r, err := chunk.open()
+	if err != nil {
+		return fmt.Errorf("fail to open chunk %d, %s", chunk.index, err.Error())
+	}
+	defer r.Close()
+	for this.ctx.Err() == nil {
+		n, err := r.Read(buffer)
+		this.tableinfo.input.ScanStates(buffer[:n], states)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("fail to read chunk %d, %s", chunk.index, err.Error())
+		}
+	}
+	return this.ctx.Err()
+}
 
-func NewJob(index int, tinfo *TableInfo, jwg *sync.WaitGroup) *Job {
+// NewJob open the data files of the table, the job is returned with the error
+// if a file can not be opened, so it is summarized as failed with the others
+func NewJob(index int, tinfo *TableInfo, jwg *sync.WaitGroup) (*Job, error) {
 	logger.Debug("makeing the %dth new job with table %s", index, tinfo.name)
 	j := &Job{
 		senderlist: make([]*Sender, 0),
@@ -148,141 +639,384 @@ func NewJob(index int, tinfo *TableInfo, jwg *sync.WaitGroup) *Job {
 		nodedq: make([]*DataQueue, 0),
 		chunks: make([]*Chunk, 0),
 		tableinfo: tinfo,
-		remainHolder: NewChunkRemainHolder(g_readernum),
 		jobid: index,
+		slicenum: len(tinfo.dbinfos),
 		jwg: jwg,
+		reject: NewRejectFile(tinfo.rejectpath),
 		displayName: fmt.Sprintf("job[%d]-%s", index, tinfo.name),
 	}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
 
-	for i:=0; i<g_slice_num; i++ {
-		j.nodedq = append(j.nodedq, NewDataQueue())
+	for i:=0; i<j.slicenum; i++ {
+		j.nodedq = append(j.nodedq, NewDataQueue(g_DataQueueSize))
 	}
-	datafile := j.tableinfo.datapath
-	f, err := os.Stat(datafile)
-	if err != nil {
-		fmt.Println("fail to open", datafile)
-		os.Exit(1)
+	for _, datafile := range j.tableinfo.datapath {
+		source, err := OpenDataSource(datafile)
+		if err != nil {
+			return j, &JobError{stage: "open", path: datafile, err: err}
+		}
+		j.sources = append(j.sources, source)
+		j.filesize += source.size
+		if source.parquet != nil && len(tinfo.columns) == 0 {
+			// the columns of the parquet file are the table columns
+			tinfo.columns = source.parquet.Columns()
+			logger.Info("%s columns of %s: %s", j.displayName, datafile, strings.Join(tinfo.columns, ", "))
+		}
 	}
-
-	j.filesize = f.Size()
 	j.makeChunks()
-	return j
+	j.reject.SetMaxErrors(tinfo.maxerrors)
+	if tinfo.maxerrorpercent > 0 {
+		// the rows are at most the bytes of the plain files, so the load
+		// stops once the bad rows are more than the percent of it
+		size := int64(0)
+		for _, source := range j.sources {
+			if !source.Splittable() || source.compression != COMPRESSION_NONE || source.parquet != nil {
+				size = -1
+				break
+			}
+			size += source.size
+		}
+		j.reject.SetMaxErrorPercent(tinfo.maxerrorpercent, size)
+	}
+	j.reject.SetLocator(j.locate)
+	return j, nil
 }
 
 
 // since multiple reader case, a reader can start at any place of a file,
-// maybe in the middle of a line, so we just ignore the data before first
-// newline as "head", the same as the tail, after all the reader work is
+// maybe in the middle of a record, so we just ignore the data before first
+// record end as "head", the same as the tail, after all the reader work is
 // done, collect head an tail for all readers, and join then as a valid
-// record again, and send it to copy reader(simulate a new basket)
+// record again, and send it to copy reader(simulate a new basket), a chunk
+// without any record end is a part of a record, it is joined to the next
 func (this *Job) AnalyzeChunkHeadAndTail() {
-	var count = g_readernum
 	var remainTuples = make([]string, 0)
-	var tuple, frontpart, endpart string
+	var positions = make([]RowPosition, 0) // where each remain tuple is
+	var tuple, frontpart, path string
+	var header, broken bool
+	var front RowPosition // where the frontpart starts
 
-	if count < 1 {
-		logger.Fatal("AnalyzeChunkHeadAndTail should not accept the count less than 1")
-	}
-	
 	if this.remainHolder == nil {
 		logger.Warn("chunk remainer holder is None")
 		return 
 	}
 
-	for i := 0; i < count; i++ {
-		// if it is the first reader, the head is a valid tuple
-		if i == 0 {
-			tuple = this.remainHolder.holders[i].head
-			remainTuples = append(remainTuples, tuple)
-			frontpart = this.remainHolder.holders[i].tail
-			continue
+	// the chunks of a file are joined, the first record of the file is the
+	// header, the readers never take it since it is the head of the first
+	// chunk, the last record without the newline at the file end is taken,
+	// the chunks of the whole records have no header, head and tail
+	finishFile := func() {
+		if len(frontpart) > 0 && !broken && !header {
+			remainTuples = append(remainTuples, frontpart + "\n")
+			positions = append(positions, front)
 		}
+		frontpart = ""
+		broken = false
+	}
 
-		if i == count -1 {
-			if len(this.remainHolder.holders[i].tail) != 0 {
-				logger.Fatal("the last chunk should not have a tail, but %s",
-					this.remainHolder.holders[i].tail)
-			}
+	for i, chunk := range this.chunks {
+		if i == 0 || chunk.source != this.chunks[i-1].source {
+			finishFile()
+			header = hasHeader(this.tableinfo.input) && !chunk.whole
+			path = chunk.source.path
+			front = RowPosition{path: path, chunk: chunk.index}
 		}
-
-		endpart = this.remainHolder.holders[i].head
-		tuple = frontpart + endpart
-		remainTuples = append(remainTuples, tuple)
-		frontpart = this.remainHolder.holders[i].tail
+		holder := this.remainHolder.holders[chunk.index]
+		if holder == nil && chunk.whole {
+			continue
+		} else if holder == nil {
+			// the chunk is not read for the max tuple limit, the records
+			// around it are not complete
+			frontpart = ""
+			header = false
+			broken = true
+			continue
+		}
+		if !holder.boundary {
+			frontpart += holder.head
+			continue
+		}
+		tuple = frontpart + holder.head
+		if header {
+			header = false
+		} else if len(tuple) > 0 && !broken {
+			remainTuples = append(remainTuples, tuple)
+			positions = append(positions, front)
+		}
+		broken = false
+		frontpart = holder.tail
+		// the tail is at the end of the chunk, so it is where the next chunk
+		// starts back by the tail
+		front = RowPosition{path: path, chunk: chunk.index + 1, offset: -int64(len(holder.tail)),
+			line: -int64(strings.Count(holder.tail, "\n"))}
 	}
+	finishFile()
 
-	for _, tuple = range remainTuples {
+	// the joined tuples of a node are sent in one basket, they are the last
+	// chunk of the checkpoint
+	baskets := make([]*TupleBasket, this.slicenum)
+	for i := range baskets {
+		baskets[i] = NewTupleBasket()
+	}
+	var skip []int64
+	if this.checkpoint != nil {
+		skip, _ = this.checkpoint.skip(len(this.chunks))
+		for _, b := range baskets {
+			b.chunk, b.upto = len(this.chunks), 1
+		}
+	}
+	atomic.AddInt64(&this.joined, int64(len(remainTuples)))
+	for i, tuple := range remainTuples {
 		bytetuple := []byte(tuple)
-		s := GetFieldByIndex(bytetuple, this.tableinfo.partitionField, 1)
-		if len(s) == 0 {
-			logger.Fatal("fail to parse the field by index")
+		if isSkipped(this.tableinfo.input, bytetuple) {
+			continue
 		}
-
+		split, err := splitRecord(this.tableinfo.input, bytetuple)
 		size := -1
-		if strings.ToLower(this.tableinfo.partitionFieldType) == "integer" {
-
-			key, err := strconv.Atoi(string(s))
-			if err != nil {
-				logger.Fatal(err.Error())
+		if err == nil {
+			size, err = this.partitionKey.Route(bytetuple, split)
+		}
+		if err == ErrNoPartition {
+			if err := this.reject.Write(bytetuple, positions[i], err.Error()); err != nil {
+				this.fail(&JobError{stage: "reject", path: positions[i].path, err: err})
+				return
 			}
-			mod := C.int(len(this.senderlist))
-
-			size = int(C.get_matching_hash_bounds_int(C.int(key), mod))
-		} else if strings.ToLower(this.tableinfo.partitionFieldType) == "numeric" {
-			mod := C.int(len(this.senderlist))
-			size = int(C.get_matching_hash_bounds_numeric(C.CString(string(s)), mod))
+			continue
+		} else if err != nil {
+			if err := this.reject.WriteBad("route", bytetuple, positions[i], err); err != nil {
+				this.fail(err)
+				return
+			}
+			continue
+		}
+		if this.binary != nil {
+			bytetuple, err = this.binary.Encode(bytetuple, split)
+		} else if this.tableinfo.input != this.tableinfo.format {
+			bytetuple, err = convertRecord(this.tableinfo.input, this.tableinfo.format, bytetuple, split)
+		}
+		if err != nil {
+			if err := this.reject.WriteBad("convert", []byte(tuple), positions[i], err); err != nil {
+				this.fail(err)
+				return
+			}
+			continue
+		}
+		if skip != nil && skip[int(size)] > 0 {
+			// committed on the node by the last run
+			continue
+		}
+		baskets[int(size)].Write(bytetuple)
+		baskets[int(size)].rows++
+	}
+	for i, b := range baskets {
+		if b.Len() == 0 && this.checkpoint == nil {
+			continue
+		}
+		if err := this.nodedq[i].putQ(this.ctx, b); err != nil {
+			b.release()
+			return
 		}
-		b := NewTupleBasket()
-		b.Write(bytetuple)
-		this.nodedq[int(size)].putQ(b)
 	}
 }
 
 
 // go through the data chain or queue, and create a gorouting go send basket
-// data to copy data sender gorouting for each node
+// data to copy data sender gorouting for each node, the copy is ended and
+// committed when the batch of the sender is full, between the baskets
 func (this *Job) GoThroughDataQueue() {
-	for i:=0; i<g_slice_num; i++ {
+	for i:=0; i<this.slicenum; i++ {
 		this.gwg.Add(1)
-		go func(i int) {
-			q := this.nodedq[i]
-			s := this.senderlist[i]
-			for {
-				b := q.popQ()
-				if b == nil {
-					time.Sleep(time.Duration(10)*time.Millisecond)
-					continue
-				}
+		go this.goThrough(i)
+	}
+}
 
-				buf := make([]byte, 2048)
-				for {
-					n, err := b.Read(buf)
-					if err == io.EOF {
-						break
-					}
+// goThrough send the baskets of the node to the sender, the baskets of the
+// batch are kept for the replay if the retries are enabled, see retry.go
+func (this *Job) goThrough(i int) {
+	q := this.nodedq[i]
+	s := this.senderlist[i]
+	batch := NewBatchProgress()
+	open := false
+	keep := g_retries > 0 && !g_atomic
+	held := make([]*TupleBasket, 0)
+	release := func() {
+		for _, b := range held {
+			b.release()
+		}
+		held = held[:0]
+	}
+	defer func() {
+		release()
+		close(s.batches)
+		this.gwg.Done()
+	}()
+
+	// the error of the copy, it is expected if the job has failed already
+	failCopy := func(err error) {
+		if this.ctx.Err() != nil {
+			logger.Warn("%s copy aborted on %s, %s", this.displayName, s.dbi.address(), err.Error())
+		} else {
+			this.fail(err)
+		}
+	}
 
-					s.w.Write(buf[:n])
+	// send write the basket to the copy, the copy is started if it is not
+	// open, the batch is replayed on a new connection if the copy fails
+	send := func(b *TupleBasket) error {
+		var err error
+		if !open {
+			err = s.begin()
+		}
+		if err == nil {
+			open = true
+			if b != nil {
+				if err = s.write(b); err != nil {
+					open = false
+					if cerr := s.abort(err); cerr != nil {
+						err = cerr
+					}
 				}
-				if b.last == true {
-					logger.Debug("%s meet the last basket", this.displayName)
-					break
+			}
+		}
+		if err != nil {
+			open = false
+			_, err = this.recover(s, held, &JobError{stage: "copy", node: s.dbi.address(), err: err})
+			if err != nil {
+				return err
+			}
+			open = true
+		}
+		return nil
+	}
+
+	// end the copy of the batch, and commit the transaction of it, the xid
+	// is saved to the checkpoint before the commit
+	end := func() error {
+		if err := s.end(); err != nil {
+			return &JobError{stage: "copy", node: s.dbi.address(), err: err}
+		}
+		if !s.txn {
+			return nil
+		}
+		var prepare func(xid string) error
+		if this.checkpoint != nil {
+			prepare = func(xid string) error {
+				return this.checkpoint.prepare(i, batch, xid)
+			}
+		}
+		if err := s.commit(prepare); err != nil {
+			return &JobError{stage: "commit", node: s.dbi.address(), err: err}
+		}
+		return nil
+	}
+
+	// commit the batch, a lost commit is checked by the xid, a failed one
+	// is replayed and committed again
+	commit := func() error {
+		started := open
+		open = false
+		for started {
+			err := end()
+			if err == nil {
+				break
+			}
+			committed, err := this.recover(s, held, err)
+			if err != nil {
+				return err
+			} else if committed {
+				break
+			}
+		}
+		if this.checkpoint != nil && (started || !batch.empty()) {
+			err := this.checkpoint.commit(i, batch)
+			batch = NewBatchProgress()
+			if err != nil {
+				return &JobError{stage: "checkpoint", err: err}
+			}
+		}
+		if started {
+			this.reportBatch(s)
+		}
+		release()
+		return nil
+	}
+
+	if err := send(nil); err != nil {
+		failCopy(err)
+		return
+	}
+	for this.ctx.Err() == nil {
+		b, err := q.popQ(this.ctx)
+		if err != nil {
+			break
+		}
+
+		// the pipe write returns when the copy has read all of it, then the
+		// slab can be reused, unless it may be replayed
+		if b.Len() > 0 {
+			if keep {
+				held = append(held, b)
+			}
+			if err := send(b); err != nil {
+				if !keep {
+					b.release()
 				}
+				failCopy(err)
+				return
 			}
-			s.w.Close()
-			this.gwg.Done()
-		}(i)
+		}
+		batch.add(b)
+		if !keep || b.Len() == 0 {
+			b.release()
+		}
+		if b.last == true {
+			logger.Debug("%s meet the last basket", this.displayName)
+			break
+		}
+		if s.full() {
+			if err := commit(); err != nil {
+				failCopy(err)
+				return
+			}
+		}
 	}
+	if this.ctx.Err() != nil {
+		// the copy reads the error, and sends CopyFail to the node, the rows
+		// of the batch on the node are rolled back
+		if open {
+			s.abort(fmt.Errorf("%s aborted", this.displayName))
+			logger.Warn("%s copy aborted on %s", this.displayName, s.dbi.address())
+		}
+		return
+	}
+	if err := commit(); err != nil {
+		failCopy(err)
+		return
+	}
+	s.committed = !s.atomic
+	logger.Info("%s data has been copied", s.name)
 }
 
-// send data to the sender's shutdown chan, hope it can stop, and this
-// operation is considered not a in hurry action, since the sender will
-// finish the copy work before it shutdown, and operaiton more like
-// indicator to indicat the sender can exit after copy (it is a little
-// tricky control, sender also can quit whenever copy is down), but anyway
-// it is a old design but not much problem here.
+// reportBatch the progress of the job when a batch of the sender is
+// committed
+func (this *Job) reportBatch(s *Sender) {
+	rows := s.rows
+	all := atomic.AddInt64(&this.rows, rows)
+	s.done()
+	if s.batchrows == 0 && s.batchsize == 0 {
+		// one copy for the whole table
+		return
+	}
+	size, unit := sizeConvert(s.totalbytes)
+	logger.Info("%s batch %d committed on %s, %d rows, total %d rows %d%s, %d rows on all nodes",
+		this.displayName, s.batchcount, s.dbi.address(), rows, s.totalrows, size, unit, all)
+}
+
+// WaitSendersStop let the senders close the connections, a sender closes it
+// once its copies end, or after the two phase commit in the atomic mode
 func (this *Job) WaitSendersStop() {
 	for i:=0; i<len(this.senderlist); i++ {
-		this.senderlist[i].shutdown <- 0
+		close(this.senderlist[i].shutdown)
 	}
 }
 
@@ -290,9 +1024,11 @@ func (this *Job) WaitSendersStop() {
 // put a final basket to the data chain, indicate there is no data anymore,
 // and the sender can send a EOF to copy data reader
 func (this *Job) FinishAllReadWork() {
-	for i:=0; i<g_slice_num; i++ {
+	for i:=0; i<this.slicenum; i++ {
 		b := NewTupleBasket()
 		b.last = true
-		this.nodedq[i].putQ(b)
+		if err := this.nodedq[i].putQ(this.ctx, b); err != nil {
+			return
+		}
 	}
 }
@@ -0,0 +1,315 @@
+package main
+
+// the json lines (ndjson) input, each line is a json object, the columns are
+// taken from the object by the json path of each column (the column name by
+// default), and the record is written in the COPY format of the table (csv
+// or text) for the senders. the partition key can be named by the paths, so
+// the key need not be a loaded column, like loading the whole object to a
+// jsonb column and routing by a nested key.
+//
+// the path is like $.user.id, user.id, items[0].sku or $["a.b"], "$" is the
+// whole object. a string is loaded as the text, the number, boolean, object
+// and array are loaded as the json text, the json null and the missing key
+// are null.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"loadconfig"
+	"strconv"
+)
+
+// jsonPathItem is a key of the object, or an index of the array if key is nil
+type jsonPathItem struct {
+	key *string
+	index int
+}
+
+type JSONFormat struct {
+	paths map[string]string // the column name to the path
+	keyPaths []string // the paths of the partition key
+	fields [][]jsonPathItem // the paths of the columns, then the keys
+	columns int
+}
+
+// NewJSONFormatFromConfig the paths are checked here, the columns are bound
+// later since they can be discovered
+func NewJSONFormatFromConfig(t *loadconfig.Table) (*JSONFormat, error) {
+	f := &JSONFormat{paths: make(map[string]string), keyPaths: t.PartitionPath}
+	for column, path := range t.JsonPaths {
+		if _, err := parseJSONPath(path); err != nil {
+			return nil, fmt.Errorf("column %s: %s", column, err.Error())
+		}
+		f.paths[unquoteIdent(column)] = path
+	}
+	for _, path := range t.PartitionPath {
+		if _, err := parseJSONPath(path); err != nil {
+			return nil, fmt.Errorf("partition path: %s", err.Error())
+		}
+	}
+	return f, nil
+}
+
+// parseJSONPath split the path to the keys and the indexes
+func parseJSONPath(path string) ([]jsonPathItem, error) {
+	bad := fmt.Errorf("invalid json path %s", path)
+	items := make([]jsonPathItem, 0)
+	s := path
+	if len(s) > 0 && s[0] == '$' {
+		s = s[1:]
+	} else if len(s) > 0 {
+		s = "." + s
+	}
+	for len(s) > 0 {
+		switch {
+		case s[0] == '.':
+			end := 1
+			for end < len(s) && s[end] != '.' && s[end] != '[' {
+				end++
+			}
+			if end == 1 {
+				return nil, bad
+			}
+			key := s[1:end]
+			items = append(items, jsonPathItem{key: &key})
+			s = s[end:]
+		case s[0] == '[' && len(s) > 1 && s[1] == '"':
+			// the quoted key, the json string
+			end := 2
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end+1 >= len(s) || s[end+1] != ']' {
+				return nil, bad
+			}
+			var key string
+			if err := json.Unmarshal([]byte(s[1:end+1]), &key); err != nil {
+				return nil, bad
+			}
+			items = append(items, jsonPathItem{key: &key})
+			s = s[end+2:]
+		case s[0] == '[':
+			end := bytes.IndexByte([]byte(s), ']')
+			if end < 0 {
+				return nil, bad
+			}
+			index, err := strconv.Atoi(s[1:end])
+			if err != nil || index < 0 {
+				return nil, bad
+			}
+			items = append(items, jsonPathItem{index: index})
+			s = s[end+1:]
+		default:
+			return nil, bad
+		}
+	}
+	return items, nil
+}
+
+// FindRecordEnd the newline in a json string is escaped, so the record ends
+// at any newline
+func (this *JSONFormat) FindRecordEnd(buf []byte, state *int) int {
+	return bytes.IndexByte(buf, '\n')
+}
+
+func (this *JSONFormat) ScanStates(buf []byte, states *[FORMAT_STATE_NUM]int) {
+}
+
+// bindColumns get the path of each column, the partition key paths are the
+// fields after the columns
+func (this *JSONFormat) bindColumns(columns []string) error {
+	if len(columns) == 0 {
+		return fmt.Errorf("the columns are required for the ndjson input")
+	}
+	this.fields = make([][]jsonPathItem, 0)
+	this.columns = len(columns)
+	names := make(map[string]bool)
+	for _, column := range columns {
+		name := unquoteIdent(column)
+		names[name] = true
+		path, ok := this.paths[name]
+		if !ok {
+			path = "$[" + strconv.Quote(name) + "]"
+		}
+		items, err := parseJSONPath(path)
+		if err != nil {
+			return err
+		}
+		this.fields = append(this.fields, items)
+	}
+	for name := range this.paths {
+		if !names[name] {
+			return fmt.Errorf("the json path of %s is not for a column", name)
+		}
+	}
+	for _, path := range this.keyPaths {
+		items, _ := parseJSONPath(path)
+		this.fields = append(this.fields, items)
+	}
+	return nil
+}
+
+// keyFields the positions of the partition key paths, as the partitionField
+func (this *JSONFormat) keyFields() []int {
+	fields := make([]int, 0)
+	for i := range this.keyPaths {
+		fields = append(fields, this.columns + i + 1)
+	}
+	return fields
+}
+
+// jsonNode a value of the record, an object or array is split to its members
+// at the first lookup in it, and kept for the other paths of the record
+type jsonNode struct {
+	raw json.RawMessage
+	object map[string]*jsonNode
+	array []*jsonNode
+	split bool
+}
+
+// parse split the object or array to its members, the other values have no
+// members
+func (this *jsonNode) parse() error {
+	this.split = true
+	raw := bytes.TrimSpace(this.raw)
+	if len(raw) > 0 && raw[0] == '{' {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return err
+		}
+		this.object = make(map[string]*jsonNode, len(object))
+		for key, value := range object {
+			this.object[key] = &jsonNode{raw: value}
+		}
+	} else if len(raw) > 0 && raw[0] == '[' {
+		var array []json.RawMessage
+		if err := json.Unmarshal(raw, &array); err != nil {
+			return err
+		}
+		this.array = make([]*jsonNode, len(array))
+		for i, value := range array {
+			this.array[i] = &jsonNode{raw: value}
+		}
+	}
+	return nil
+}
+
+// member get the member of the object or array, nil if it is missing
+func (this *jsonNode) member(item jsonPathItem) (*jsonNode, error) {
+	if !this.split {
+		if err := this.parse(); err != nil {
+			return nil, err
+		}
+	}
+	if item.key != nil {
+		return this.object[*item.key], nil
+	}
+	if item.index < len(this.array) {
+		return this.array[item.index], nil
+	}
+	return nil, nil
+}
+
+// lookup get the value at the path, nil if it is missing
+func (this *jsonNode) lookup(path []jsonPathItem) (json.RawMessage, error) {
+	node := this
+	for _, item := range path {
+		next, err := node.member(item)
+		if err != nil || next == nil {
+			return nil, err
+		}
+		node = next
+	}
+	return node.raw, nil
+}
+
+// jsonValue get the text of the json value, the string is unquoted
+func jsonValue(raw json.RawMessage) ([]byte, bool, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, true, nil
+	}
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, false, err
+		}
+		return []byte(s), false, nil
+	}
+	return raw, false, nil
+}
+
+// split get the values of the columns and then the partition key paths, the
+// object is parsed once for all of them
+func (this *JSONFormat) split(c []byte) (*Fields, error) {
+	line := bytes.TrimSpace(c)
+	if len(line) == 0 || line[0] != '{' {
+		return nil, fmt.Errorf("invalid json object: %s", string(line))
+	}
+	root := &jsonNode{raw: line}
+	if err := root.parse(); err != nil {
+		return nil, fmt.Errorf("invalid json object: %s", err.Error())
+	}
+	split := &Fields{
+		values: make([][]byte, len(this.fields)),
+		nulls: make([]bool, len(this.fields)),
+		columns: this.columns,
+	}
+	for i, path := range this.fields {
+		raw, err := root.lookup(path)
+		if err != nil {
+			return nil, err
+		}
+		if split.values[i], split.nulls[i], err = jsonValue(raw); err != nil {
+			return nil, err
+		}
+	}
+	return split, nil
+}
+
+// GetField the index is of the columns, then the partition key paths
+func (this *JSONFormat) GetField(c []byte, index int) ([]byte, bool, error) {
+	if index < 1 || index > len(this.fields) {
+		return nil, false, fmt.Errorf("too few fields, field %d not found", index)
+	}
+	split, err := this.split(c)
+	if err != nil {
+		return nil, false, err
+	}
+	return split.values[index-1], split.nulls[index-1], nil
+}
+
+// GetFields get the values of the columns
+func (this *JSONFormat) GetFields(c []byte) ([][]byte, []bool, error) {
+	split, err := this.split(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return split.values[:split.columns], split.nulls[:split.columns], nil
+}
+
+// AppendRecord write the fields as a json array, the json input is only read,
+// the records are sent in the COPY format of the table
+func (this *JSONFormat) AppendRecord(buf []byte, fields [][]byte, nulls []bool) []byte {
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if !nulls[i] {
+			values[i] = string(field)
+		}
+	}
+	b, _ := json.Marshal(values)
+	return append(append(buf, b...), '\n')
+}
+
+func (this *JSONFormat) CopyOptions() string {
+	return "ndjson"
+}
+
+// isBlank check the blank line of the json lines, it is skipped
+func isBlank(tuple []byte) bool {
+	return len(bytes.TrimSpace(tuple)) == 0
+}
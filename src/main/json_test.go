@@ -0,0 +1,158 @@
+package main
+
+import (
+	"loadconfig"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// jsonPathOf the items of the path, the keys as strings and the indexes as
+// ints
+func jsonPathOf(items []jsonPathItem) []interface{} {
+	path := make([]interface{}, 0)
+	for _, item := range items {
+		if item.key != nil {
+			path = append(path, *item.key)
+		} else {
+			path = append(path, item.index)
+		}
+	}
+	return path
+}
+
+func TestJSONPath(t *testing.T) {
+	cases := []struct {
+		path string
+		items []interface{}
+	}{
+		{"$", []interface{}{}},
+		{"id", []interface{}{"id"}},
+		{"$.id", []interface{}{"id"}},
+		{"$.user.id", []interface{}{"user", "id"}},
+		{"user.id", []interface{}{"user", "id"}},
+		{"items[0]", []interface{}{"items", 0}},
+		{"items[12].sku", []interface{}{"items", 12, "sku"}},
+		{"$[1][0]", []interface{}{1, 0}},
+		// the quoted key is a json string, it may have the dots and brackets
+		{`$["a.b"]`, []interface{}{"a.b"}},
+		{`$["a[0]"].c`, []interface{}{"a[0]", "c"}},
+		{`$["say \"hi\"!"]`, []interface{}{`say "hi"!`}},
+		{`$.x["y"][3]`, []interface{}{"x", "y", 3}},
+	}
+	for _, c := range cases {
+		items, err := parseJSONPath(c.path)
+		if err != nil {
+			t.Errorf("parseJSONPath(%q): %s", c.path, err)
+			continue
+		}
+		if got := jsonPathOf(items); !reflect.DeepEqual(got, c.items) {
+			t.Errorf("parseJSONPath(%q) = %v, want %v", c.path, got, c.items)
+		}
+	}
+
+	for _, path := range []string{"$.", "a..b", "a.", "$a", "items[x]", "items[-1]", "items[0",
+		`$["a`, `$["a"`, `$["a"x]`, `$["\x"]`} {
+		if items, err := parseJSONPath(path); err == nil {
+			t.Errorf("parseJSONPath(%q) = %v, no error", path, jsonPathOf(items))
+		}
+	}
+}
+
+func TestJSONSplit(t *testing.T) {
+	f, err := NewJSONFormatFromConfig(&loadconfig.Table{
+		JsonPaths: map[string]string{
+			"uid": "user.id",
+			"sku": "items[0].sku",
+			"dotted": `$["a.b"]`,
+			"doc": "$",
+			`"Tag"`: "$.tags[1]",
+		},
+		PartitionPath: []string{"$.user.region"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the column without the path is the key of the column name
+	if err := f.bindColumns([]string{"id", "uid", "sku", "dotted", `"Tag"`, "Flag", "doc"}); err != nil {
+		t.Fatal(err)
+	}
+	if fields := f.keyFields(); !reflect.DeepEqual(fields, []int{8}) {
+		t.Errorf("keyFields = %v", fields)
+	}
+
+	null := "<null>"
+	cases := []struct {
+		line string
+		values []string // the columns, then the partition key
+	}{
+		{`{"id": 1, "user": {"id": "u1", "region": "eu"}, "items": [{"sku": "a\tb"}], "a.b": 2.50,` +
+			` "tags": ["x", {"y": [1]}], "flag": true}`,
+			[]string{"1", "u1", "a\tb", "2.50", `{"y": [1]}`, "true", "", "eu"}},
+		// the json null, the missing key and the index out of the array are null
+		{` {"id": null, "user": {"id": 7}, "items": [], "tags": ["x"]} `,
+			[]string{null, "7", null, null, null, null, "", null}},
+		{`{"user": "u", "items": {"0": 1}, "a": {"b": 1}, "flag": "é\"\\"}`,
+			[]string{null, null, null, null, null, "é\"\\", "", null}},
+	}
+	for _, c := range cases {
+		split, err := f.split([]byte(c.line + "\n"))
+		if err != nil {
+			t.Errorf("split(%s): %s", c.line, err)
+			continue
+		}
+		got := make([]string, len(split.values))
+		for i, v := range split.values {
+			got[i] = string(v)
+			if split.nulls[i] {
+				got[i] = null
+			}
+		}
+		// the whole object is the trimmed line
+		want := append([]string{}, c.values...)
+		want[6] = strings.TrimSpace(c.line)
+		if !reflect.DeepEqual(got, want) || split.columns != 7 {
+			t.Errorf("split(%s)\n got %q\nwant %q", c.line, got, want)
+		}
+
+		key, isNull, err := f.GetField([]byte(c.line), 8)
+		if err != nil || isNull != (c.values[7] == null) || !isNull && string(key) != c.values[7] {
+			t.Errorf("GetField(%s, 8) = %q, %v, %v", c.line, key, isNull, err)
+		}
+	}
+
+	for _, line := range []string{"", "[1, 2]", `"id"`, `{"id": 1`, `{"id": 1} x`, `{"items": [1}`} {
+		if _, err := f.split([]byte(line)); err == nil {
+			t.Errorf("split(%s) no error", line)
+		}
+	}
+	if _, _, err := f.GetField([]byte(`{}`), 9); err == nil {
+		t.Errorf("GetField(9) no error")
+	}
+}
+
+func TestJSONConfig(t *testing.T) {
+	for _, c := range []loadconfig.Table{
+		{JsonPaths: map[string]string{"id": "$.a[x]"}},
+		{PartitionPath: []string{"a..b"}},
+	} {
+		if _, err := NewJSONFormatFromConfig(&c); err == nil {
+			t.Errorf("NewJSONFormatFromConfig(%+v) no error", c)
+		}
+	}
+
+	f, err := NewJSONFormatFromConfig(&loadconfig.Table{JsonPaths: map[string]string{"ID": "$.x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.bindColumns(nil); err == nil {
+		t.Errorf("bindColumns without the columns, no error")
+	}
+	// the path is of the column id, the name is folded
+	if err := f.bindColumns([]string{`"ID"`}); err == nil {
+		t.Errorf("the path of a column not loaded, no error")
+	}
+	if err := f.bindColumns([]string{"id"}); err != nil {
+		t.Errorf("bindColumns(id): %s", err)
+	}
+}
@@ -23,11 +23,19 @@ var (
 	g_dbinfos []DBInfo
 	g_tableinfos []TableInfo
 	g_quiet = false
+	g_stdin = false // a table reads from stdin
 	g_filesize int64 = 0
 	g_jobs []*Job
 	g_slice_num = 0
 	g_encoding string
 	g_has_csv_header bool = false
+	g_discover bool = false
+	g_atomic bool = false
+	g_journal *Journal
+	g_commitrows int64 = 0 // the rows of a copy, 0 is no limit
+	g_commitsize int64 = 0 // the bytes of a copy, 0 is no limit
+	g_checkpoint bool = false
+	g_resume bool = false // resume the load by the checkpoints of the last run
 	jwg sync.WaitGroup
 )
 
@@ -39,7 +47,8 @@ func loadConfig(configFile string) (*loadconfig.Config) {
 	
 	conf, err := loadconfig.ReadConfigData(configFile)
 	if err != nil {
-		logger.Fatal(err.Error())
+		logger.Error("fail to read the configuration %s, %s", configFile, err.Error())
+		os.Exit(1)
 	}
 	return conf
 }
@@ -59,6 +68,16 @@ func loadSysConfig(configFile string) (*loadconfig.SysConfig) {
 }
 
 
+// journalPath the journal of the atomic load, the config file + ".journal"
+// if it is not set
+func journalPath(conf *loadconfig.Config) string {
+	if conf.Journal != "" {
+		return conf.Journal
+	}
+	return g_configfile + ".journal"
+}
+
+
 func sysinit(conf *loadconfig.Config, sysconf *loadconfig.SysConfig) {
 	logger.set_log_level(conf.Loglevel)
 
@@ -69,6 +88,38 @@ func sysinit(conf *loadconfig.Config, sysconf *loadconfig.SysConfig) {
 	g_slice_num = conf.Slicenum
 	g_encoding = conf.Encoding
 	g_has_csv_header = conf.Csvheader
+	g_discover = conf.Discover
+	g_atomic = conf.Atomic
+	if g_atomic {
+		g_journal = NewJournal(journalPath(conf))
+	}
+	g_commitrows = conf.CommitRows
+	g_commitsize = int64(conf.CommitSize) * 1024 * 1024
+	g_checkpoint = conf.Checkpoint
+	if g_commitrows < 0 || g_commitsize < 0 {
+		logger.Error("invalid commitrows %d or commitsize %d", conf.CommitRows, conf.CommitSize)
+		os.Exit(1)
+	}
+	g_retries = conf.Retries
+	if conf.RetryWait > 0 {
+		g_retrywait = time.Duration(conf.RetryWait) * time.Second
+	}
+	if g_retries < 0 || conf.RetryWait < 0 {
+		logger.Error("invalid retries %d or retrywait %d", conf.Retries, conf.RetryWait)
+		os.Exit(1)
+	}
+	if (g_checkpoint || (g_retries > 0 && !g_atomic)) && g_commitrows == 0 && g_commitsize == 0 {
+		g_commitsize = 64 * 1024 * 1024
+	}
+	if g_atomic && (g_commitrows > 0 || g_commitsize > 0) {
+		logger.Error("atomic can not be set with commitrows, commitsize or checkpoint, " +
+			"the table is committed at once")
+		os.Exit(1)
+	}
+	if g_resume && !g_checkpoint {
+		logger.Error("--resume needs the checkpoint")
+		os.Exit(1)
+	}
 
 	if sysconf != nil {
 		g_BasketTupleSize = sysconf.Basket_tuple_size * 1024 * 1024
@@ -77,21 +128,97 @@ func sysinit(conf *loadconfig.Config, sysconf *loadconfig.SysConfig) {
 	}
 
 	g_tableinfos = make([]TableInfo, 0)
+	stdinTable := ""
 	for i:=0; i<g_tablenum; i++ {
 		t := conf.Tables[i]
+		datapath, err := expandDatapath(t.Datapath)
+		if err != nil {
+			logger.Error("table %s: %s", t.Tablename, err.Error())
+			os.Exit(1)
+		}
+		if len(datapath) == 1 && datapath[0] == "-" {
+			// stdin can only be read once
+			if stdinTable != "" {
+				logger.Error("table %s and %s both read from stdin", stdinTable, t.Tablename)
+				os.Exit(1)
+			}
+			stdinTable = t.Tablename
+			g_stdin = true
+		}
+		rejectpath := t.Rejectfile
+		if rejectpath == "" && stdinTable == t.Tablename {
+			rejectpath = "stdin.reject"
+		} else if rejectpath == "" && len(t.Datapath) == 1 && datapath[0] == t.Datapath[0] {
+			rejectpath = t.Datapath[0] + ".reject"
+		} else if rejectpath == "" {
+			rejectpath = t.Tablename + ".reject"
+		}
+		var maxerrors int64
+		if t.MaxErrors != nil {
+			maxerrors = *t.MaxErrors
+		} else if t.MaxErrorPercent > 0 {
+			maxerrors = -1
+		}
+		if maxerrors < -1 || t.MaxErrorPercent < 0 || t.MaxErrorPercent > 100 {
+			logger.Error("table %s: invalid maxErrors or maxErrorPercent", t.Tablename)
+			os.Exit(1)
+		}
+		if t.MaxErrorPercent > 0 && (g_commitrows > 0 || g_commitsize > 0) {
+			// the percent is known after all the rows are read, the batches
+			// before it are committed already
+			logger.Error("table %s: maxErrorPercent can not be set with commitrows, commitsize, checkpoint " +
+				"or retries, the batches are committed before all the rows are read", t.Tablename)
+			os.Exit(1)
+		}
+		target := t.Target
+		if target == "" {
+			target = conf.Target
+		}
+		if t.Binary && g_encoding != "" {
+			// the binary copy has no encoding, the text is sent as it is
+			logger.Error("table %s: binary can not be set with encoding %s, the text should be in the "+
+				"server encoding", t.Tablename, g_encoding)
+			os.Exit(1)
+		}
+		format, err := NewFormatFromConfig(&t)
+		if err != nil {
+			logger.Error("table %s: %s", t.Tablename, err.Error())
+			os.Exit(1)
+		}
+		input, err := NewInputFormatFromConfig(&t, format)
+		if err != nil {
+			logger.Error("table %s: %s", t.Tablename, err.Error())
+			os.Exit(1)
+		}
 		g_tableinfos = append(g_tableinfos,
 			TableInfo{
 				name: t.Tablename,
-				columns:strings.Split(t.Columns, ","),
-				datapath: t.Datapath,
+				columns:splitList(t.Columns),
+				datapath: datapath,
 				partitionField: t.PartitionField,
-				partitionFieldType: t.PartitionFieldType,
+				partitionFieldType: splitList(t.PartitionFieldType),
+				partitionStrategy: t.PartitionStrategy,
+				partitions: t.Partitions,
+				rejectpath: rejectpath,
+				maxerrors: maxerrors,
+				maxerrorpercent: t.MaxErrorPercent,
 				schema: conf.Schema,
+				target: target,
+				format: format,
+				input: input,
+				binary: t.Binary,
 			})
 	}
 
-	if g_slice_num != g_nodenum {
-		logger.Error("configuration not consistant: slice nubmer should be equal to g_nodenum")
+	if conf.Discover {
+		discoverTables(conf)
+		applyTargetTemplates()
+		return
+	}
+
+	mapping, err := makeSliceNodeMapping(conf)
+	if err != nil {
+		logger.Error("configuration not consistant: %s", err.Error())
 		os.Exit(1)
 	}
 	
@@ -100,9 +227,7 @@ func sysinit(conf *loadconfig.Config, sysconf *loadconfig.SysConfig) {
 	for i:=0; i < g_slice_num; i++ {
 		remainder := i;
 
-		// target_node_index := remainder % g_nodenum
-		// n := conf.Nodes[target_node_index]
-		n := conf.Nodes[remainder]
+		n := conf.Nodes[mapping[remainder]]
 		g_dbinfos[i] = DBInfo{
 			host: n.Host,
 			port: n.Port,
@@ -113,16 +238,126 @@ func sysinit(conf *loadconfig.Config, sysconf *loadconfig.SysConfig) {
 			schema: conf.Schema,
 		}
 	}
+
+	for i:=0; i<g_tablenum; i++ {
+		g_tableinfos[i].dbinfos = g_dbinfos
+	}
+	applyTargetTemplates()
+}
+
+
+// each slice of a table copies into the physical partition on its node, the
+// name is made by the target template of the table, like
+// "{schema}_{remainder}.{table}" or "{table}_p{remainder}"
+func applyTargetTemplates() {
+	for i:=0; i<g_tablenum; i++ {
+		tinfo := &g_tableinfos[i]
+		if len(tinfo.target) == 0 {
+			continue
+		}
+		dbinfos := make([]DBInfo, len(tinfo.dbinfos))
+		copy(dbinfos, tinfo.dbinfos)
+		for j := range dbinfos {
+			dbinfos[j].schema, dbinfos[j].tablename = makeTargetName(
+				tinfo.target, tinfo.schema, tinfo.name, dbinfos[j].remainder)
+		}
+		tinfo.dbinfos = dbinfos
+	}
+}
+
+
+// map each remainder(slice) to the index of the node it lives on, if the
+// remainders are configured for the nodes, use them, otherwise remainder i
+// goes to node i % len(nodes), like the mgt tools do
+func makeSliceNodeMapping(conf *loadconfig.Config) ([]int, error) {
+	if g_nodenum == 0 {
+		return nil, fmt.Errorf("no nodes configured")
+	}
+	if g_slice_num <= 0 {
+		g_slice_num = g_nodenum
+	}
+	mapping := make([]int, g_slice_num)
+
+	explicit := false
+	for _, n := range conf.Nodes {
+		if len(n.Remainders) > 0 {
+			explicit = true
+		}
+	}
+	if !explicit {
+		for i:=0; i<g_slice_num; i++ {
+			mapping[i] = i % g_nodenum
+		}
+		return mapping, nil
+	}
+
+	for i:=0; i<g_slice_num; i++ {
+		mapping[i] = -1
+	}
+	for nodeid, n := range conf.Nodes {
+		for _, r := range n.Remainders {
+			if r < 0 || r >= g_slice_num {
+				return nil, fmt.Errorf("remainder %d of node %s:%d out of slice number %d",
+					r, n.Host, n.Port, g_slice_num)
+			}
+			if mapping[r] >= 0 {
+				return nil, fmt.Errorf("remainder %d configured on more than one node", r)
+			}
+			mapping[r] = nodeid
+		}
+	}
+	for i:=0; i<g_slice_num; i++ {
+		if mapping[i] < 0 {
+			return nil, fmt.Errorf("remainder %d not configured on any node", i)
+		}
+	}
+	return mapping, nil
+}
+
+
+// read the partition layout of all the tables from the coordinator
+func discoverTables(conf *loadconfig.Config) {
+	c := conf.Coordinator
+	logger.Info("discover the partition layout from %s:%d", c.Host, c.Port)
+	d, err := NewDiscoverer(c.Host, c.Port, conf.User, conf.Password, conf.Dbname)
+	if err != nil {
+		logger.Error("fail to connect coordinator %s:%d, %s", c.Host, c.Port, err.Error())
+		os.Exit(1)
+	}
+	defer d.Close()
+
+	for i:=0; i<g_tablenum; i++ {
+		tinfo := &g_tableinfos[i]
+		if err := d.Discover(tinfo); err != nil {
+			logger.Error("fail to discover table %s, %s", tinfo.name, err.Error())
+			os.Exit(1)
+		}
+	}
 }
 
 
 func showConfigInfo() {
 	var info = "\n-----Distributed Database Data Loading Tool-----\n"
 	info += fmt.Sprintf("  node number:\t%d\n", g_nodenum)
-	info += fmt.Sprintf("  slice number:\t%d\n", g_slice_num)
+	if !g_discover {
+		// the slices of each table are shown with it in the discover mode
+		info += fmt.Sprintf("  slice number:\t%d\n", len(g_dbinfos))
+	}
 	info += fmt.Sprintf("  encoding:\t%s\n", g_encoding)
 	info += fmt.Sprintf("   csv header:\t%t\n", g_has_csv_header)
-	for i:=0; i<g_slice_num; i++ {
+	if g_atomic {
+		info += fmt.Sprintf("  atomic:\ttrue, journal: %s\n", g_journal.path)
+	}
+	if g_commitrows > 0 || g_commitsize > 0 {
+		info += fmt.Sprintf("  commit:\tevery %d rows, %d MB\n", g_commitrows, g_commitsize/1024/1024)
+	}
+	if g_retries > 0 {
+		info += fmt.Sprintf("  retries:\t%d, wait %s\n", g_retries, g_retrywait)
+	}
+	if g_checkpoint {
+		info += fmt.Sprintf("  checkpoint:\ttrue, resume: %t\n", g_resume)
+	}
+	for i:=0; i<len(g_dbinfos); i++ {
 		d := g_dbinfos[i]
 		info += fmt.Sprintf("    remainder: %d, host: %s, port: %d, user: %s, db: %s\n",
 			d.remainder, d.host, d.port, d.user, d.dbname)
@@ -135,8 +370,33 @@ func showConfigInfo() {
 		info += fmt.Sprintf("  [%d] table name: %s\n", i, c.name)
 		info += fmt.Sprintf("       columns: %s\n", strings.Join(c.columns, ","))
 		info += fmt.Sprintf("       schema: %s\n", c.schema)
-		info += fmt.Sprintf("       datapath: %s\n", c.datapath)
-		info += fmt.Sprintf("       partitionFIeld: %d %s\n", c.partitionField, c.partitionFieldType)
+		if len(c.target) > 0 {
+			info += fmt.Sprintf("       target: %s\n", c.target)
+		}
+		if len(c.datapath) == 1 {
+			info += fmt.Sprintf("       datapath: %s\n", c.datapath[0])
+		} else {
+			info += fmt.Sprintf("       datapath: %s ... (%d files)\n", c.datapath[0], len(c.datapath))
+		}
+		info += fmt.Sprintf("       format: %s\n", c.format.CopyOptions())
+		if c.input != c.format {
+			info += fmt.Sprintf("       input: %s\n", c.input.CopyOptions())
+		}
+		info += fmt.Sprintf("       partitionFIeld: %v %s\n", c.partitionField,
+			strings.Join(c.partitionFieldType, ","))
+		if c.partitionStrategy != "" {
+			info += fmt.Sprintf("       partitionStrategy: %s (%d partitions)\n",
+				c.partitionStrategy, len(c.partitions))
+		}
+		if g_discover {
+			info += fmt.Sprintf("       slice number: %d\n", len(c.dbinfos))
+		}
+		if g_discover || len(c.target) > 0 {
+			for _, d := range c.dbinfos {
+				info += fmt.Sprintf("       slice %d -> host: %s, port: %d, user: %s, db: %s, table: %s.%s\n",
+					d.remainder, d.host, d.port, d.user, d.dbname, d.schema, d.tablename)
+			}
+		}
 	}
 
 	info += "System Parameters:\n"
@@ -157,7 +417,11 @@ func prepareJobs() {
 	g_jobs = make([]*Job, 0)
 
 	for i:=0; i<g_tablenum; i++ {
-		job := NewJob(i, &g_tableinfos[i], &jwg)
+		job, err := NewJob(i, &g_tableinfos[i], &jwg)
+		if err != nil {
+			// the job is not processed, and it is summarized at the end
+			job.fail(err)
+		}
 		g_jobs = append(g_jobs, job)
 	}
 	logger.Debug("there totally %d jobs to be processed", len(g_jobs))
@@ -167,8 +431,14 @@ func prepareJobs() {
 func validateJobs() {
 	logger.Debug("validate jobs start...")
 	for i, job := range g_jobs {
+		if job.err != nil {
+			continue
+		}
 		logger.Info("[%d] job start to validation...", i)
-		job.validate()
+		if err := job.validate(); err != nil {
+			job.fail(err)
+			continue
+		}
 		logger.Info("[%d] job validation successfully complete", i)
 	}
 	logger.Debug("validate jobs end...")
@@ -177,6 +447,11 @@ func validateJobs() {
 func processJobs() {
 	logger.Debug("process jobs start...")
 	for i, job := range g_jobs {
+		if job.err != nil {
+			// failed before it starts, the other jobs go on
+			job.closeSources()
+			continue
+		}
 		jwg.Add(1)
 		logger.Debug("[%d] job start to process...", i)
 		go job.process()
@@ -185,7 +460,8 @@ func processJobs() {
 	logger.Debug("process jobs end...")
 }
 
-func endJobs() {
+// endJobs summarize the failed jobs, the number of them is returned
+func endJobs() int {
 	logger.Debug("end jobs start...")
 	//var total_handlecount int64 = 0
 	//for i, r := range readerlist {
@@ -195,7 +471,47 @@ func endJobs() {
 	//}
 	//logger.Printf("total handle count is %d\n", total_handlecount)
 	//logger.Println("total execution interval is", time.Since(start))
+	logger.Info("%s", g_slabs)
+	if g_journal != nil {
+		// the transactions of the run are resolved unless they failed in
+		// the commit, only those are left for the recover
+		g_journal.Close()
+		if err := compactJournal(g_journal.path); err != nil {
+			logger.Warn("fail to compact journal %s, %s", g_journal.path, err.Error())
+		}
+	}
+
+	failed := 0
+	for _, job := range g_jobs {
+		if job.err == nil {
+			continue
+		}
+		failed++
+		summary := fmt.Sprintf("%s failed\n%s", job.displayName, errorSummary(job.err, "    "))
+		if job.checkpoint != nil {
+			summary += fmt.Sprintf("    the committed batches are kept, %s\n", job.checkpoint)
+			summary += fmt.Sprintf("    run with --resume to load the rest, see %s\n", job.checkpoint.path)
+		} else if nodes := job.committedNodes(); len(nodes) > 0 {
+			summary += fmt.Sprintf("    the copy was done before the failure on %s\n", strings.Join(nodes, ", "))
+		} else if len(job.senderlist) == 0 {
+			summary += "    the job is not started, nothing is copied\n"
+		} else {
+			summary += "    the copy is rolled back on all nodes\n"
+		}
+		logger.Error("%s", summary)
+	}
+	if failed > 0 {
+		logger.Error("%d of %d jobs failed", failed, len(g_jobs))
+	} else {
+		// all loaded, nothing to resume
+		for _, job := range g_jobs {
+			if job.checkpoint != nil {
+				os.Remove(job.checkpoint.path)
+			}
+		}
+	}
 	logger.Debug("end jobs end...")
+	return failed
 }
 
 
@@ -210,12 +526,28 @@ func main() {
            panic(err) 
         }
 
-	if len(os.Args) == 2 {
-		g_configfile = os.Args[1]
-	} else if (len(os.Args) == 3) {
+	// resolve the prepared transactions left by a crashed atomic load
+	if len(os.Args) == 3 && os.Args[1] == "recover" {
+		g_configfile = os.Args[2]
+		conf := loadConfig(g_configfile)
+		logger.set_log_level(conf.Loglevel)
+		failed := recoverJournal(conf, journalPath(conf))
+		trace.Stop()
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) >= 2 {
 		g_configfile = os.Args[1]
-		if os.Args[2] == "-q" {
+	}
+	for _, arg := range os.Args[2:] {
+		switch arg {
+		case "-q":
 			g_quiet = true
+		case "--resume":
+			g_resume = true
 		}
 	}
 
@@ -227,7 +559,8 @@ func main() {
 		showConfigInfo()
 	}
 
-	if !g_quiet {
+	// the data comes from stdin, do not wait for the enter
+	if !g_quiet && !g_stdin {
 		fmt.Println("press enter to continue...")
 		fmt.Scanln()
 	}
@@ -238,8 +571,12 @@ func main() {
 	prepareJobs()
 	validateJobs()
 	processJobs()
-	endJobs()
+	failed := endJobs()
 
 	logger.Info("total execution interval is %s", time.Since(start))
+	if failed > 0 {
+		trace.Stop()
+		os.Exit(1)
+	}
 	logger.Info("all work done")
 }
@@ -0,0 +1,434 @@
+package main
+
+// the parquet data file, the file is detected by the magic "PAR1", each row
+// group is a chunk, so the readers decode the row groups in parallel. the
+// columns of the file are matched with the table columns by the name, and
+// each row is written as a record of the table format (csv or text), then
+// the partition key, the reject file and the binary mode work the same way
+// as the text files. the columns of the file are the table columns if they
+// are not configured. the nested and repeated columns are not supported.
+//
+// the values are written as the postgresql input of the logical type, like
+// DATE as 2006-01-02, DECIMAL as the decimal number, the timestamp adjusted
+// to utc has the "+00" zone, and the binary without the string type is bytea
+// in the hex format.
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/deprecated"
+	"github.com/parquet-go/parquet-go/format"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PARQUET_MAGIC = "PAR1"
+	PARQUET_ROWS_PER_READ = 1024
+	// the julian day of 1970-01-01, for the int96 timestamp
+	JULIAN_UNIX_EPOCH_DAY = 2440588
+)
+
+var simpleIdent = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+// parquetConverter append the text of the value to buf
+type parquetConverter func(buf []byte, v parquet.Value) []byte
+
+type ParquetSource struct {
+	file *parquet.File
+	format Format
+	leaves []int // the leaf column of the file for each table column
+	converters []parquetConverter
+}
+
+func openParquet(fd *os.File, size int64) (*ParquetSource, error) {
+	file, err := parquet.OpenFile(fd, size)
+	if err != nil {
+		return nil, err
+	}
+	return &ParquetSource{file: file}, nil
+}
+
+// Columns get the names of the columns of the file, the name is quoted if
+// it is not a lowercase identifier
+func (this *ParquetSource) Columns() []string {
+	names := make([]string, 0)
+	for _, field := range this.file.Schema().Fields() {
+		name := field.Name()
+		if !simpleIdent.MatchString(name) {
+			name = QuoteIdentifier(name)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// bind match the table columns with the columns of the file, and get the
+// converter by the type of each column
+func (this *ParquetSource) bind(columns []string, format Format) error {
+	if len(columns) == 0 {
+		return fmt.Errorf("no columns to read from the parquet file")
+	}
+	this.format = format
+	this.leaves = make([]int, 0, len(columns))
+	this.converters = make([]parquetConverter, 0, len(columns))
+	schema := this.file.Schema()
+	for _, column := range columns {
+		name := unquoteIdent(column)
+		leaf, ok := schema.Lookup(name)
+		if !ok {
+			return fmt.Errorf("column %s is not found in the parquet file", name)
+		}
+		if leaf.MaxRepetitionLevel > 0 || len(leaf.Path) > 1 {
+			return fmt.Errorf("column %s is nested or repeated, it is not supported", name)
+		}
+		converter, err := parquetConverterOf(leaf.Node.Type())
+		if err != nil {
+			return fmt.Errorf("column %s: %s", name, err.Error())
+		}
+		this.leaves = append(this.leaves, leaf.ColumnIndex)
+		this.converters = append(this.converters, converter)
+	}
+	return nil
+}
+
+// MakeChunks make a chunk of each row group, the size is the compressed size
+// of the row group
+func (this *ParquetSource) MakeChunks(source *DataSource, bufsize int) []*Chunk {
+	chunks := make([]*Chunk, 0)
+	for i, rg := range this.file.Metadata().RowGroups {
+		size := rg.TotalCompressedSize
+		if size <= 0 {
+			size = rg.TotalByteSize
+		}
+		chunks = append(chunks, &Chunk{source: source, bufsize: bufsize, rowGroup: i,
+			chunksize: size, whole: true})
+	}
+	return chunks
+}
+
+// openRowGroup decode the row group to the records of the table format
+func (this *ParquetSource) openRowGroup(i int) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		rows := this.file.RowGroups()[i].Rows()
+		defer rows.Close()
+		w := bufio.NewWriterSize(pw, 1024*1024)
+		buffer := make([]parquet.Row, PARQUET_ROWS_PER_READ)
+		values := make([]parquet.Value, len(this.file.Schema().Columns()))
+		fields := make([][]byte, len(this.leaves))
+		nulls := make([]bool, len(this.leaves))
+		ends := make([]int, len(this.leaves))
+		var text, record []byte
+		for {
+			n, err := rows.ReadRows(buffer)
+			for _, row := range buffer[:n] {
+				for _, v := range row {
+					values[v.Column()] = v
+				}
+				// the fields are written to text one by one, then sliced
+				text = text[:0]
+				for k, leaf := range this.leaves {
+					v := values[leaf]
+					nulls[k] = v.IsNull()
+					if !nulls[k] {
+						text = this.converters[k](text, v)
+					}
+					ends[k] = len(text)
+				}
+				start := 0
+				for k := range fields {
+					fields[k] = text[start:ends[k]]
+					start = ends[k]
+				}
+				record = this.format.AppendRecord(record[:0], fields, nulls)
+				if _, err := w.Write(record); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(w.Flush())
+	}()
+	return pr
+}
+
+// unquoteIdent get the name of the column, the quoted name is case
+// sensitive, otherwise it is lowercased the same as postgresql does
+func unquoteIdent(column string) string {
+	name := strings.TrimSpace(column)
+	if len(name) >= 2 && name[0] == '"' && name[len(name)-1] == '"' {
+		return strings.Replace(name[1:len(name)-1], `""`, `"`, -1)
+	}
+	return strings.ToLower(name)
+}
+
+// parquetConverterOf get the converter by the logical type, or the converted
+// type written by the old writers, or the physical type
+func parquetConverterOf(t parquet.Type) (parquetConverter, error) {
+	if lt := t.LogicalType(); lt != nil && lt.Value != nil {
+		switch l := lt.Value.(type) {
+		case *format.StringType, *format.EnumType, *format.JsonType:
+			return convertString, nil
+		case *format.UUIDType:
+			return convertUUID, nil
+		case *format.DateType:
+			return convertDate, nil
+		case *format.TimestampType:
+			if l.Unit.Value == nil {
+				return nil, fmt.Errorf("parquet type %s without the unit", lt)
+			}
+			return convertTimestamp(l.Unit.Value.Duration(), l.IsAdjustedToUTC), nil
+		case *format.TimeType:
+			if l.Unit.Value == nil {
+				return nil, fmt.Errorf("parquet type %s without the unit", lt)
+			}
+			return convertTime(l.Unit.Value.Duration()), nil
+		case *format.DecimalType:
+			return convertDecimal(int(l.Scale)), nil
+		case *format.IntType:
+			if !l.IsSigned {
+				return convertUnsigned, nil
+			}
+		case *format.NullType:
+			return convertString, nil
+		case *format.BsonType:
+			return convertBytea, nil
+		default:
+			return nil, fmt.Errorf("parquet type %s is not supported", lt)
+		}
+	}
+	if ct := t.ConvertedType(); ct != nil {
+		switch *ct {
+		case deprecated.UTF8, deprecated.Enum, deprecated.Json:
+			return convertString, nil
+		case deprecated.Date:
+			return convertDate, nil
+		case deprecated.TimestampMillis:
+			return convertTimestamp(time.Millisecond, true), nil
+		case deprecated.TimestampMicros:
+			return convertTimestamp(time.Microsecond, true), nil
+		case deprecated.TimeMillis:
+			return convertTime(time.Millisecond), nil
+		case deprecated.TimeMicros:
+			return convertTime(time.Microsecond), nil
+		case deprecated.Uint8, deprecated.Uint16, deprecated.Uint32, deprecated.Uint64:
+			return convertUnsigned, nil
+		case deprecated.Decimal:
+			return nil, fmt.Errorf("the decimal without the logical type is not supported")
+		}
+	}
+
+	switch t.Kind() {
+	case parquet.Boolean:
+		return convertBool, nil
+	case parquet.Int32, parquet.Int64:
+		return convertInt, nil
+	case parquet.Int96:
+		return convertInt96, nil
+	case parquet.Float, parquet.Double:
+		return convertFloat, nil
+	case parquet.ByteArray, parquet.FixedLenByteArray:
+		return convertBytea, nil
+	}
+	return nil, fmt.Errorf("parquet type %s is not supported", t)
+}
+
+func convertString(buf []byte, v parquet.Value) []byte {
+	return append(buf, v.ByteArray()...)
+}
+
+func convertBool(buf []byte, v parquet.Value) []byte {
+	return strconv.AppendBool(buf, v.Boolean())
+}
+
+func convertInt(buf []byte, v parquet.Value) []byte {
+	if v.Kind() == parquet.Int32 {
+		return strconv.AppendInt(buf, int64(v.Int32()), 10)
+	}
+	return strconv.AppendInt(buf, v.Int64(), 10)
+}
+
+func convertUnsigned(buf []byte, v parquet.Value) []byte {
+	if v.Kind() == parquet.Int32 {
+		return strconv.AppendUint(buf, uint64(uint32(v.Int32())), 10)
+	}
+	return strconv.AppendUint(buf, uint64(v.Int64()), 10)
+}
+
+// convertFloat the infinity and nan are written as postgresql does
+func convertFloat(buf []byte, v parquet.Value) []byte {
+	bits := 64
+	f := v.Double()
+	if v.Kind() == parquet.Float {
+		bits = 32
+		f = float64(v.Float())
+	}
+	switch {
+	case math.IsNaN(f):
+		return append(buf, "NaN"...)
+	case math.IsInf(f, 1):
+		return append(buf, "Infinity"...)
+	case math.IsInf(f, -1):
+		return append(buf, "-Infinity"...)
+	}
+	return strconv.AppendFloat(buf, f, 'g', -1, bits)
+}
+
+// convertBytea write the bytes in the bytea hex format
+func convertBytea(buf []byte, v parquet.Value) []byte {
+	b := v.ByteArray()
+	buf = append(buf, '\\', 'x')
+	start := len(buf)
+	buf = append(buf, make([]byte, hex.EncodedLen(len(b)))...)
+	hex.Encode(buf[start:], b)
+	return buf
+}
+
+func convertUUID(buf []byte, v parquet.Value) []byte {
+	b := v.ByteArray()
+	if len(b) != 16 {
+		return convertBytea(buf, v)
+	}
+	s := hex.EncodeToString(b)
+	return append(buf, s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]...)
+}
+
+// convertDate the date is the days from 1970-01-01
+func convertDate(buf []byte, v parquet.Value) []byte {
+	return appendDate(buf, time.Unix(int64(v.Int32())*86400, 0).UTC())
+}
+
+func appendDate(buf []byte, t time.Time) []byte {
+	if t.Year() <= 0 {
+		// 1 BC is the year 0
+		return append(t.AddDate(1 - 2*t.Year(), 0, 0).AppendFormat(buf, "2006-01-02"), " BC"...)
+	}
+	return t.AppendFormat(buf, "2006-01-02")
+}
+
+// convertTimestamp the timestamp is the units from 1970-01-01 00:00:00, the
+// fraction is cut to the microseconds as postgresql keeps
+func convertTimestamp(unit time.Duration, utc bool) parquetConverter {
+	return func(buf []byte, v parquet.Value) []byte {
+		n := v.Int64()
+		per := int64(time.Second / unit)
+		t := time.Unix(n/per, (n%per)*int64(unit)).UTC()
+		if n%per < 0 {
+			t = time.Unix(n/per-1, (n%per+per)*int64(unit)).UTC()
+		}
+		return appendTimestamp(buf, t, utc)
+	}
+}
+
+func appendTimestamp(buf []byte, t time.Time, utc bool) []byte {
+	t = t.Truncate(time.Microsecond)
+	bc := t.Year() <= 0
+	if bc {
+		t = t.AddDate(1 - 2*t.Year(), 0, 0)
+	}
+	buf = t.AppendFormat(buf, "2006-01-02 15:04:05.999999")
+	if utc {
+		buf = append(buf, "+00"...)
+	}
+	if bc {
+		buf = append(buf, " BC"...)
+	}
+	return buf
+}
+
+// convertInt96 the int96 timestamp of impala and spark, the nanoseconds of
+// the day and the julian day, little endian
+func convertInt96(buf []byte, v parquet.Value) []byte {
+	i := v.Int96()
+	nanos := int64(uint64(i[1])<<32 | uint64(i[0]))
+	days := int64(i[2]) - JULIAN_UNIX_EPOCH_DAY
+	return appendTimestamp(buf, time.Unix(days*86400, nanos).UTC(), false)
+}
+
+// convertTime the time is the units from the midnight
+func convertTime(unit time.Duration) parquetConverter {
+	return func(buf []byte, v parquet.Value) []byte {
+		var n int64
+		if v.Kind() == parquet.Int32 {
+			n = int64(v.Int32())
+		} else {
+			n = v.Int64()
+		}
+		d := (time.Duration(n) * unit).Truncate(time.Microsecond)
+		t := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Add(d)
+		if d >= 24*time.Hour {
+			return append(buf, "24:00:00"...)
+		}
+		return t.AppendFormat(buf, "15:04:05.999999")
+	}
+}
+
+// convertDecimal the unscaled value is int32, int64 or the big endian two's
+// complement bytes
+func convertDecimal(scale int) parquetConverter {
+	return func(buf []byte, v parquet.Value) []byte {
+		var digits string
+		switch v.Kind() {
+		case parquet.Int32:
+			digits = strconv.FormatInt(int64(v.Int32()), 10)
+		case parquet.Int64:
+			digits = strconv.FormatInt(v.Int64(), 10)
+		default:
+			b := v.ByteArray()
+			n := new(big.Int).SetBytes(b)
+			if len(b) > 0 && b[0] & 0x80 != 0 {
+				n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+			}
+			digits = n.String()
+		}
+		return appendDecimal(buf, digits, scale)
+	}
+}
+
+// appendDecimal put the point into the digits by the scale
+func appendDecimal(buf []byte, digits string, scale int) []byte {
+	if strings.HasPrefix(digits, "-") {
+		buf = append(buf, '-')
+		digits = digits[1:]
+	}
+	if scale <= 0 {
+		buf = append(buf, digits...)
+		for i := 0; i < -scale; i++ {
+			buf = append(buf, '0')
+		}
+		return buf
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale - len(digits) + 1) + digits
+	}
+	buf = append(buf, digits[:len(digits)-scale]...)
+	buf = append(buf, '.')
+	return append(buf, digits[len(digits)-scale:]...)
+}
+
+// isParquetFile check the magic at the start and the end of the file
+func isParquetFile(fd *os.File, size int64, magic []byte) bool {
+	if size < 12 || len(magic) < 4 || string(magic[:4]) != PARQUET_MAGIC {
+		return false
+	}
+	tail := make([]byte, 4)
+	if _, err := fd.ReadAt(tail, size-4); err != nil {
+		return false
+	}
+	return string(tail) == PARQUET_MAGIC
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// the fixture of the parquet types, the columns are written in this order
+type parquetFixture struct {
+	ID int64 `parquet:"id"`
+	Name *string `parquet:"name,optional"`
+	Day int32 `parquet:"day,date"`
+	Ts int64 `parquet:"ts,timestamp(microsecond)"`
+	Amount int64 `parquet:"amount,decimal(2:18)"`
+	Score float64 `parquet:"score"`
+	Ok bool `parquet:"ok"`
+	Raw []byte `parquet:"raw"`
+	U [16]byte `parquet:"u,uuid"`
+	Mixed string `parquet:"MixedCase"`
+}
+
+// writeParquet write the fixture rows, 2 rows in a row group, and open it
+func writeParquet(t *testing.T, rows []parquetFixture) *ParquetSource {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "fixture.parquet")
+	if err := parquet.WriteFile(path, rows, parquet.MaxRowsPerRowGroup(2)); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fd.Close() })
+	info, _ := fd.Stat()
+	p, err := openParquet(fd, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// readParquet decode all the row groups to the records
+func readParquet(t *testing.T, p *ParquetSource) []string {
+	records := make([]string, 0)
+	for i := range p.MakeChunks(nil, 0) {
+		r := p.openRowGroup(i)
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, strings.SplitAfter(string(data), "\n")...)
+		records = records[:len(records)-1]
+	}
+	return records
+}
+
+func TestParquetColumns(t *testing.T) {
+	name := "a\tb\\c"
+	empty := ""
+	u := [16]byte{}
+	for i := range u {
+		u[i] = byte(i * 17)
+	}
+	p := writeParquet(t, []parquetFixture{
+		{ID: 1, Name: &name, Day: 0, Ts: 0, Amount: 12345, Score: 0.5, Ok: true,
+			Raw: []byte{0, 0xff}, U: u, Mixed: "M"},
+		{ID: -2, Name: nil, Day: -1, Ts: -1, Amount: -5, Score: 1.25e-7, Ok: false,
+			Raw: []byte{}, Mixed: ""},
+		{ID: 3, Name: &empty, Day: 18690, Ts: 1614687296789012, Amount: 100, Score: -3,
+			Raw: []byte("x"), Mixed: "NULL"},
+	})
+
+	want := []string{"id", "name", "day", "ts", "amount", "score", "ok", "raw", "u", `"MixedCase"`}
+	if columns := p.Columns(); !reflect.DeepEqual(columns, want) {
+		t.Errorf("columns %q, want %q", columns, want)
+	}
+	if chunks := p.MakeChunks(nil, 0); len(chunks) != 2 || !chunks[0].whole || chunks[1].rowGroup != 1 {
+		t.Errorf("%d chunks of the 2 row groups", len(chunks))
+	}
+
+	// the columns are bound by the names, in the order of the table
+	columns := []string{"amount", `"MixedCase"`, "ID", "name", "day", "ts", "score", "ok", "raw", "u"}
+	if err := p.bind(columns, NewTextFormat()); err != nil {
+		t.Fatal(err)
+	}
+	records := []string{
+		"123.45\tM\t1\ta\\tb\\\\c\t1970-01-01\t1970-01-01 00:00:00+00\t0.5\ttrue\t\\\\x00ff\t" +
+			"00112233-4455-6677-8899-aabbccddeeff\n",
+		"-0.05\t\t-2\t\\N\t1969-12-31\t1969-12-31 23:59:59.999999+00\t1.25e-07\tfalse\t\\\\x\t" +
+			"00000000-0000-0000-0000-000000000000\n",
+		"1.00\tNULL\t3\t\t2021-03-04\t2021-03-02 12:14:56.789012+00\t-3\tfalse\t\\\\x78\t" +
+			"00000000-0000-0000-0000-000000000000\n",
+	}
+	if got := readParquet(t, p); !reflect.DeepEqual(got, records) {
+		t.Errorf("text records\n got %q\nwant %q", got, records)
+	}
+
+	// the csv quotes the string which is the same as the null string
+	if err := p.bind([]string{"id", "name", `"MixedCase"`}, NewCSVFormat()); err != nil {
+		t.Fatal(err)
+	}
+	records = []string{"1,a\tb\\c,M\n", "-2,NULL,\n", "3,,\"NULL\"\n"}
+	if got := readParquet(t, p); !reflect.DeepEqual(got, records) {
+		t.Errorf("csv records\n got %q\nwant %q", got, records)
+	}
+
+	for _, columns := range [][]string{
+		{},
+		{"missing"},
+		// the unquoted name is folded to lower case
+		{"id", "MixedCase"},
+	} {
+		if err := p.bind(columns, NewTextFormat()); err == nil {
+			t.Errorf("bind %q no error", columns)
+		}
+	}
+}
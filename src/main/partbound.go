@@ -0,0 +1,271 @@
+package main
+
+// range and list partition bounds, the bound values and the row keys are
+// parsed to the typed values, and compared the same way postgresql compares
+// them, text is compared bytewise (as the "C" collation), so a range
+// partitioned text key should use COLLATE "C" on the server
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"pghash"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	PARTITION_STRATEGY_HASH int = iota
+	PARTITION_STRATEGY_RANGE
+	PARTITION_STRATEGY_LIST
+)
+
+const (
+	KEY_VALUE_MINVALUE int = -1
+	KEY_VALUE_NORMAL int = 0
+	KEY_VALUE_MAXVALUE int = 1
+)
+
+func parsePartitionStrategy(name string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "hash":
+		return PARTITION_STRATEGY_HASH, nil
+	case "range":
+		return PARTITION_STRATEGY_RANGE, nil
+	case "list":
+		return PARTITION_STRATEGY_LIST, nil
+	}
+	return -1, fmt.Errorf("unsupport partition strategy %s", name)
+}
+
+// keyValue is a typed partition key value, integer types, date and timestamp
+// are kept in i, numeric in n, text and uuid in b
+type keyValue struct {
+	kind int
+	i int64
+	n *big.Rat
+	nan bool
+	b []byte
+}
+
+func parseKeyValue(fieldType int, s []byte) (keyValue, error) {
+	var v keyValue
+	var err error
+	str := strings.TrimSpace(string(s))
+
+	switch fieldType {
+	case PARTITION_FIELD_TYPE_INTEGER:
+		v.i, err = strconv.ParseInt(str, 10, 32)
+	case PARTITION_FIELD_TYPE_SMALLINT:
+		v.i, err = strconv.ParseInt(str, 10, 16)
+	case PARTITION_FIELD_TYPE_BIGINT:
+		v.i, err = strconv.ParseInt(str, 10, 64)
+	case PARTITION_FIELD_TYPE_DATE:
+		var d int32
+		d, err = pghash.ParseDate(str)
+		v.i = int64(d)
+	case PARTITION_FIELD_TYPE_TIMESTAMP:
+		v.i, err = pghash.ParseTimestamp(str)
+	case PARTITION_FIELD_TYPE_NUMERIC:
+		if strings.EqualFold(str, "nan") {
+			v.nan = true
+		} else {
+			var ok bool
+			v.n, ok = new(big.Rat).SetString(str)
+			if !ok {
+				err = fmt.Errorf("invalid input syntax for type numeric: \"%s\"", str)
+			}
+		}
+	case PARTITION_FIELD_TYPE_TEXT:
+		v.b = append([]byte{}, s...)
+	case PARTITION_FIELD_TYPE_UUID:
+		v.b, err = pghash.ParseUUID(str)
+	default:
+		err = fmt.Errorf("unknown partition field type %d", fieldType)
+	}
+	return v, err
+}
+
+// parseBoundValue parse the value in the partition bound, MINVALUE and
+// MAXVALUE are accepted for the range bound
+func parseBoundValue(fieldType int, s string) (keyValue, error) {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "MINVALUE":
+		return keyValue{kind: KEY_VALUE_MINVALUE}, nil
+	case "MAXVALUE":
+		return keyValue{kind: KEY_VALUE_MAXVALUE}, nil
+	}
+	return parseKeyValue(fieldType, []byte(s))
+}
+
+func compareKeyValue(fieldType int, a keyValue, b keyValue) int {
+	if a.kind != KEY_VALUE_NORMAL || b.kind != KEY_VALUE_NORMAL {
+		return a.kind - b.kind
+	}
+
+	switch fieldType {
+	case PARTITION_FIELD_TYPE_NUMERIC:
+		// NaN is larger than any other value, and equals to itself
+		if a.nan || b.nan {
+			if a.nan && b.nan {
+				return 0
+			} else if a.nan {
+				return 1
+			}
+			return -1
+		}
+		return a.n.Cmp(b.n)
+	case PARTITION_FIELD_TYPE_TEXT, PARTITION_FIELD_TYPE_UUID:
+		return bytes.Compare(a.b, b.b)
+	}
+
+	if a.i < b.i {
+		return -1
+	} else if a.i > b.i {
+		return 1
+	}
+	return 0
+}
+
+// the map key for the list partition value lookup
+func (this keyValue) listKey() string {
+	if this.n != nil {
+		return this.n.RatString()
+	} else if this.nan {
+		return "NaN"
+	} else if this.b != nil {
+		return string(this.b)
+	}
+	return strconv.FormatInt(this.i, 10)
+}
+
+// compare multiple column keys, the first not equal column decides, and a
+// MINVALUE or MAXVALUE column hides the following columns
+func compareKeyValues(types []int, a []keyValue, b []keyValue) int {
+	for i := range a {
+		c := compareKeyValue(types[i], a[i], b[i])
+		if c != 0 || a[i].kind != KEY_VALUE_NORMAL {
+			return c
+		}
+	}
+	return 0
+}
+
+// RangeBound is a partition FROM (lower) TO (upper), lower is inclusive and
+// upper is exclusive
+type RangeBound struct {
+	slice int
+	lower []keyValue
+	upper []keyValue
+}
+
+// ListBound is the values of a list partition
+type ListBound struct {
+	slice int
+	values []keyValue
+}
+
+type PartitionBounds struct {
+	ranges []*RangeBound // sorted by the bound
+	lists map[string]int // list value to slice
+	nullSlice int // the list partition accepts null, -1 if none
+	defaultSlice int // -1 if no default partition
+}
+
+func NewPartitionBounds() *PartitionBounds {
+	return &PartitionBounds{
+		ranges: make([]*RangeBound, 0),
+		lists: make(map[string]int),
+		nullSlice: -1,
+		defaultSlice: -1,
+	}
+}
+
+func (this *PartitionBounds) addRange(types []int, slice int, from []string, to []string) error {
+	if len(from) != len(types) || len(to) != len(types) {
+		return fmt.Errorf("range bound column number not match the partition key")
+	}
+	b := &RangeBound{slice: slice}
+	for i := range types {
+		lower, err := parseBoundValue(types[i], from[i])
+		if err != nil {
+			return err
+		}
+		upper, err := parseBoundValue(types[i], to[i])
+		if err != nil {
+			return err
+		}
+		b.lower = append(b.lower, lower)
+		b.upper = append(b.upper, upper)
+	}
+	if compareKeyValues(types, b.lower, b.upper) >= 0 {
+		return fmt.Errorf("empty range bound (%s) to (%s)",
+			strings.Join(from, ","), strings.Join(to, ","))
+	}
+
+	// keep them sorted, and make sure no overlap as postgresql does
+	pos := sort.Search(len(this.ranges), func(i int) bool {
+		return compareKeyValues(types, this.ranges[i].lower, b.lower) > 0
+	})
+	if pos > 0 && compareKeyValues(types, this.ranges[pos-1].upper, b.lower) > 0 {
+		return fmt.Errorf("range bound (%s) overlap with other partition", strings.Join(from, ","))
+	}
+	if pos < len(this.ranges) && compareKeyValues(types, b.upper, this.ranges[pos].lower) > 0 {
+		return fmt.Errorf("range bound (%s) overlap with other partition", strings.Join(to, ","))
+	}
+	this.ranges = append(this.ranges, nil)
+	copy(this.ranges[pos+1:], this.ranges[pos:])
+	this.ranges[pos] = b
+	return nil
+}
+
+func (this *PartitionBounds) addList(fieldType int, slice int, values []string, null bool) error {
+	if len(values) == 0 && !null {
+		return fmt.Errorf("list partition without value")
+	}
+	if null {
+		if this.nullSlice >= 0 {
+			return fmt.Errorf("null is in multiple partitions")
+		}
+		this.nullSlice = slice
+	}
+	for _, s := range values {
+		v, err := parseKeyValue(fieldType, []byte(s))
+		if err != nil {
+			return err
+		}
+		if _, ok := this.lists[v.listKey()]; ok {
+			return fmt.Errorf("list value %s is in multiple partitions", s)
+		}
+		this.lists[v.listKey()] = slice
+	}
+	return nil
+}
+
+// find the slice of the range partition the key belongs to, -1 if not found
+func (this *PartitionBounds) findRange(types []int, key []keyValue) int {
+	pos := sort.Search(len(this.ranges), func(i int) bool {
+		return compareKeyValues(types, this.ranges[i].upper, key) > 0
+	})
+	if pos < len(this.ranges) && compareKeyValues(types, this.ranges[pos].lower, key) <= 0 {
+		return this.ranges[pos].slice
+	}
+	return this.defaultSlice
+}
+
+// the null key goes to the list partition accepts null, the range partition
+// never accepts null, both go to the default partition otherwise
+func (this *PartitionBounds) findNull(strategy int) int {
+	if strategy == PARTITION_STRATEGY_LIST && this.nullSlice >= 0 {
+		return this.nullSlice
+	}
+	return this.defaultSlice
+}
+
+func (this *PartitionBounds) findList(key keyValue) int {
+	if slice, ok := this.lists[key.listKey()]; ok {
+		return slice
+	}
+	return this.defaultSlice
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"loadconfig"
+	"testing"
+)
+
+// the rows are csv, NULL is the null key, and slice -1 means
+// ErrNoPartition
+type routeCase struct {
+	row string
+	slice int
+}
+
+type boundsCase struct {
+	name string
+	strategy string
+	fields []int
+	types []string
+	partitions []loadconfig.Partition
+	routes []routeCase
+}
+
+func routeKey(strategy string, fields []int, types []string,
+	partitions []loadconfig.Partition) (*PartitionKey, error) {
+	tinfo := &TableInfo{
+		name: "t",
+		partitionStrategy: strategy,
+		partitionField: fields,
+		partitionFieldType: types,
+		partitions: partitions,
+		input: NewCSVFormat(),
+	}
+	return NewPartitionKey(tinfo, 4)
+}
+
+func TestPartitionBoundsRoute(t *testing.T) {
+	cases := []boundsCase{
+		{"date range", "range", []int{1}, []string{"date"},
+			[]loadconfig.Partition{
+				{Slice: 1, From: []string{"2021-01-01"}, To: []string{"2021-02-01"}},
+				{Slice: 0, From: []string{"MINVALUE"}, To: []string{"2021-01-01"}},
+				{Slice: 2, From: []string{"2021-02-01"}, To: []string{"2021-03-01"}},
+			},
+			[]routeCase{
+				{"1900-01-01", 0}, {"2020-12-31", 0}, {"2021-01-01", 1},
+				{"2021-01-31", 1}, {"2021-02-01", 2}, {"2021-02-28", 2},
+				// the upper bound is exclusive, and no default partition
+				{"2021-03-01", -1}, {"NULL", -1},
+			}},
+		{"range default", "range", []int{1}, []string{"bigint"},
+			[]loadconfig.Partition{
+				{Slice: 0, From: []string{"0"}, To: []string{"100"}},
+				{Slice: 1, From: []string{"200"}, To: []string{"MAXVALUE"}},
+				{Slice: 3, Default: true},
+			},
+			[]routeCase{
+				{"-1", 3}, {"0", 0}, {"99", 0}, {"100", 3}, {"199", 3},
+				{"200", 1}, {"9223372036854775807", 1},
+				// the range partition never accepts null
+				{"NULL", 3},
+			}},
+		// a MINVALUE or MAXVALUE column hides the following columns
+		{"composite range", "range", []int{1, 2}, []string{"integer", "text"},
+			[]loadconfig.Partition{
+				{Slice: 0, From: []string{"MINVALUE", "MINVALUE"}, To: []string{"1", "m"}},
+				{Slice: 1, From: []string{"1", "m"}, To: []string{"2", "MINVALUE"}},
+				{Slice: 2, From: []string{"2", "MINVALUE"}, To: []string{"MAXVALUE", "MAXVALUE"}},
+			},
+			[]routeCase{
+				{"0,zzz", 0}, {"1,a", 0}, {"1,m", 1}, {"1,zzz", 1},
+				{"2,NULL", -1}, {"2,a", 2}, {"2147483647,x", 2},
+			}},
+		// text is compared bytewise, the upper case is before the lower case
+		{"text range", "range", []int{1}, []string{"text"},
+			[]loadconfig.Partition{
+				{Slice: 0, From: []string{"A"}, To: []string{"a"}},
+				{Slice: 1, From: []string{"a"}, To: []string{"MAXVALUE"}},
+			},
+			[]routeCase{
+				{"B", 0}, {"Zebra", 0}, {"a", 1}, {"apple", 1}, {"@", -1},
+			}},
+		{"numeric range", "range", []int{1}, []string{"numeric"},
+			[]loadconfig.Partition{
+				{Slice: 0, From: []string{"-1.5"}, To: []string{"2.25"}},
+				{Slice: 1, From: []string{"2.25"}, To: []string{"MAXVALUE"}},
+			},
+			[]routeCase{
+				{"-1.50", 0}, {"2.2499", 0}, {"2.250", 1}, {"1e10", 1}, {"NaN", 1}, {"-2", -1},
+			}},
+		{"list", "list", []int{2}, []string{"text"},
+			[]loadconfig.Partition{
+				{Slice: 0, Values: []string{"north", "south"}},
+				{Slice: 1, Values: []string{"east"}, Null: true},
+				{Slice: 2, Default: true},
+			},
+			[]routeCase{
+				{"1,north", 0}, {"2,south", 0}, {"3,east", 1}, {"4,NULL", 1},
+				{"5,west", 2}, {"6,North", 2},
+			}},
+		// the list values are compared by the typed values
+		{"numeric list", "list", []int{1}, []string{"numeric"},
+			[]loadconfig.Partition{
+				{Slice: 0, Values: []string{"1.5", "2"}},
+				{Slice: 1, Values: []string{"NaN"}},
+			},
+			[]routeCase{
+				{"1.50", 0}, {"2.0", 0}, {"nan", 1}, {"3", -1},
+				// no partition accepts null and no default
+				{"NULL", -1},
+			}},
+		{"null only list", "list", []int{1}, []string{"integer"},
+			[]loadconfig.Partition{
+				{Slice: 3, Null: true},
+				{Slice: 0, Values: []string{"1"}},
+			},
+			[]routeCase{
+				{"1", 0}, {"NULL", 3}, {"2", -1},
+			}},
+	}
+
+	for _, c := range cases {
+		k, err := routeKey(c.strategy, c.fields, c.types, c.partitions)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		for _, r := range c.routes {
+			slice, err := k.Route([]byte(r.row), nil)
+			if r.slice < 0 {
+				if err != ErrNoPartition {
+					t.Errorf("%s: route %q = %d, %v, want ErrNoPartition", c.name, r.row, slice, err)
+				}
+				continue
+			}
+			if err != nil || slice != r.slice {
+				t.Errorf("%s: route %q = %d, %v, want %d", c.name, r.row, slice, err, r.slice)
+			}
+		}
+	}
+}
+
+func TestPartitionBoundsConflicts(t *testing.T) {
+	cases := []boundsCase{
+		{"empty range", "range", []int{1}, []string{"integer"},
+			[]loadconfig.Partition{
+				{Slice: 0, From: []string{"10"}, To: []string{"10"}},
+			}, nil},
+		{"overlap lower", "range", []int{1}, []string{"integer"},
+			[]loadconfig.Partition{
+				{Slice: 0, From: []string{"0"}, To: []string{"10"}},
+				{Slice: 1, From: []string{"9"}, To: []string{"20"}},
+			}, nil},
+		{"overlap upper", "range", []int{1}, []string{"integer"},
+			[]loadconfig.Partition{
+				{Slice: 0, From: []string{"10"}, To: []string{"20"}},
+				{Slice: 1, From: []string{"MINVALUE"}, To: []string{"11"}},
+			}, nil},
+		{"range columns", "range", []int{1, 2}, []string{"integer", "integer"},
+			[]loadconfig.Partition{
+				{Slice: 0, From: []string{"0"}, To: []string{"10", "0"}},
+			}, nil},
+		{"bad bound", "range", []int{1}, []string{"date"},
+			[]loadconfig.Partition{
+				{Slice: 0, From: []string{"2021-13-01"}, To: []string{"MAXVALUE"}},
+			}, nil},
+		{"two defaults", "range", []int{1}, []string{"integer"},
+			[]loadconfig.Partition{
+				{Slice: 0, Default: true},
+				{Slice: 1, Default: true},
+			}, nil},
+		{"slice out of range", "range", []int{1}, []string{"integer"},
+			[]loadconfig.Partition{
+				{Slice: 4, From: []string{"0"}, To: []string{"10"}},
+			}, nil},
+		{"no partition", "range", []int{1}, []string{"integer"}, nil, nil},
+		{"duplicate list value", "list", []int{1}, []string{"numeric"},
+			[]loadconfig.Partition{
+				{Slice: 0, Values: []string{"1.5"}},
+				{Slice: 1, Values: []string{"1.50"}},
+			}, nil},
+		{"null in two lists", "list", []int{1}, []string{"text"},
+			[]loadconfig.Partition{
+				{Slice: 0, Values: []string{"a"}, Null: true},
+				{Slice: 1, Null: true},
+			}, nil},
+		{"empty list", "list", []int{1}, []string{"text"},
+			[]loadconfig.Partition{
+				{Slice: 0},
+			}, nil},
+		{"list columns", "list", []int{1, 2}, []string{"text", "text"},
+			[]loadconfig.Partition{
+				{Slice: 0, Values: []string{"a"}},
+			}, nil},
+	}
+	for _, c := range cases {
+		if _, err := routeKey(c.strategy, c.fields, c.types, c.partitions); err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+	}
+}
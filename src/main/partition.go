@@ -0,0 +1,247 @@
+package main
+
+// partition key type handling, each supported type is hashed with the same
+// extended hash function postgresql uses for the hash partition pruning, so
+// a row goes to the same slice as it is inserted from the coordinator
+
+import (
+	"errors"
+	"fmt"
+	"pghash"
+	"strconv"
+	"strings"
+)
+
+const (
+	PARTITION_FIELD_TYPE_INTEGER int = iota
+	PARTITION_FIELD_TYPE_NUMERIC
+	PARTITION_FIELD_TYPE_SMALLINT
+	PARTITION_FIELD_TYPE_BIGINT
+	PARTITION_FIELD_TYPE_TEXT
+	PARTITION_FIELD_TYPE_DATE
+	PARTITION_FIELD_TYPE_TIMESTAMP
+	PARTITION_FIELD_TYPE_UUID
+)
+
+// parsePartitionFieldType map the configured type name (the postgresql type
+// name or its alias) to the partition field type
+func parsePartitionFieldType(name string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "integer", "int", "int4":
+		return PARTITION_FIELD_TYPE_INTEGER, nil
+	case "numeric", "decimal":
+		return PARTITION_FIELD_TYPE_NUMERIC, nil
+	case "smallint", "int2":
+		return PARTITION_FIELD_TYPE_SMALLINT, nil
+	case "bigint", "int8":
+		return PARTITION_FIELD_TYPE_BIGINT, nil
+	case "text", "varchar", "character varying":
+		return PARTITION_FIELD_TYPE_TEXT, nil
+	case "date":
+		return PARTITION_FIELD_TYPE_DATE, nil
+	case "timestamp", "timestamp without time zone":
+		return PARTITION_FIELD_TYPE_TIMESTAMP, nil
+	case "uuid":
+		return PARTITION_FIELD_TYPE_UUID, nil
+	}
+	return -1, fmt.Errorf("unsupport partition field type %s", name)
+}
+
+// hashPartitionKey hash the text form of the partition key by its type
+func hashPartitionKey(fieldType int, key []byte) (uint64, error) {
+	switch fieldType {
+	case PARTITION_FIELD_TYPE_INTEGER:
+		v, err := strconv.ParseInt(strings.TrimSpace(string(key)), 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		return pghash.HashInt(int32(v)), nil
+	case PARTITION_FIELD_TYPE_SMALLINT:
+		v, err := strconv.ParseInt(strings.TrimSpace(string(key)), 10, 16)
+		if err != nil {
+			return 0, err
+		}
+		return pghash.HashInt(int32(v)), nil
+	case PARTITION_FIELD_TYPE_BIGINT:
+		v, err := strconv.ParseInt(strings.TrimSpace(string(key)), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return pghash.HashBigint(v), nil
+	case PARTITION_FIELD_TYPE_NUMERIC:
+		return pghash.HashNumeric(string(key))
+	case PARTITION_FIELD_TYPE_TEXT:
+		return pghash.HashString(key), nil
+	case PARTITION_FIELD_TYPE_DATE:
+		return pghash.HashDate(string(key))
+	case PARTITION_FIELD_TYPE_TIMESTAMP:
+		return pghash.HashTimestamp(string(key))
+	case PARTITION_FIELD_TYPE_UUID:
+		return pghash.HashUUID(string(key))
+	}
+	return 0, fmt.Errorf("unknown partition field type %d", fieldType)
+}
+
+// ErrNoPartition means no partition of the table matches the tuple, only
+// happens for range and list partition without a default partition
+var ErrNoPartition = errors.New("no partition of the table found for the row")
+
+// PartitionKey describe the partition key columns of a table, there are
+// more than one column for a composite key like PARTITION BY HASH (a, b),
+// and how the tuple is routed to the slice by the key
+type PartitionKey struct {
+	fields []int // field position in the tuple, start from 1
+	types []int
+	strategy int
+	modulus int // hash only
+	bounds *PartitionBounds // range and list only
+	format Format
+}
+
+func NewPartitionKey(tinfo *TableInfo, modulus int) (*PartitionKey, error) {
+	fields := tinfo.partitionField
+	typenames := tinfo.partitionFieldType
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no partition field provided")
+	}
+	if len(fields) != len(typenames) {
+		return nil, fmt.Errorf("partition field number %d not match the type number %d",
+			len(fields), len(typenames))
+	}
+	strategy, err := parsePartitionStrategy(tinfo.partitionStrategy)
+	if err != nil {
+		return nil, err
+	}
+	k := &PartitionKey{
+		fields: fields,
+		types: make([]int, len(typenames)),
+		strategy: strategy,
+		modulus: modulus,
+		format: tinfo.input,
+	}
+	for i, name := range typenames {
+		if fields[i] < 1 {
+			return nil, fmt.Errorf("invalid partition field %d, start from 1", fields[i])
+		}
+		t, err := parsePartitionFieldType(name)
+		if err != nil {
+			return nil, err
+		}
+		k.types[i] = t
+	}
+
+	if strategy == PARTITION_STRATEGY_HASH {
+		return k, nil
+	}
+
+	if strategy == PARTITION_STRATEGY_LIST && len(fields) != 1 {
+		return nil, fmt.Errorf("list partition key should be one column")
+	}
+	if len(tinfo.partitions) == 0 {
+		return nil, fmt.Errorf("no partitions provided for %s partition", tinfo.partitionStrategy)
+	}
+	k.bounds = NewPartitionBounds()
+	for _, p := range tinfo.partitions {
+		if p.Slice < 0 || p.Slice >= modulus {
+			return nil, fmt.Errorf("partition slice %d out of range [0, %d)", p.Slice, modulus)
+		}
+		if p.Default {
+			if k.bounds.defaultSlice >= 0 {
+				return nil, fmt.Errorf("more than one default partition")
+			}
+			k.bounds.defaultSlice = p.Slice
+			continue
+		}
+		if strategy == PARTITION_STRATEGY_RANGE {
+			err = k.bounds.addRange(k.types, p.Slice, p.From, p.To)
+		} else {
+			err = k.bounds.addList(k.types[0], p.Slice, p.Values, p.Null)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// getFields get the text of all the key columns from the tuple, or from the
+// split record if it is not nil, the key is nil if the column is null
+func (this *PartitionKey) getFields(tuple []byte, split *Fields) ([][]byte, bool, error) {
+	keys := make([][]byte, len(this.fields))
+	hasNull := false
+	for i, field := range this.fields {
+		var s []byte
+		var null bool
+		var err error
+		if split != nil {
+			s, null = split.values[field-1], split.nulls[field-1]
+		} else {
+			s, null, err = this.format.GetField(tuple, field)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if null {
+			hasNull = true
+			continue
+		}
+		keys[i] = s
+	}
+	return keys, hasNull, nil
+}
+
+// Route get the slice the tuple belongs to, ErrNoPartition is returned if no
+// range or list partition matches, split is the record split by splitRecord,
+// or nil
+func (this *PartitionKey) Route(tuple []byte, split *Fields) (int, error) {
+	keys, hasNull, err := this.getFields(tuple, split)
+	if err != nil {
+		return -1, err
+	}
+
+	var slice int
+	switch {
+	case hasNull && this.strategy != PARTITION_STRATEGY_HASH:
+		slice = this.bounds.findNull(this.strategy)
+	case this.strategy == PARTITION_STRATEGY_HASH:
+		return this.getMatchingHashBound(keys)
+	case this.strategy == PARTITION_STRATEGY_RANGE:
+		values := make([]keyValue, len(keys))
+		for i, s := range keys {
+			values[i], err = parseKeyValue(this.types[i], s)
+			if err != nil {
+				return -1, err
+			}
+		}
+		slice = this.bounds.findRange(this.types, values)
+	case this.strategy == PARTITION_STRATEGY_LIST:
+		value, err := parseKeyValue(this.types[0], keys[0])
+		if err != nil {
+			return -1, err
+		}
+		slice = this.bounds.findList(value)
+	}
+
+	if slice < 0 {
+		return -1, ErrNoPartition
+	}
+	return slice, nil
+}
+
+// getMatchingHashBound get the remainder of the slice the key belongs to,
+// the column hashes are combined in the key column order as postgresql does,
+// and the null column is skipped
+func (this *PartitionKey) getMatchingHashBound(keys [][]byte) (int, error) {
+	var rowHash uint64 = 0
+	for i, s := range keys {
+		if s == nil {
+			continue
+		}
+		h, err := hashPartitionKey(this.types[i], s)
+		if err != nil {
+			return -1, err
+		}
+		rowHash = pghash.HashCombine64(rowHash, h)
+	}
+	return pghash.MatchingHashBound(rowHash, this.modulus), nil
+}
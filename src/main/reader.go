@@ -5,30 +5,18 @@ package main
 // the reader start offset and end point, each reader can read the data in
 // parallel
 
-// #cgo CFLAGS: -g -Wall
-// #cgo LDFLAGS: -L./ -lhash
-// #include "hashfunc.h"
-import "C"
-
 import (
-	"os"
 	"io"
 	"sync"
 	"bytes"
-	"time"
-	"strconv"
-	"strings"
-)
-
-const (
-	PARTITION_FIELD_TYPE_INTEGER int = 0
-	PARTITION_FIELD_TYPE_NUMERIC int = 1
+	"context"
+	"fmt"
 )
 
 var (
-	Delim = ','
 	g_BasketTupleSize = 4 * 1024 * 1024 // bytes number M
 	g_DataQueueSize = 50
+	g_slabs = NewSlabPool()
 	crholder *ChunkRemainHolder = nil
 )
 
@@ -36,6 +24,7 @@ type ChunkRemainer struct {
 	index int
 	head string
 	tail string
+	boundary bool // false if no record end found in the chunk
 }
 
 
@@ -51,8 +40,8 @@ func NewChunkRemainHolder(count int) (*ChunkRemainHolder) {
 }
 
 
-func (this *ChunkRemainHolder) SetRemain(index int, head string, tail string) {
-	this.holders[index] = &ChunkRemainer{index, head, tail}
+func (this *ChunkRemainHolder) SetRemain(index int, head string, tail string, boundary bool) {
+	this.holders[index] = &ChunkRemainer{index, head, tail, boundary}
 }
 
 
@@ -67,12 +56,17 @@ func NewReader(
 	r.count = 0
 	r.index = i
 	r.rwg = rwg
-	r.baskets = make([]*TupleBasket, g_slice_num)
-	for i:=0; i<g_slice_num; i++ {
+	r.baskets = make([]*TupleBasket, len(nodedq))
+	for i:=0; i<len(nodedq); i++ {
 		r.baskets[i] = NewTupleBasket()
 	}
 	r.nodedq = nodedq
 	r.remainHolder = remainHolder
+	r.chunk = -1
+	r.ctx = context.Background()
+	r.fail = func(err error) {
+		logger.Error("reader[%d] %s", i, err.Error())
+	}
 	
 	return r
 }
@@ -87,40 +81,86 @@ type Reader struct {
 	rwg *sync.WaitGroup
 	remainHolder *ChunkRemainHolder
 	index int
-	partitionField int
-	partitionFieldType int
+	partitionKey *PartitionKey
+	reject *RejectFile
+	format Format // the format of the data files
+	output Format // the COPY format if the records are converted, or nil
+	binary *BinaryEncoder // nil if not in binary mode
+	ctx context.Context // the context of the job
+	fail func(error) // fail the job
+	path string // the file of the chunk or the block
+	checkpoint *Checkpoint // nil if the load is not checkpointed
+	chunk int // the chunk read with the checkpoint, or -1
+	skip []int64 // the bytes of the chunk committed on each node by the last run
+	start int64 // the offset of the tuple in the chunk
+	end int64 // the offset after the tuple
+	pos RowPosition // where the tuple is, for the reject file
 }
 
-func (this *Reader) setPartitionField(index int, partitionFieldType string) {
-	this.partitionField = index
-	if strings.ToLower(partitionFieldType) == "integer" {
-		this.partitionFieldType = PARTITION_FIELD_TYPE_INTEGER;
-	} else if (strings.ToLower(partitionFieldType) == "numeric") {
-		this.partitionFieldType = PARTITION_FIELD_TYPE_NUMERIC
-	} else {
-		logger.Error("reader: unsupport partition field type %s", partitionFieldType)
-		os.Exit(2);
-	}
+func (this *Reader) setPartitionKey(key *PartitionKey) {
+	this.partitionKey = key
+}
+
+func (this *Reader) setRejectFile(reject *RejectFile) {
+	this.reject = reject
+}
+
+func (this *Reader) setFormat(format Format) {
+	this.format = format
+}
+
+func (this *Reader) setOutputFormat(output Format) {
+	this.output = output
+}
+
+func (this *Reader) setContext(ctx context.Context) {
+	this.ctx = ctx
 }
 
-func (this *Reader) putTupleToBasket(nodeid int, data []byte) {
+// setFailure set the function to fail the job, the reader stops after it
+func (this *Reader) setFailure(fail func(error)) {
+	this.fail = fail
+}
+
+func (this *Reader) setBinaryEncoder(binary *BinaryEncoder) {
+	this.binary = binary
+}
+
+func (this *Reader) setCheckpoint(checkpoint *Checkpoint) {
+	this.checkpoint = checkpoint
+}
+
+// putTupleToBasket the basket is put to the queue of the node when the tuple
+// does not fit in it, it waits while the queue is full, an error is returned
+// if the job is cancelled
+func (this *Reader) putTupleToBasket(nodeid int, data []byte) error {
+	if this.skip != nil && this.end <= this.skip[nodeid] {
+		// the tuple is committed on the node by the last run
+		return nil
+	}
 	b := this.baskets[nodeid]
-	// actually need firstly look at the basket exist
+	if b.Len() > 0 && len(data) > b.Free() {
+		if err := this.putBasket(nodeid, this.start); err != nil {
+			return err
+		}
+		b = this.baskets[nodeid]
+	}
 	b.Write(data)
+	b.rows++
+	return nil
+}
 
-	// not exactly same size as the basket limitation
-	if b.Len() >= g_BasketTupleSize {
-		for {
-			if this.nodedq[nodeid].size() < g_DataQueueSize {
-				break
-			}
-			//logger.Info("too many basket unhandled(%d) ...", DataQueueSize)
-			time.Sleep(100*time.Millisecond)
-		}
-		this.nodedq[nodeid].putQ(b)
-		this.baskets[nodeid] = NewTupleBasket()
-		this.basketcount ++
+// putBasket put the basket of the node to the queue, all the rows of the
+// chunk before the offset for the node are in it or the ones before it
+func (this *Reader) putBasket(nodeid int, upto int64) error {
+	b := this.baskets[nodeid]
+	b.chunk, b.upto = this.chunk, upto
+	if err := this.nodedq[nodeid].putQ(this.ctx, b); err != nil {
+		return err
 	}
+	this.baskets[nodeid] = NewTupleBasket()
+	this.basketcount ++
+	return nil
 }
 
 
@@ -128,192 +168,257 @@ func (this *Reader) upLoadAllBasket() {
 	// in case the basket is not full, and send it to data queue
 	// usually called at the end of the read
 	logger.Info("upload all the basket for readers")
-	for i:=0; i<g_slice_num; i++ {
+	for i:=0; i<len(this.nodedq); i++ {
 		b := this.baskets[i]
-		this.nodedq[i].putQ(b)
+		if b.Len() == 0 {
+			continue
+		}
+		b.chunk, b.upto = this.chunk, this.end
+		if err := this.nodedq[i].putQ(this.ctx, b); err != nil {
+			b.release()
+			return
+		}
 	}
 }
 
 
-func (this *Reader) startReader(chunksizes []*Chunk, i int,	fd *os.File) {
-	go this.Run(chunksizes, i, fd)
+func (this *Reader) startReader(chunks chan *Chunk, blocks chan *Block) {
+	go this.Run(chunks, blocks)
 }
 
-// all the dirty
-func (this *Reader) Run(chunksizes []*Chunk, i int, fd *os.File) {
-	// also need to check the offset and file size
-	chunk := chunksizes[i]
-	// maybe we can just don't need to read much data at the first time
-	buffer := make([]byte, chunk.bufsize)
-	var head, tail string
-	var end = false
-	bytelen, err := fd.ReadAt(buffer, chunk.offset)
-	if err != nil {
-		if err == io.EOF {
-			// do nothing at this point
+// handleTuple route the tuple to the basket of the slice, false is returned
+// if the max tuple limit is reached, or the job fails or is cancelled
+func (this *Reader) handleTuple(tuple []byte) bool {
+	if !isSkipped(this.format, tuple) {
+		split, err := splitRecord(this.format, tuple)
+		size := -1
+		if err == nil {
+			size, err = this.partitionKey.Route(tuple, split)
+		}
+		if err == ErrNoPartition {
+			if err := this.reject.Write(tuple, this.pos, err.Error()); err != nil {
+				this.fail(&JobError{stage: "reject", path: this.path, err: err})
+				return false
+			}
+		} else if err != nil {
+			if err := this.reject.WriteBad("route", tuple, this.pos, err); err != nil {
+				this.fail(err)
+				return false
+			}
 		} else {
-			logger.Error("reader: fail to readat %d", chunk.offset)
-			logger.Fatal(err.Error())
+			data := tuple
+			if this.binary != nil {
+				data, err = this.binary.Encode(tuple, split)
+			} else if this.output != nil {
+				data, err = convertRecord(this.format, this.output, tuple, split)
+			}
+			if err != nil {
+				if err := this.reject.WriteBad("convert", tuple, this.pos, err); err != nil {
+					this.fail(err)
+					return false
+				}
+			} else if err := this.putTupleToBasket(size, data); err != nil {
+				logger.Debug("reader[%d] stopped, %s", this.index, err.Error())
+				return false
+			}
 		}
 	}
-	_ = end
-	_ = bytelen
-	pos := ReadSlice(buffer, '\n')
-	if pos < 0 {
-		logger.Error("bufsize too small, no newline found in first buffer read")
-		logger.Error("suggest larger the bufsize")
-		logger.Fatal("")
+	this.count++
+	if this.processMaxLineLimited != 0 && this.count >= this.processMaxLineLimited {
+		logger.Info("reader[%d] reach the max tuple limit %d", this.index, this.processMaxLineLimited)
+		return false
 	}
-	
-	head = string(buffer[:pos+1])
+	this.handlecount++
+	return true
+}
 
-	offset := chunk.offset + int64(pos) + 1
+// Run take the chunks and the blocks (nil if no file is read as a stream)
+// until both are closed, after the max tuple limit is reached (or the job
+// fails), the rest chunks are not read, and the blocks are drained, so the
+// stream readers are not blocked
+func (this *Reader) Run(chunks chan *Chunk, blocks chan *Block) {
+	limited := false
+	for chunks != nil || blocks != nil {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				chunks = nil
+			} else if !limited {
+				limited = !this.readChunk(chunk)
+			}
+		case block, ok := <-blocks:
+			if !ok {
+				blocks = nil
+			} else if !limited {
+				limited = !this.readBlock(block)
+			}
+		}
+	}
+	this.upLoadAllBasket()
+	this.rwg.Done()
+}
 
-	targetOffset := chunk.offset + chunk.chunksize
+// readChunk route the records of the chunk, false is returned if the max
+// tuple limit is reached or the job fails, all the dirty
+func (this *Reader) readChunk(chunk *Chunk) bool {
+	i := chunk.index
+	this.path = chunk.source.path
+	buffer := make([]byte, chunk.bufsize)
+	// the head is the data before the first record end, it is the rest of the
+	// record started in the previous chunk, the chunk start may be in the
+	// middle of a quoted field, so begin the scan with the state at the start
+	// of the chunk
+	var head = make([]byte, 0)
+	var tail string
+	var boundary = chunk.whole
+	var limited = false
+	var state = chunk.state
+	var consumed int64 // the offset of the buffer start in the chunk
+	var lines int64 // the newlines before the tuple in the chunk
+	var rows = this.count
+	var skipped int64 // the bytes committed on all nodes by the last run
+
+	this.chunk, this.skip = -1, nil
+	this.pos = RowPosition{path: this.path, chunk: i}
+	if this.checkpoint != nil {
+		skip, remain := this.checkpoint.skip(i)
+		if remain != nil {
+			logger.Info("reader[%d] chunk %d of %s is committed on all nodes", this.index, i, this.path)
+			this.remainHolder.SetRemain(i, remain.head, remain.tail, remain.boundary)
+			return true
+		}
+		this.chunk, this.skip = i, skip
+		skipped = skip[0]
+		for _, n := range skip {
+			if n < skipped {
+				skipped = n
+			}
+		}
+	}
+
+	r, err := chunk.open()
+	if err != nil {
+		this.fail(&JobError{stage: "read", path: this.path, err: fmt.Errorf("fail to open chunk %d, %s", i, err.Error())})
+		return false
+	}
+	defer r.Close()
 
-	var lastBuffer bool = false
-	_ = lastBuffer
 	remain := 0
-	var bufSlice []byte
+	scanned := 0
+	end := false
 
-	left := chunk.chunksize - int64(pos) - 1
-	
-	if left < int64(chunk.bufsize) {
-		bufSlice = buffer[:left]
-	} else {
-		bufSlice = buffer
-	}
-	
 mainloop:
-	for end != true {
-		bytesread, err := fd.ReadAt(bufSlice, offset)
-		if err != nil {
-			if err == io.EOF {
-				end = true
-			}
-			if bytesread == 0 {
-				break
-			}
+	for !end {
+		if remain == len(buffer) {
+			// the record is larger than the buffer, grow it
+			newbuf := make([]byte, len(buffer)*2)
+			copy(newbuf, buffer[:remain])
+			buffer = newbuf
+		}
+		bytesread, err := r.Read(buffer[remain:])
+		if err == io.EOF {
+			end = true
+		} else if err != nil {
+			this.fail(&JobError{stage: "read", path: this.path, err: fmt.Errorf("fail to read chunk %d, %s", i, err.Error())})
+			return false
 		}
-		
+		if bytesread == 0 {
+			continue
+		}
+
 		actualLen := bytesread + remain
 		start := 0
-		for {
-			l := ReadSlice(buffer[start:actualLen], '\n')
+		if !boundary {
+			l := this.format.FindRecordEnd(buffer[scanned:actualLen], &state)
 			if l < 0 {
-				break
-			}
-			
-			s := GetFieldByIndex(buffer[start:start+l+1], this.partitionField, l)
-			if len(s) == 0 {
-				logger.Error(string(buffer[start:start+l+1]))
-				logger.Fatal("fail to parse the field by index")
+				head = append(head, buffer[:actualLen]...)
+				lines += int64(bytes.Count(buffer[:actualLen], []byte{'\n'}))
+				consumed += int64(actualLen)
+				remain = 0
+				scanned = 0
+				continue
 			}
+			start = scanned + l + 1
+			head = append(head, buffer[:start]...)
+			lines += int64(bytes.Count(buffer[:start], []byte{'\n'}))
+			scanned = start
+			boundary = true
+		}
 
-			size := -1
-
-			if this.partitionFieldType == PARTITION_FIELD_TYPE_INTEGER {
-				
-				key, err := strconv.Atoi(string(s))
-				if err != nil {
-					logger.Fatal(err.Error())
-				}
-				mod := C.int(g_slice_num)
-				
-				size = int(C.get_matching_hash_bounds_int(C.int(key), mod))
-			} else if (this.partitionFieldType == PARTITION_FIELD_TYPE_NUMERIC) {
-				mod := C.int(g_slice_num)
-				size = int(C.get_matching_hash_bounds_numeric(C.CString(string(s)), mod))
+		for {
+			l := this.format.FindRecordEnd(buffer[scanned:actualLen], &state)
+			if l < 0 {
+				break
 			}
-			//logger.Info("reader: the key is %s,and target index is %d, mod is %d\n", string(s), size, g_slice_num)
-
-			this.putTupleToBasket(size, buffer[start:start+l+1])
-			this.count++
-			if this.processMaxLineLimited != 0 && this.count >= this.processMaxLineLimited {
-				logger.Info("reader[%d] reach the max tuple limit %d", i, this.processMaxLineLimited)
-				end = true
+			next := scanned + l + 1
+			this.start, this.end = consumed + int64(start), consumed + int64(next)
+			this.pos.offset, this.pos.line = this.start, lines
+			lines += int64(bytes.Count(buffer[start:next], []byte{'\n'}))
+			if this.end <= skipped {
+				// committed on all nodes
+			} else if !this.handleTuple(buffer[start:next]) {
+				remain = 0
+				limited = true
 				break mainloop
 			}
-			
-			start += l + 1
-			this.handlecount++
+			start = next
+			scanned = next
 		}
 
+		// keep the uncomplete record, it is already scanned
 		remain = actualLen - start
-		
-		p := start
-		for i:=0; i<remain; i++ {
-			buffer[i] = buffer[p]
-			p++
-		}
-		if lastBuffer == true {
-			tail = string(buffer[:remain])
-			break
+		copy(buffer, buffer[start:actualLen])
+		consumed += int64(start)
+		scanned = remain
+	}
+	tail = string(buffer[:remain])
+	this.remainHolder.SetRemain(i, string(head), tail, boundary)
+	if !limited {
+		// and the record joined by the tail
+		this.reject.Read(this.count - rows + 1, chunk.chunksize)
+	}
+	if this.checkpoint != nil && !limited {
+		// the baskets of the chunk are all sent, even the empty ones, so
+		// the chunk is committed to its end on every node
+		this.checkpoint.read(i, consumed, string(head), tail, boundary)
+		for n := range this.baskets {
+			if err := this.putBasket(n, consumed); err != nil {
+				return false
+			}
 		}
+	}
+	return !limited
+}
 
-		bufSlice = buffer[remain:]
-
-		offset += int64(bytesread)
-		if int64(offset) == targetOffset {
-			tail = string(buffer[:remain])
-			break
+// readBlock route the records of the block from the stream reader, the
+// block only has the whole records, so there is no head and tail
+func (this *Reader) readBlock(b *Block) bool {
+	block := b.data
+	this.path = b.path
+	this.chunk, this.skip = -1, nil
+	this.pos = RowPosition{path: b.path, chunk: -1}
+	lines := b.lines
+	state := FORMAT_STATE_START
+	start := 0
+	for start < len(block) {
+		l := this.format.FindRecordEnd(block[start:], &state)
+		if l < 0 {
+			// the rest of the last block shorter than a fixed length record,
+			// like the last newline
+			l = len(block) - start - 1
 		}
-		
-		if targetOffset - int64(offset) < int64(chunk.bufsize) {
-			lastBuffer = true
-			bufSlice = buffer[remain:int64(remain)+targetOffset-offset]
+		tuple := block[start:start+l+1]
+		this.pos.offset, this.pos.line = b.offset + int64(start), lines + 1
+		lines += int64(bytes.Count(tuple, []byte{'\n'}))
+		if !this.handleTuple(tuple) {
+			return false
 		}
+		start += l + 1
 	}
-	this.upLoadAllBasket()
-
-	this.remainHolder.SetRemain(i, head, tail)
-	this.rwg.Done()
+	return true
 }
 
 func ReadSlice(buffer []byte, delim byte) (pos int) {
 	// if i == -1, means not found the delim
 	return bytes.IndexByte(buffer, delim)
 }
-
-func GetFieldByIndex(c []byte, index int, max int) ([]byte) {
-	// currently max is not used
-
-	var r = make([]byte, 0)
-	for i:=0; i<index; i++ {
-		r = GetNextField(c, byte(Delim)) // actually here need to define a delim
-		c = c[len(r)+1:]
-	}
-	return r
-}
-
-// lengthNL reports the number of bytes for the trailing \n.
-func lengthNL(b []byte) int {
-	if len(b) > 0 && b[len(b)-1] == '\n' {
-		return 1
-	}
-	return 0
-}
-
-func GetNextField(c []byte, delim byte) ([]byte) {
-	var field = make([]byte, 0)
-	if c[0] != '"' {
-		i := bytes.IndexByte(c, delim)
-		field = c
-		if i >= 0 {
-			field = field[:i]
-		} else {
-			field = field[:len(field) - lengthNL(field)]
-		}
-	} else {
-		c = c[1:]
-		i := bytes.IndexByte(c, '"')
-		if i >= 0 {
-			field = c[:i]
-		} else {
-			// currently we only support oneline tuple, so we normally should
-			// find the paired sing
-			logger.Fatal("cannot find pair double mark")
-		}
-	}
-	return field
-}
@@ -0,0 +1,176 @@
+package main
+
+// the rows can not be loaded are written to the reject file of the table
+// instead of stopping the loading, the file is shared by all the readers of
+// a job, and only created when the first row is rejected. each row is after
+// a line of where it is and why it is rejected:
+//
+//   # data.csv:1234 offset 56789: route: invalid integer "abc"
+//   abc,name 1
+//
+// the rows of no partition are always rejected, the bad rows (the partition
+// key can not be parsed, too few fields, an unmatched quote, or the row can
+// not be converted) are rejected up to the max errors of the table, then the
+// job fails.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// RowPosition is where the row is in the data file, the offset is of the
+// decompressed data (-1 if it is not known, like the parquet rows), and the
+// line is from 1. the reader of a chunk only knows the offset and the
+// newlines before the row in the chunk (chunk >= 0), they are resolved to
+// the file by the locator of the job
+type RowPosition struct {
+	path string
+	chunk int
+	offset int64
+	line int64
+}
+
+func (this RowPosition) String() string {
+	var b strings.Builder
+	b.WriteString(this.path)
+	if this.line > 0 {
+		fmt.Fprintf(&b, ":%d", this.line)
+	}
+	if this.offset >= 0 {
+		fmt.Fprintf(&b, " offset %d", this.offset)
+	}
+	return b.String()
+}
+
+type RejectFile struct {
+	path string
+	fd *os.File
+	count int64
+	errors int64 // the bad rows
+	maxerrors int64 // the bad rows allowed, -1 is no limit
+	maxpercent float64 // the percent of the bad rows in all the rows, 0 is no limit
+	size int64 // the bytes of the data, -1 if it is not known
+	readrows int64 // the rows of the chunks read
+	readbytes int64 // the bytes of the chunks read
+	mux sync.Mutex
+	flag int // truncate or append the file
+	locate func(RowPosition) RowPosition
+}
+
+func NewRejectFile(path string) *RejectFile {
+	return &RejectFile{path: path, flag: os.O_TRUNC}
+}
+
+// SetMaxErrors set the bad rows allowed, -1 is no limit, the job fails on the
+// first bad row by default
+func (this *RejectFile) SetMaxErrors(n int64) {
+	this.maxerrors = n
+}
+
+// SetMaxErrorPercent set the max percent of the bad rows, and the bytes of
+// the data (-1 if it is not known), the rows not read are at most the bytes
+// not read, so the percent can be known to be passed before all the rows are
+// read
+func (this *RejectFile) SetMaxErrorPercent(percent float64, size int64) {
+	this.maxpercent = percent
+	this.size = size
+}
+
+// Read the rows and the bytes of a chunk are read
+func (this *RejectFile) Read(rows int64, size int64) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.readrows += rows
+	this.readbytes += size
+}
+
+// SetLocator set the function to resolve the position in the chunk to the
+// file
+func (this *RejectFile) SetLocator(locate func(RowPosition) RowPosition) {
+	this.locate = locate
+}
+
+// Append keep the rows rejected by the last run, for the resumed load
+func (this *RejectFile) Append() {
+	this.flag = os.O_APPEND
+}
+
+// Write append the raw tuple to the reject file after the line of its
+// position and the reason, the tuple should include the trailing newline
+func (this *RejectFile) Write(tuple []byte, pos RowPosition, reason string) error {
+	if pos.chunk >= 0 && this.locate != nil {
+		pos = this.locate(pos)
+	}
+	this.mux.Lock()
+	defer this.mux.Unlock()
+
+	if this.fd == nil {
+		fd, err := os.OpenFile(this.path, os.O_CREATE|os.O_WRONLY|this.flag, 0644)
+		if err != nil {
+			return fmt.Errorf("fail to create reject file %s, %s", this.path, err.Error())
+		}
+		this.fd = fd
+	}
+	reason = strings.ReplaceAll(reason, "\n", " ")
+	if _, err := fmt.Fprintf(this.fd, "# %s: %s\n", pos, reason); err != nil {
+		return fmt.Errorf("fail to write reject file %s, %s", this.path, err.Error())
+	}
+	if _, err := this.fd.Write(tuple); err != nil {
+		return fmt.Errorf("fail to write reject file %s, %s", this.path, err.Error())
+	}
+	if len(tuple) == 0 || tuple[len(tuple)-1] != '\n' {
+		this.fd.Write([]byte{'\n'})
+	}
+	this.count++
+	logger.Debug("reject row to %s: %s", this.path, reason)
+	return nil
+}
+
+// WriteBad write the bad row of the stage to the reject file, the error to
+// fail the job is returned if the bad rows are more than the max errors
+func (this *RejectFile) WriteBad(stage string, tuple []byte, pos RowPosition, err error) error {
+	if werr := this.Write(tuple, pos, stage + ": " + err.Error()); werr != nil {
+		return &JobError{stage: "reject", path: pos.path, err: werr}
+	}
+	this.mux.Lock()
+	this.errors++
+	n := this.errors
+	rows := this.readrows + this.size - this.readbytes
+	this.mux.Unlock()
+	if this.maxpercent > 0 && this.size >= 0 && float64(n) * 100 > this.maxpercent * float64(rows) {
+		err = fmt.Errorf("%s, %d bad rows, more than maxErrorPercent %g%% of at most %d rows", err.Error(),
+			n, this.maxpercent, rows)
+		return newRowError(stage, pos.path, tuple, err)
+	}
+	if this.maxerrors < 0 || n <= this.maxerrors {
+		return nil
+	}
+	if this.maxerrors > 0 {
+		err = fmt.Errorf("%s, %d bad rows, more than maxerrors %d", err.Error(), n, this.maxerrors)
+	}
+	return newRowError(stage, pos.path, tuple, err)
+}
+
+// Errors the bad rows rejected
+func (this *RejectFile) Errors() int64 {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return this.errors
+}
+
+func (this *RejectFile) Count() int64 {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return this.count
+}
+
+func (this *RejectFile) Close() {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if this.fd != nil {
+		this.fd.Close()
+		this.fd = nil
+	}
+}
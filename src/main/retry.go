@@ -0,0 +1,153 @@
+package main
+
+// the transient failures of the nodes are retried, like a node is
+// restarting or the connection is reset. the connection is retried with the
+// backoff, and when the copy of a batch fails, the sender reconnects and
+// replays the baskets of the batch in a new copy, so the go through
+// goroutine keeps the baskets until the batch is committed, the memory is
+// bounded by the batch size of the nodes (commitsize is 64 MB by default
+// then).
+//
+// the batch is a transaction, the xid is got before the commit, if the
+// connection is lost during the commit, the status of the xid is checked
+// after reconnecting, the batch is not replayed if it is committed.
+//
+// the errors of the data, like a bad row, are not retried.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+// the max wait between the retries
+const RETRY_MAX_WAIT = 60 * time.Second
+
+// the old connection is not closed on the node yet, the status of the
+// commit is checked again later
+var ErrCommitInProgress = errors.New("the commit is in progress")
+
+var (
+	g_retries = 0 // the retries of a connection or a batch
+	g_retrywait = time.Second // the wait before the first retry, doubled each time
+)
+
+// transient the error may pass by retrying
+func transient(err error) bool {
+	if errors.Is(err, ErrCommitInProgress) {
+		return true
+	}
+	var pgerr *pgconn.PgError
+	if errors.As(err, &pgerr) {
+		switch pgerr.Code[:2] {
+		case "08": // connection exception
+			return true
+		case "57": // operator intervention, like the node is shutting down
+			return pgerr.Code != "57014" // query canceled
+		case "53": // insufficient resources, like too many connections
+			return true
+		}
+		return pgerr.Code == "40001" || pgerr.Code == "40P01"
+	}
+	var neterr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &neterr) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// retryWait the wait before the retry
+func retryWait(attempt int) time.Duration {
+	wait := g_retrywait
+	for i := 1; i < attempt && wait < RETRY_MAX_WAIT; i++ {
+		wait *= 2
+	}
+	if wait > RETRY_MAX_WAIT {
+		wait = RETRY_MAX_WAIT
+	}
+	return wait
+}
+
+// sleep wait for the duration, false is returned if the context is done
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryTransient call the function until it returns no error, or the error
+// is not transient, or the retries are used up
+func retryTransient(ctx context.Context, what string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > g_retries || !transient(err) {
+			return err
+		}
+		wait := retryWait(attempt)
+		logger.Warn("%s failed, %s, retry %d of %d in %s", what, err.Error(), attempt, g_retries, wait)
+		if !sleep(ctx, wait) {
+			return err
+		}
+	}
+}
+
+// recover reconnect the sender after the batch fails, if the commit of the
+// batch is lost, it is checked by the xid, otherwise the baskets of the
+// batch are replayed in a new copy, and the batch is open again, true is
+// returned if the batch is committed. the retries are counted for the whole
+// batch, they are reset when it is committed
+func (this *Job) recover(s *Sender, baskets []*TupleBasket, cause error) (bool, error) {
+	if g_atomic {
+		// the copy is the whole table, the baskets are not kept
+		return false, cause
+	}
+	for {
+		if this.ctx.Err() != nil || s.retried >= g_retries || !(transient(cause) || s.db.IsClosed()) {
+			return false, cause
+		}
+		s.retried++
+		wait := retryWait(s.retried)
+		logger.Warn("%s batch failed on %s, %s, retry %d of %d in %s", this.displayName, s.dbi.address(),
+			cause.Error(), s.retried, g_retries, wait)
+		if !sleep(this.ctx, wait) {
+			return false, cause
+		}
+		if err := s.dial(); err != nil {
+			cause = &JobError{stage: "connect", node: s.dbi.address(), err: err}
+			continue
+		}
+		if s.xid != "" {
+			status, err := s.query("SELECT txid_status(" + s.xid + ")")
+			if err != nil {
+				cause = &JobError{stage: "commit", node: s.dbi.address(), err: err}
+				continue
+			} else if status == "in progress" {
+				cause = &JobError{stage: "commit", node: s.dbi.address(),
+					err: fmt.Errorf("xid %s, %w", s.xid, ErrCommitInProgress)}
+				continue
+			}
+			logger.Info("%s the lost commit of xid %s on %s is %s", this.displayName, s.xid, s.dbi.address(),
+				status)
+			s.xid = ""
+			if status == "committed" {
+				return true, nil
+			}
+		}
+		if err := s.replay(baskets); err != nil {
+			cause = &JobError{stage: "copy", node: s.dbi.address(), err: err}
+			continue
+		}
+		logger.Info("%s %d baskets replayed on %s", this.displayName, len(baskets), s.dbi.address())
+		return false, nil
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+func TestTransient(t *testing.T) {
+	cases := []struct {
+		err error
+		transient bool
+	}{
+		// the connection exceptions
+		{&pgconn.PgError{Code: "08000"}, true},
+		{&pgconn.PgError{Code: "08006"}, true},
+		{&pgconn.PgError{Code: "08P01"}, true},
+		// the node is shutting down or restarting, but not the canceled query
+		{&pgconn.PgError{Code: "57P01"}, true},
+		{&pgconn.PgError{Code: "57P03"}, true},
+		{&pgconn.PgError{Code: "57014"}, false},
+		// too many connections, out of memory or disk
+		{&pgconn.PgError{Code: "53300"}, true},
+		{&pgconn.PgError{Code: "53100"}, true},
+		// the serialization failure and the deadlock
+		{&pgconn.PgError{Code: "40001"}, true},
+		{&pgconn.PgError{Code: "40P01"}, true},
+		{&pgconn.PgError{Code: "40002"}, false},
+		// the errors of the data are not retried
+		{&pgconn.PgError{Code: "22P02"}, false},
+		{&pgconn.PgError{Code: "23505"}, false},
+		{&pgconn.PgError{Code: "42P01"}, false},
+		{&pgconn.PgError{Code: "XX000"}, false},
+
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("i/o timeout")}, true},
+		{&os.SyscallError{Syscall: "write", Err: syscall.EPIPE}, true},
+		{syscall.ECONNRESET, true},
+		{syscall.ECONNREFUSED, true},
+		{ErrCommitInProgress, true},
+		{errors.New("invalid input syntax"), false},
+		{ErrNoPartition, false},
+
+		// the wrapped errors are classified by the cause
+		{&JobError{stage: "copy", node: "h:5432", err: &pgconn.PgError{Code: "57P01"}}, true},
+		{&JobError{stage: "copy", node: "h:5432", err: &pgconn.PgError{Code: "22P02"}}, false},
+		{&JobError{stage: "commit", err: fmt.Errorf("xid 100, %w", ErrCommitInProgress)}, true},
+		{fmt.Errorf("copy, %w", io.ErrUnexpectedEOF), true},
+	}
+	for _, c := range cases {
+		if got := transient(c.err); got != c.transient {
+			t.Errorf("transient(%#v) = %v, want %v", c.err, got, c.transient)
+		}
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	saved := g_retrywait
+	defer func() { g_retrywait = saved }()
+
+	cases := []struct {
+		first time.Duration
+		attempt int
+		wait time.Duration
+	}{
+		{time.Second, 1, time.Second},
+		{time.Second, 2, 2 * time.Second},
+		{time.Second, 3, 4 * time.Second},
+		{time.Second, 6, 32 * time.Second},
+		// doubled up to the max wait
+		{time.Second, 7, RETRY_MAX_WAIT},
+		{time.Second, 1000, RETRY_MAX_WAIT},
+		{100 * time.Millisecond, 4, 800 * time.Millisecond},
+		{2 * RETRY_MAX_WAIT, 1, RETRY_MAX_WAIT},
+	}
+	for _, c := range cases {
+		g_retrywait = c.first
+		if wait := retryWait(c.attempt); wait != c.wait {
+			t.Errorf("retryWait(%d) of the first wait %s = %s, want %s", c.attempt, c.first, wait, c.wait)
+		}
+	}
+
+	// the wait never decreases, and never exceeds the max wait
+	g_retrywait = 3 * time.Second
+	last := time.Duration(0)
+	for attempt := 1; attempt < 100; attempt++ {
+		wait := retryWait(attempt)
+		if wait < last || wait > RETRY_MAX_WAIT {
+			t.Fatalf("retryWait(%d) = %s after %s", attempt, wait, last)
+		}
+		last = wait
+	}
+}
+
+func TestRetryTransient(t *testing.T) {
+	saved := []interface{}{g_retries, g_retrywait}
+	defer func() { g_retries, g_retrywait = saved[0].(int), saved[1].(time.Duration) }()
+	g_retries, g_retrywait = 3, time.Millisecond
+
+	cases := []struct {
+		name string
+		errs []error // the errors of the calls, nil after them
+		calls int
+		err error
+	}{
+		{"ok", nil, 1, nil},
+		{"passed", []error{io.EOF, &pgconn.PgError{Code: "08006"}}, 3, nil},
+		{"used up", []error{io.EOF, io.EOF, io.EOF, io.EOF, io.EOF}, 4, io.EOF},
+		{"not transient", []error{ErrNoPartition}, 1, ErrNoPartition},
+		{"not transient later", []error{io.EOF, ErrNoPartition}, 2, ErrNoPartition},
+	}
+	for _, c := range cases {
+		calls := 0
+		err := retryTransient(context.Background(), c.name, func() error {
+			calls++
+			if calls <= len(c.errs) {
+				return c.errs[calls-1]
+			}
+			return nil
+		})
+		if calls != c.calls || err != c.err {
+			t.Errorf("%s: %d calls, %v, want %d calls, %v", c.name, calls, err, c.calls, c.err)
+		}
+	}
+
+	// the wait is stopped by the context
+	g_retrywait = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err := retryTransient(ctx, "canceled", func() error {
+		calls++
+		return io.EOF
+	})
+	if calls != 1 || err != io.EOF {
+		t.Errorf("canceled: %d calls, %v", calls, err)
+	}
+}
@@ -9,16 +9,28 @@ import (
 	"io"
 	"time"
 	"bytes"
+	"loadconfig"
+	"strconv"
 )
 
 
 type TableInfo struct {
 	name string
 	columns []string
-	datapath string
-	partitionFieldType string
-	partitionField int
+	datapath []string // the data files, the globs and directories are expanded
+	partitionFieldType []string
+	partitionField []int
+	partitionStrategy string
+	partitions []loadconfig.Partition
 	schema string
+	rejectpath string
+	maxerrors int64 // the bad rows allowed, -1 is no limit
+	maxerrorpercent float64 // 0 is no limit
+	target string // the template of the partition name on the node
+	format Format // the COPY format
+	input Format // the format of the data files, the same as format except ndjson
+	binary bool // send the rows in the binary copy format
+	dbinfos []DBInfo // the slices of the table, index by the remainder
 }
 
 type DBInfo struct {
@@ -29,6 +41,7 @@ type DBInfo struct {
 	password string
 	remainder int
 	schema string
+	tablename string // the table on the node, empty means the same as the table
 }
 
 func (this DBInfo) MakeConnectionString() (string) {
@@ -37,17 +50,37 @@ func (this DBInfo) MakeConnectionString() (string) {
 		this.host, this.port, this.user, this.password, this.dbname)
 }
 
+// address the node of the slice, for the messages
+func (this DBInfo) address() string {
+	return fmt.Sprintf("%s:%d", this.host, this.port)
+}
+
+// the schema and name of the table the slice data copied into on the node
+func (this DBInfo) targetSchema(tinfo *TableInfo) string {
+	if len(this.schema) > 0 {
+		return this.schema
+	}
+	return tinfo.schema
+}
+
+func (this DBInfo) targetTable(tinfo *TableInfo) string {
+	if len(this.tablename) > 0 {
+		return this.tablename
+	}
+	return tinfo.name
+}
+
 type Sender struct {
 	dbi *DBInfo
 	index int
-	c chan []byte
-	shutdown chan int
+	shutdown chan struct{} // closed by the job after the two phase commit
 	tablename string
 	fields []string
 	schema string
+	format Format
+	binary bool
 
 	db *pgconn.PgConn
-	count int
 	wg *sync.WaitGroup
 	buffer []byte
 	r *io.PipeReader
@@ -56,6 +89,23 @@ type Sender struct {
 	name string
 
 	remainder int
+	ctx context.Context // the context of the job
+	atomic bool // the copy is in a transaction, see twophase.go
+	copyEnd chan struct{} // closed when the copy returns
+	committed bool // the copy is done, or the prepared transaction is committed
+	txn bool // each batch is a transaction committed by the job, see checkpoint.go
+	copysql string
+	batches chan *io.PipeReader // the pipe of each copy, closed after the last one
+	copied chan error // the result of each copy
+	batchrows int64 // end the copy after the rows, 0 is no limit
+	batchsize int64 // end the copy after the bytes, 0 is no limit
+	rows int64 // the rows of the copy
+	bytes int64 // the bytes of the copy
+	batchcount int // the copies committed
+	totalrows int64 // the rows committed
+	totalbytes int64
+	xid string // the transaction being committed, checked if the commit is lost
+	retried int // the retries of the batch, see retry.go
 }
 
 func (this *Sender) SetTable(schema string, name string, columns ... string) {
@@ -64,35 +114,76 @@ func (this *Sender) SetTable(schema string, name string, columns ... string) {
 	this.fields = append(this.fields, columns...)
 }
 
+func (this *Sender) SetFormat(format Format) {
+	this.format = format
+}
+
+func (this *Sender) SetBinary(binary bool) {
+	this.binary = binary
+}
+
+func (this *Sender) SetContext(ctx context.Context) {
+	this.ctx = ctx
+}
+
+func (this *Sender) SetAtomic(atomic bool) {
+	this.atomic = atomic
+}
+
+func (this *Sender) SetTransaction(txn bool) {
+	this.txn = txn
+}
+
+// SetBatch end the copy and start a new one every rows or bytes, 0 is no
+// limit, the copy is only ended between the baskets
+func (this *Sender) SetBatch(rows int64, size int64) {
+	this.batchrows = rows
+	this.batchsize = size
+}
+
+// ColumnTypes get the type names of the table columns on the node, index by
+// the column name, the names are cast to regclass as they are configured, so
+// they are case folded the same as in the copy statement
+func (this *Sender) ColumnTypes() (map[string]string, error) {
+	relname := this.schema + "." + this.tablename
+	result := this.db.ExecParams(context.Background(), SQL_COLUMN_TYPES,
+		[][]byte{[]byte(relname)}, nil, nil, nil).Read()
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	types := make(map[string]string)
+	for _, row := range result.Rows {
+		types[string(row[0])] = string(row[1])
+	}
+	return types, nil
+}
+
 
 // this function will hang until the copy function call finish, so it should
-// be run in a goroutine
+// be run in a goroutine, the data can be copied in batches, each batch is a
+// copy of its own pipe, see begin and end
 func (this *Sender) Run() {
 	logger.Debug("%s run enter", this.name)
 	
 	// ctx, _ := context.WithTimeout(context.Background(), 1000*time.Second)
         ctx := context.Background();
 
-	_, err := this.db.CopyFrom(ctx, this.r,
-		CopyIn(this.remainder, this.schema, this.tablename, this.fields...))
-	if err != nil {
-		logger.Fatal(err.Error())
-	}
-
-	logger.Info("%s data has been copied", this.name)
-
-	// actually, the copy function call will return only when the copy work
-	// is done (receive a EOF sign), and then going to monitor the shutdown
-	// chan, so if when a goroutine send data to shutdown chan, it will not
-	// break, until the copy finish, and this is desiered purpose.
-loop:
-	for {
-		select {
-		case s := <-this.c:
-			this.Send(s)
-		case <-this.shutdown:
-			break loop
+	// the error of the copy is handled by the go through goroutine, the
+	// batch may be retried
+	for r := range this.batches {
+		_, err := this.db.CopyFrom(ctx, r, this.copysql)
+		if err != nil {
+			// the go through goroutine may be blocked on the pipe
+			r.CloseWithError(err)
 		}
+		this.copied <- err
+	}
+	close(this.copyEnd)
+
+	// the transaction of the atomic copy is prepared and committed on this
+	// connection by the job after the copies on all nodes end
+	if this.atomic {
+		<-this.shutdown
 	}
 	this.FinishWork()
 	logger.Info("sender work done for [%d]", this.index)
@@ -108,35 +199,159 @@ func (this *Sender) FinishWork() {
 	}
 }
 
-// setup database connection
-func (this *Sender) PrepareCopyTransaction() {
+// setup database connection, the transient errors are retried
+func (this *Sender) PrepareCopyTransaction() error {
 	connstr := this.dbi.MakeConnectionString()
 	logger.Info("going to connect %s", connstr)
-	db, err := pgconn.Connect(context.Background(), connstr)
+	err := retryTransient(this.ctx, "connect " + this.dbi.address(), this.dial)
+	if err != nil {
+		return err
+	}
+	if this.atomic {
+		return this.exec("BEGIN")
+	}
+	return nil
+}
+
+// dial connect to the node, the old connection is closed
+func (this *Sender) dial() error {
+	if this.db != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
+		this.db.Close(ctx)
+		cancel()
+	}
+	db, err := pgconn.Connect(context.Background(), this.dbi.MakeConnectionString())
 	if err != nil {
-		logger.Fatal(err.Error())
+		return err
 	}
 	this.db = db
+	return nil
+}
+
+// exec run the statement on the node, it is only called when the copy is
+// not running
+func (this *Sender) exec(sql string) error {
+	logger.Debug("%s %s", this.name, sql)
+	_, err := this.db.Exec(context.Background(), sql).ReadAll()
+	return err
 }
 
 
-func (this *Sender) Send(s []byte) {
-	_, err := this.w.Write(s)
+// query run the query on the node, the first value is returned
+func (this *Sender) query(sql string) (string, error) {
+	results, err := this.db.Exec(context.Background(), sql).ReadAll()
 	if err != nil {
-		logger.Fatal(err.Error())
+		return "", err
 	}
-	this.count++
+	if len(results) == 0 || len(results[0].Rows) == 0 {
+		return "", fmt.Errorf("no result of %s", sql)
+	}
+	return string(results[0].Rows[0][0]), nil
+}
+
+// begin start the copy of a batch, the data is written to the pipe until the
+// batch ends
+func (this *Sender) begin() error {
+	if this.txn {
+		if err := this.exec("BEGIN"); err != nil {
+			return err
+		}
+	}
+	this.rows, this.bytes = 0, 0
+	this.r, this.w = io.Pipe()
+	this.batches <- this.r
+	if this.binary {
+		// the error is returned by the next write or the end
+		this.w.Write(BinaryCopyHeader)
+	}
+	return nil
+}
+
+// write the basket to the copy of the batch
+func (this *Sender) write(b *TupleBasket) error {
+	if _, err := this.w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	this.rows += int64(b.rows)
+	this.bytes += int64(b.Len())
+	return nil
+}
+
+// full the batch has the rows or bytes, the copy should be ended
+func (this *Sender) full() bool {
+	return (this.batchrows > 0 && this.rows >= this.batchrows) ||
+		(this.batchsize > 0 && this.bytes >= this.batchsize)
+}
+
+// done the batch is committed
+func (this *Sender) done() {
+	this.batchcount++
+	this.totalrows += this.rows
+	this.totalbytes += this.bytes
+	this.rows, this.bytes = 0, 0
+	this.retried = 0
+}
+
+// end finish the copy of the batch, the error of the copy is returned
+func (this *Sender) end() error {
+	if this.binary {
+		this.w.Write(BinaryCopyTrailer)
+	}
+	this.w.Close()
+	return <-this.copied
+}
+
+// abort the copy of the batch, the copy reads the error, and sends CopyFail
+// to the node, the rows of the batch are rolled back, the error of the copy
+// is returned
+func (this *Sender) abort(err error) error {
+	this.w.CloseWithError(err)
+	return <-this.copied
+}
+
+// replay the baskets of the batch in a new copy
+func (this *Sender) replay(baskets []*TupleBasket) error {
+	if err := this.begin(); err != nil {
+		return err
+	}
+	for _, b := range baskets {
+		if err := this.write(b); err != nil {
+			return this.abort(err)
+		}
+	}
+	return nil
+}
+
+// commit the transaction of the batch, the prepare is called with the xid
+// before the commit, the xid is kept if the commit fails
+func (this *Sender) commit(prepare func(xid string) error) error {
+	xid, err := this.query("SELECT txid_current()")
+	if err != nil {
+		return err
+	}
+	if prepare != nil {
+		if err := prepare(xid); err != nil {
+			return err
+		}
+	}
+	this.xid = xid
+	if err := this.exec("COMMIT"); err != nil {
+		return err
+	}
+	this.xid = ""
+	return nil
 }
 
 
 func (this *Sender) StartBackend(wg *sync.WaitGroup) {
 	logger.Debug("sender backend start")
-	this.c = make(chan []byte)
-	this.shutdown = make(chan int)
+	this.shutdown = make(chan struct{})
+	this.copyEnd = make(chan struct{})
+	this.batches = make(chan *io.PipeReader)
+	this.copied = make(chan error, 1)
+	this.copysql = CopyIn(this.remainder, this.format, this.binary, this.schema, this.tablename, this.fields...)
 	this.wg = wg
 	this.wg.Add(1)
-	this.buffer = append(this.buffer, 'd', 0, 0, 0, 0) // for binary copy only
-	this.r, this.w = io.Pipe()
 	go this.Run()
 }
 
@@ -148,11 +363,26 @@ func NewSender(dbi *DBInfo, index int) (*Sender) {
 		remainder: dbi.remainder,
 		//buffer:  make([]byte, 0, ciBufferSize),
 		name: fmt.Sprintf("Sender-%d", index),
+		ctx: context.Background(),
 	}
 }
 
+// makeTargetName make the schema and name of the partition table of the
+// remainder by the template, {schema}, {table} and {remainder} in the template
+// are replaced, if there is no schema part, the table schema is used
+func makeTargetName(template string, schema string, table string, remainder int) (string, string) {
+	name := strings.NewReplacer(
+		"{schema}", schema,
+		"{table}", table,
+		"{remainder}", strconv.Itoa(remainder)).Replace(template)
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return schema, name
+}
+
 // setup the copyin comamnd
-func CopyIn(remainder int, schema string, table string, columns...string) string {
+func CopyIn(remainder int, format Format, binary bool, schema string, table string, columns...string) string {
 	statement := fmt.Sprintf("copy %s.%s (", schema, table)
 	for i, col := range columns {
 		if i != 0 {
@@ -160,15 +390,17 @@ func CopyIn(remainder int, schema string, table string, columns...string) string
 		}
 		statement += col
 	}
-	statement += ") FROM STDIN WITH CSV"
-	if g_has_csv_header {
-		statement += " header"
+	if binary {
+		statement += ") FROM STDIN WITH (FORMAT binary)"
+		logger.Info("remainder %d: %s", remainder, statement)
+		return statement
 	}
+	statement += ") FROM STDIN WITH (" + format.CopyOptions()
 	if len(g_encoding) > 0 {
-		statement += " encoding '" + g_encoding + "'"
+		statement += ", ENCODING " + QuoteLiteral(g_encoding)
 	}
-	statement += " NULL AS 'NULL'"
-	logger.Info(statement)
+	statement += ")"
+	logger.Info("remainder %d: %s", remainder, statement)
 	return statement
 }
 
@@ -179,3 +411,13 @@ func QuoteIdentifier(name string) string {
 	}
 	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
 }
+
+// QuoteLiteral quote the string constant, the escape string syntax is used
+// if there is a backslash
+func QuoteLiteral(s string) string {
+	s = strings.Replace(s, `'`, `''`, -1)
+	if strings.IndexByte(s, '\\') >= 0 {
+		return `E'` + strings.Replace(s, `\`, `\\`, -1) + `'`
+	}
+	return `'` + s + `'`
+}
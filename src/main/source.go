@@ -0,0 +1,482 @@
+package main
+
+// the data source of a table, a plain file or a compressed file, the
+// compression is detected by the magic bytes or the file extension, and
+// decompressed as a stream, no temporary file is needed.
+//
+// the datapath "-" is stdin, and a named pipe (fifo) or any other file which
+// is not a regular file is read as a stream too, no size or ReadAt is needed.
+//
+// the plain file is split to the chunks by the byte offset, the compressed
+// file can only be split at the boundary of the unit which can be
+// decompressed alone:
+//   zstd:  the frames (pzstd, or zstd with multiple frames)
+//   gzip:  the members of the bgzf (bgzip) blocked gzip
+//   bzip2: the blocks, found by the block magic at any bit position
+// then a chunk is a run of the whole units, and the readers decompress their
+// chunks in parallel. otherwise (single gzip or zstd stream, xz, or a stream
+// source) the file is not splittable, one decompressor feeds the records to the readers, see
+// StreamReader.
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"fmt"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	COMPRESSION_NONE int = iota
+	COMPRESSION_GZIP
+	COMPRESSION_ZSTD
+	COMPRESSION_BZIP2
+	COMPRESSION_XZ
+)
+
+var compressionNames = []string{"none", "gzip", "zstd", "bzip2", "xz"}
+
+// Segment is a unit of the compressed file which can be decompressed alone,
+// offset and size are in bytes, except for bzip2 they are in bits
+type Segment struct {
+	offset int64
+	size int64
+	crc uint32 // bzip2 block crc
+}
+
+type DataSource struct {
+	path string
+	fd *os.File
+	size int64
+	compression int
+	segments []*Segment // nil if the compressed file is not splittable
+	stream *bufio.Reader // the stdin or fifo, read only once from the start
+	parquet *ParquetSource // the chunks are the row groups
+}
+
+// expandDatapath get the data files of the table, the glob is matched and
+// the directory is listed (not recursive, the hidden and .reject files are
+// skipped), both sorted by the name, stdin can not be listed with the files
+func expandDatapath(paths []string) ([]string, error) {
+	files := make([]string, 0)
+	for _, p := range paths {
+		if p == "-" {
+			if len(paths) > 1 {
+				return nil, fmt.Errorf("stdin \"-\" can not be listed with the other data files")
+			}
+			files = append(files, p)
+			continue
+		}
+		if strings.ContainsAny(p, "*?[") {
+			matches, err := filepath.Glob(p)
+			if err != nil {
+				return nil, err
+			}
+			n := len(files)
+			sort.Strings(matches)
+			for _, m := range matches {
+				if f, err := os.Stat(m); err == nil && !f.IsDir() {
+					files = append(files, m)
+				}
+			}
+			if len(files) == n {
+				return nil, fmt.Errorf("no data file matches %s", p)
+			}
+			continue
+		}
+		f, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !f.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		entries, err := ioutil.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		n := len(files)
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") || strings.HasSuffix(e.Name(), ".reject") {
+				continue
+			}
+			files = append(files, filepath.Join(p, e.Name()))
+		}
+		if len(files) == n {
+			return nil, fmt.Errorf("no data file in the directory %s", p)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no datapath")
+	}
+	return files, nil
+}
+
+// detectCompression check the magic bytes first, then the file extension
+func detectCompression(path string, magic []byte) (int, error) {
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return COMPRESSION_GZIP, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return COMPRESSION_ZSTD, nil
+	case len(magic) >= 4 && magic[0] & 0xf0 == 0x50 && bytes.Equal(magic[1:4], []byte{0x2a, 0x4d, 0x18}):
+		// zstd skippable frame, pzstd writes one before each frame
+		return COMPRESSION_ZSTD, nil
+	case len(magic) >= 4 && bytes.HasPrefix(magic, []byte("BZh")) && magic[3] >= '1' && magic[3] <= '9':
+		return COMPRESSION_BZIP2, nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return COMPRESSION_XZ, nil
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	for c, exts := range map[int][]string{
+		COMPRESSION_GZIP: {".gz", ".gzip", ".bgz"},
+		COMPRESSION_ZSTD: {".zst", ".zstd"},
+		COMPRESSION_BZIP2: {".bz2", ".bzip2"},
+		COMPRESSION_XZ: {".xz"},
+	} {
+		for _, e := range exts {
+			if ext == e && len(magic) > 0 {
+				return -1, fmt.Errorf("%s is not a valid %s file", path, compressionNames[c])
+			}
+		}
+	}
+	return COMPRESSION_NONE, nil
+}
+
+func OpenDataSource(path string) (*DataSource, error) {
+	if path == "-" {
+		return openStreamSource(path, os.Stdin)
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if !f.Mode().IsRegular() {
+		return openStreamSource(path, fd)
+	}
+	s := &DataSource{path: path, fd: fd, size: f.Size()}
+
+	magic := make([]byte, 6)
+	n, err := fd.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		fd.Close()
+		return nil, err
+	}
+	if isParquetFile(fd, s.size, magic[:n]) {
+		if s.parquet, err = openParquet(fd, s.size); err != nil {
+			fd.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+	s.compression, err = detectCompression(path, magic[:n])
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	switch s.compression {
+	case COMPRESSION_GZIP:
+		s.segments, err = findBgzfBlocks(fd, s.size)
+	case COMPRESSION_ZSTD:
+		s.segments, err = findZstdFrames(fd, s.size)
+	case COMPRESSION_BZIP2:
+		s.segments, err = findBzip2Blocks(fd, s.size)
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if len(s.segments) < 2 {
+		s.segments = nil
+	}
+	return s, nil
+}
+
+// openStreamSource the magic bytes are peeked from the stream, the size is
+// unknown, so it is 0
+func openStreamSource(path string, fd *os.File) (*DataSource, error) {
+	s := &DataSource{path: path, fd: fd, stream: bufio.NewReaderSize(fd, 1024*1024)}
+	magic, err := s.stream.Peek(6)
+	if err != nil && err != io.EOF {
+		s.Close()
+		return nil, err
+	}
+	if len(magic) >= 4 && string(magic[:4]) == PARQUET_MAGIC {
+		s.Close()
+		return nil, fmt.Errorf("the parquet file can not be read from %s, it is not seekable", path)
+	}
+	s.compression, err = detectCompression(path, magic)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (this *DataSource) Close() {
+	if this.fd != os.Stdin {
+		this.fd.Close()
+	}
+}
+
+// Splittable is true if the file can be read by the chunks in parallel
+func (this *DataSource) Splittable() bool {
+	if this.stream != nil {
+		return false
+	}
+	return this.compression == COMPRESSION_NONE || this.segments != nil || this.parquet != nil
+}
+
+func (this *DataSource) String() string {
+	name := this.path
+	if this.path == "-" {
+		name = "stdin"
+	}
+	if this.stream != nil {
+		if this.compression == COMPRESSION_NONE {
+			return name + " (stream)"
+		}
+		return fmt.Sprintf("%s (stream, %s)", name, compressionNames[this.compression])
+	}
+	if this.parquet != nil {
+		return fmt.Sprintf("%s (parquet, %d row groups)", this.path, len(this.parquet.file.RowGroups()))
+	}
+	if this.compression == COMPRESSION_NONE {
+		return this.path
+	}
+	if this.segments != nil {
+		return fmt.Sprintf("%s (%s, %d blocks)", this.path, compressionNames[this.compression],
+			len(this.segments))
+	}
+	return fmt.Sprintf("%s (%s, not splittable)", this.path, compressionNames[this.compression])
+}
+
+// MakeChunks split the file to n chunks, the plain file is split by the
+// byte offset, the compressed file is split by the segments, the chunks are
+// about the same compressed size, some of them may be empty
+func (this *DataSource) MakeChunks(n int, bufsize int) []*Chunk {
+	if this.parquet != nil {
+		return this.parquet.MakeChunks(this, bufsize)
+	}
+	chunks := make([]*Chunk, 0)
+	if this.compression == COMPRESSION_NONE {
+		chunksize := ((this.size-1) / int64(n)) + 1
+		left := this.size
+		for i := 0; i < n; i++ {
+			chunk := &Chunk{source: this, bufsize: bufsize}
+			if left > chunksize {
+				chunk.chunksize = chunksize
+			} else if left > 0 {
+				chunk.chunksize = left
+			}
+			left -= chunksize
+			chunk.offset = chunksize * int64(i)
+			chunks = append(chunks, chunk)
+		}
+		return chunks
+	}
+
+	var total int64
+	for _, seg := range this.segments {
+		total += seg.size
+	}
+	next := 0
+	var done int64
+	for i := 0; i < n; i++ {
+		chunk := &Chunk{source: this, bufsize: bufsize}
+		target := total * int64(i+1) / int64(n)
+		for next < len(this.segments) && (done < target || i == n-1) {
+			seg := this.segments[next]
+			if len(chunk.segments) == 0 {
+				chunk.offset = seg.offset
+			}
+			chunk.segments = append(chunk.segments, seg)
+			chunk.chunksize += seg.size
+			done += seg.size
+			next++
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// MakeRecordChunks split the file of the fixed length records to n chunks at
+// the record boundaries, the chunks have the whole records, the offset of a
+// record in the compressed file is not known, so it is one chunk
+func (this *DataSource) MakeRecordChunks(n int, bufsize int, length int64) []*Chunk {
+	if this.parquet != nil {
+		return this.parquet.MakeChunks(this, bufsize)
+	}
+	if this.compression != COMPRESSION_NONE {
+		chunks := this.MakeChunks(1, bufsize)
+		chunks[0].whole = true
+		return chunks
+	}
+	records := (this.size-1) / length + 1
+	chunksize := ((records-1) / int64(n) + 1) * length
+	chunks := make([]*Chunk, 0)
+	for offset := int64(0); offset < this.size; offset += chunksize {
+		chunk := &Chunk{source: this, bufsize: bufsize, offset: offset, chunksize: chunksize, whole: true}
+		if offset+chunksize > this.size {
+			chunk.chunksize = this.size - offset
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// Open get the decompressed stream of the whole file, the stream source can
+// only be opened once
+func (this *DataSource) Open() (io.ReadCloser, error) {
+	if this.stream != nil {
+		return decompressReader(this.compression, this.stream)
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(this.fd, 0, this.size), 1024*1024)
+	return decompressReader(this.compression, r)
+}
+
+// openChunk get the decompressed stream of the chunk
+func (this *DataSource) openChunk(chunk *Chunk) (io.ReadCloser, error) {
+	if this.parquet != nil {
+		return this.parquet.openRowGroup(chunk.rowGroup), nil
+	}
+	if chunk.chunksize <= 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if this.compression == COMPRESSION_BZIP2 {
+		return ioutil.NopCloser(bzip2.NewReader(newBzip2BlockReader(this.fd, chunk.segments))), nil
+	}
+	r := io.NewSectionReader(this.fd, chunk.offset, chunk.chunksize)
+	if this.compression == COMPRESSION_NONE {
+		return ioutil.NopCloser(r), nil
+	}
+	return decompressReader(this.compression, bufio.NewReaderSize(r, 1024*1024))
+}
+
+func decompressReader(compression int, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case COMPRESSION_GZIP:
+		return gzip.NewReader(r)
+	case COMPRESSION_ZSTD:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case COMPRESSION_BZIP2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case COMPRESSION_XZ:
+		x, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(x), nil
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// findBgzfBlocks get the members of the bgzf file, each member has the "BC"
+// extra field with the member size, nil if it is not a bgzf file
+func findBgzfBlocks(fd *os.File, size int64) ([]*Segment, error) {
+	segments := make([]*Segment, 0)
+	header := make([]byte, 18)
+	var offset int64
+	for offset < size {
+		if _, err := fd.ReadAt(header, offset); err != nil {
+			return nil, nil
+		}
+		// ID1 ID2 CM FLG(FEXTRA) MTIME(4) XFL OS XLEN(2) SI1 SI2 SLEN(2) BSIZE(2)
+		if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 || header[3] & 4 == 0 ||
+			header[12] != 'B' || header[13] != 'C' || binary.LittleEndian.Uint16(header[14:]) != 2 {
+			return nil, nil
+		}
+		bsize := int64(binary.LittleEndian.Uint16(header[16:])) + 1
+		segments = append(segments, &Segment{offset: offset, size: bsize})
+		offset += bsize
+	}
+	return segments, nil
+}
+
+// findZstdFrames get the frames of the zstd file by walking the frame and
+// block headers, the skippable frames are joined to the next frame
+func findZstdFrames(fd *os.File, size int64) ([]*Segment, error) {
+	segments := make([]*Segment, 0)
+	buf := make([]byte, 18)
+	var offset, start int64
+	for offset < size {
+		n, _ := fd.ReadAt(buf, offset)
+		if n < 8 {
+			return nil, fmt.Errorf("truncated zstd frame at %d", offset)
+		}
+		magic := binary.LittleEndian.Uint32(buf)
+		if magic & 0xfffffff0 == 0x184d2a50 {
+			offset += 8 + int64(binary.LittleEndian.Uint32(buf[4:]))
+			continue
+		}
+		if magic != 0xfd2fb528 {
+			return nil, fmt.Errorf("invalid zstd frame magic at %d", offset)
+		}
+
+		// frame header
+		fhd := buf[4]
+		singleSegment := fhd & 0x20 != 0
+		pos := offset + 5
+		if !singleSegment {
+			pos++ // window descriptor
+		}
+		pos += []int64{0, 1, 2, 4}[fhd & 3] // dictionary id
+		fcs := []int64{0, 2, 4, 8}[fhd >> 6]
+		if fcs == 0 && singleSegment {
+			fcs = 1
+		}
+		pos += fcs
+
+		// blocks
+		bh := make([]byte, 3)
+		for {
+			if _, err := fd.ReadAt(bh, pos); err != nil {
+				return nil, fmt.Errorf("truncated zstd block at %d", pos)
+			}
+			h := uint32(bh[0]) | uint32(bh[1]) << 8 | uint32(bh[2]) << 16
+			blockSize := int64(h >> 3)
+			switch (h >> 1) & 3 {
+			case 1: // rle
+				blockSize = 1
+			case 3:
+				return nil, fmt.Errorf("invalid zstd block type at %d", pos)
+			}
+			pos += 3 + blockSize
+			if h & 1 != 0 {
+				break
+			}
+		}
+		if fhd & 4 != 0 {
+			pos += 4 // content checksum
+		}
+		segments = append(segments, &Segment{offset: start, size: pos - start})
+		offset = pos
+		start = pos
+	}
+	if start < size && len(segments) > 0 {
+		// the trailing skippable frames
+		segments[len(segments)-1].size = size - segments[len(segments)-1].offset
+	}
+	return segments, nil
+}
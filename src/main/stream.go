@@ -0,0 +1,131 @@
+package main
+
+// the stream reader reads the data sequentially, it is used when the data
+// can not be read by the chunks in parallel, like the compressed file can
+// not be split, it cuts the data to the blocks of the whole records, and the
+// readers (see Reader.RunBlocks) route the records of the blocks in parallel,
+// so there is only one decompressor for a file, but many partitioning workers
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// Block is the whole records cut from the stream, and where it is in the
+// decompressed stream, for the reject file
+type Block struct {
+	path string
+	data []byte
+	offset int64
+	lines int64 // the newlines before the block
+}
+
+type StreamReader struct {
+	path string
+	format Format
+	bufsize int
+	count int64 // the blocks
+	offset int64 // the offset of the next block
+	lines int64 // the newlines before the next block
+}
+
+func NewStreamReader(path string, format Format, bufsize int) *StreamReader {
+	return &StreamReader{
+		path: path,
+		format: format,
+		bufsize: bufsize,
+	}
+}
+
+// Run read the stream to the end and send the blocks to the channel, the
+// last record without the newline is also sent, the channel is shared by
+// the streams of the job, it is closed by the job, it returns when the
+// context is cancelled
+func (this *StreamReader) Run(ctx context.Context, r io.ReadCloser, blocks chan *Block) error {
+	defer r.Close()
+
+	buffer := make([]byte, this.bufsize)
+	remain := 0
+	scanned := 0
+	state := FORMAT_STATE_START
+	skipHeader := hasHeader(this.format)
+	for {
+		if remain == len(buffer) {
+			// the record is larger than the buffer, grow it
+			newbuf := make([]byte, len(buffer)*2)
+			copy(newbuf, buffer[:remain])
+			buffer = newbuf
+		}
+		n, err := io.ReadFull(r, buffer[remain:])
+		end := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !end {
+			return err
+		}
+		actualLen := remain + n
+
+		// find the last record end of the buffer
+		last := -1
+		for {
+			l := this.format.FindRecordEnd(buffer[scanned:actualLen], &state)
+			if l < 0 {
+				// the state is kept for the rest of the record
+				scanned = actualLen
+				break
+			}
+			scanned += l + 1
+			last = scanned
+			state = FORMAT_STATE_START
+			if skipHeader {
+				// the first record of the file is the header
+				this.offset += int64(last)
+				this.lines += int64(bytes.Count(buffer[:last], []byte{'\n'}))
+				copy(buffer, buffer[last:actualLen])
+				actualLen -= last
+				scanned -= last
+				last = -1
+				skipHeader = false
+			}
+		}
+
+		if end {
+			if actualLen > 0 && last < actualLen {
+				// the last record without the newline
+				buffer = append(buffer[:actualLen], '\n')
+				actualLen++
+			}
+			if actualLen > 0 && !(skipHeader && last < 0) {
+				if err := this.send(ctx, blocks, buffer[:actualLen]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if last < 0 {
+			remain = actualLen
+			continue
+		}
+
+		// the buffer is given to the readers, start a new one with the rest
+		newbuf := make([]byte, len(buffer))
+		remain = copy(newbuf, buffer[last:actualLen])
+		scanned -= last
+		if err := this.send(ctx, blocks, buffer[:last]); err != nil {
+			return err
+		}
+		buffer = newbuf
+	}
+}
+
+func (this *StreamReader) send(ctx context.Context, blocks chan *Block, data []byte) error {
+	block := &Block{path: this.path, data: data, offset: this.offset, lines: this.lines}
+	select {
+	case blocks <- block:
+		this.count++
+		this.offset += int64(len(data))
+		this.lines += int64(bytes.Count(data, []byte{'\n'}))
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+// the postgresql text format, the output of COPY ... TO in text format, the
+// fields are delimited by tab by default, the null is \N by default, and
+// the backslash escapes the next char, so an escaped newline or delimiter
+// is part of the field, the same as CopyReadLineText and
+// CopyReadAttributesText do:
+//   TEXT_STATE_OUT:  normal
+//   TEXT_STATE_ESC:  the last char is a backslash
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"loadconfig"
+	"strings"
+)
+
+const (
+	TEXT_STATE_OUT int = iota
+	TEXT_STATE_ESC
+)
+
+type TextFormat struct {
+	delim byte
+	null string
+}
+
+// NewTextFormat make the default format
+func NewTextFormat() *TextFormat {
+	return &TextFormat{
+		delim: '\t',
+		null: `\N`,
+	}
+}
+
+// NewTextFormatFromConfig make the format by the table settings, and check
+// them the same way as the COPY command does
+func NewTextFormatFromConfig(t *loadconfig.Table) (*TextFormat, error) {
+	f := NewTextFormat()
+	var err error
+	if t.Quote != "" || t.Escape != "" || len(t.ForceNull) > 0 || len(t.ForceNotNull) > 0 {
+		return nil, fmt.Errorf("quote, escape and force options are available only in csv format")
+	}
+	if t.Delimiter != "" {
+		if f.delim, err = formatChar("delimiter", t.Delimiter); err != nil {
+			return nil, err
+		}
+	}
+	if t.Null != nil {
+		f.null = *t.Null
+	}
+
+	if f.delim == '\n' || f.delim == '\r' {
+		return nil, fmt.Errorf("delimiter cannot be newline or carriage return")
+	}
+	if strings.ContainsAny(f.null, "\r\n") {
+		return nil, fmt.Errorf("null representation cannot use newline or carriage return")
+	}
+	if strings.IndexByte("\\.abcdefghijklmnopqrstuvwxyz0123456789", f.delim) >= 0 {
+		return nil, fmt.Errorf("delimiter cannot be \"%c\"", f.delim)
+	}
+	if strings.IndexByte(f.null, f.delim) >= 0 {
+		return nil, fmt.Errorf("delimiter must not appear in the null specification")
+	}
+	return f, nil
+}
+
+// FindRecordEnd find the newline not escaped
+func (this *TextFormat) FindRecordEnd(buf []byte, state *int) int {
+	s := *state
+	for i := 0; i < len(buf); i++ {
+		if s == TEXT_STATE_ESC {
+			s = TEXT_STATE_OUT
+			continue
+		}
+		j := indexAnyOf2(buf[i:], '\n', '\\')
+		if j < 0 {
+			break
+		}
+		i += j
+		if buf[i] == '\n' {
+			*state = TEXT_STATE_OUT
+			return i
+		}
+		s = TEXT_STATE_ESC
+	}
+	*state = s
+	return -1
+}
+
+// textStateAt the state at the offset of the plain file, by the backslashes
+// right before it, only the run of them is read
+func textStateAt(r io.ReaderAt, offset int64) (int, error) {
+	buf := make([]byte, 4096)
+	n := 0
+	for offset > 0 {
+		size := int64(len(buf))
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		if _, err := r.ReadAt(buf[:size], offset); err != nil {
+			return TEXT_STATE_OUT, err
+		}
+		m := int(size) - len(bytes.TrimRight(buf[:size], "\\"))
+		n += m
+		if m < int(size) {
+			break
+		}
+	}
+	if n%2 == 1 {
+		return TEXT_STATE_ESC, nil
+	}
+	return TEXT_STATE_OUT, nil
+}
+
+// ScanStates only the backslash right before the chunk start matters, a run
+// of backslashes flips the state by its length
+func (this *TextFormat) ScanStates(buf []byte, states *[FORMAT_STATE_NUM]int) {
+	if len(buf) == 0 {
+		return
+	}
+	n := len(buf) - len(bytes.TrimRight(buf, "\\"))
+	for i := range states {
+		if n == len(buf) {
+			// all backslashes, go on from the start state
+			if (states[i] == TEXT_STATE_ESC) != (n%2 == 0) {
+				states[i] = TEXT_STATE_OUT
+			} else {
+				states[i] = TEXT_STATE_ESC
+			}
+		} else if n%2 == 1 {
+			states[i] = TEXT_STATE_ESC
+		} else {
+			states[i] = TEXT_STATE_OUT
+		}
+	}
+}
+
+// getNextField split the raw field at the start of c, the data after the
+// delimiter is returned (nil if it is the last field)
+func (this *TextFormat) getNextField(c []byte) ([]byte, []byte) {
+	for i := 0; i < len(c); i++ {
+		if c[i] == '\\' {
+			i++
+		} else if c[i] == this.delim {
+			return c[:i], c[i+1:]
+		}
+	}
+	return c, nil
+}
+
+// GetField the raw field is compared with the null string before unescape
+func (this *TextFormat) GetField(c []byte, index int) ([]byte, bool, error) {
+	var field []byte
+	rest := stripLineEnd(c)
+	for i := 0; i < index; i++ {
+		if rest == nil {
+			return nil, false, fmt.Errorf("too few fields, field %d not found", index)
+		}
+		field, rest = this.getNextField(rest)
+	}
+	if string(field) == this.null {
+		return field, true, nil
+	}
+	return unescapeText(field), false, nil
+}
+
+func (this *TextFormat) GetFields(c []byte) ([][]byte, []bool, error) {
+	var field []byte
+	fields := make([][]byte, 0)
+	nulls := make([]bool, 0)
+	rest := stripLineEnd(c)
+	for rest != nil {
+		field, rest = this.getNextField(rest)
+		null := string(field) == this.null
+		if !null {
+			field = unescapeText(field)
+		}
+		fields = append(fields, field)
+		nulls = append(nulls, null)
+	}
+	return fields, nulls, nil
+}
+
+func (this *TextFormat) bindColumns(columns []string) error {
+	return nil
+}
+
+func (this *TextFormat) CopyOptions() string {
+	return "FORMAT text, DELIMITER " + QuoteLiteral(string(this.delim)) +
+		", NULL " + QuoteLiteral(this.null)
+}
+
+// AppendRecord escape the backslash, the delimiter and the control chars
+// the same as CopyAttributeOutText
+func (this *TextFormat) AppendRecord(buf []byte, fields [][]byte, nulls []bool) []byte {
+	for i, field := range fields {
+		if i > 0 {
+			buf = append(buf, this.delim)
+		}
+		if nulls[i] {
+			buf = append(buf, this.null...)
+			continue
+		}
+		for _, c := range field {
+			switch c {
+			case '\b':
+				buf = append(buf, '\\', 'b')
+			case '\f':
+				buf = append(buf, '\\', 'f')
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			case '\v':
+				buf = append(buf, '\\', 'v')
+			case '\\', this.delim:
+				buf = append(buf, '\\', c)
+			default:
+				buf = append(buf, c)
+			}
+		}
+	}
+	return append(buf, '\n')
+}
+
+// unescapeText handle the backslash sequences the same as
+// CopyReadAttributesText, \b \f \n \r \t \v, the octal \digits and the hex
+// \xdigits, any other char after the backslash is taken literally
+func unescapeText(field []byte) []byte {
+	if bytes.IndexByte(field, '\\') < 0 {
+		return field
+	}
+	out := make([]byte, 0, len(field))
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c != '\\' || i+1 >= len(field) {
+			out = append(out, c)
+			continue
+		}
+		i++
+		c = field[i]
+		switch {
+		case c >= '0' && c <= '7':
+			val := int(c - '0')
+			for k := 0; k < 2 && i+1 < len(field) && field[i+1] >= '0' && field[i+1] <= '7'; k++ {
+				i++
+				val = (val << 3) + int(field[i]-'0')
+			}
+			c = byte(val & 0377)
+		case c == 'x' && i+1 < len(field) && hexValue(field[i+1]) >= 0:
+			i++
+			val := hexValue(field[i])
+			if i+1 < len(field) && hexValue(field[i+1]) >= 0 {
+				i++
+				val = (val << 4) + hexValue(field[i])
+			}
+			c = byte(val & 0xff)
+		case c == 'b':
+			c = '\b'
+		case c == 'f':
+			c = '\f'
+		case c == 'n':
+			c = '\n'
+		case c == 'r':
+			c = '\r'
+		case c == 't':
+			c = '\t'
+		case c == 'v':
+			c = '\v'
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func hexValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c - 'a') + 10
+	case c >= 'A' && c <= 'F':
+		return int(c - 'A') + 10
+	}
+	return -1
+}
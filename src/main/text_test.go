@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"loadconfig"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestTextUnescape(t *testing.T) {
+	cases := []struct {
+		raw string
+		want string
+	}{
+		{`plain`, "plain"},
+		{`\b\f\n\r\t\v`, "\b\f\n\r\t\v"},
+		{`a\\b`, `a\b`},
+		{`\N`, "N"},
+		{`\q\.`, "q."},
+		// octal, at most 3 digits
+		{`\101\60\0`, "A0\000"},
+		{`\1012`, "A2"},
+		{`\777`, "\xff"},
+		{`\8`, "8"},
+		// hex, at most 2 digits
+		{`\x41\x4`, "A\x04"},
+		{`\x414`, "A4"},
+		{`\xg`, "xg"},
+		{`\X41`, "X41"},
+		// the backslash at the end is kept
+		{`a\`, `a\`},
+	}
+	for _, c := range cases {
+		if got := string(unescapeText([]byte(c.raw))); got != c.want {
+			t.Errorf("unescapeText(%q) = %q, want %q", c.raw, got, c.want)
+		}
+	}
+}
+
+func TestTextGetFields(t *testing.T) {
+	cases := []struct {
+		null *string
+		record string
+		fields []string
+		nulls []bool
+	}{
+		{nil, "1\ta\tb\n", []string{"1", "a", "b"}, []bool{false, false, false}},
+		// \N is null, the escaped backslash before N is not
+		{nil, `\N` + "\t" + `\\N` + "\t\n", []string{`\N`, `\N`, ""}, []bool{true, false, false}},
+		// the escaped delimiter and newline are in the field
+		{nil, `a\` + "\tb\t" + `c\` + "\nd\r\n", []string{"a\tb", "c\nd"}, []bool{false, false}},
+		{nil, `\x41\102\n`, []string{"AB\n"}, []bool{false}},
+		{strptr(""), "\tx\t\n", []string{"", "x", ""}, []bool{true, false, true}},
+	}
+	for _, c := range cases {
+		f, err := NewTextFormatFromConfig(&loadconfig.Table{Format: "text", Null: c.null})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields, nulls, err := f.GetFields([]byte(c.record))
+		if err != nil {
+			t.Errorf("GetFields(%q) %s", c.record, err.Error())
+			continue
+		}
+		got := make([]string, len(fields))
+		for i, field := range fields {
+			got[i] = string(field)
+		}
+		if !reflect.DeepEqual(got, c.fields) || !reflect.DeepEqual(nulls, c.nulls) {
+			t.Errorf("GetFields(%q) = %q %v, want %q %v", c.record, got, nulls, c.fields, c.nulls)
+		}
+		for i := range c.fields {
+			field, null, err := f.GetField([]byte(c.record), i+1)
+			if err != nil || null != c.nulls[i] || (!null && string(field) != c.fields[i]) {
+				t.Errorf("GetField(%q, %d) = %q %v %v", c.record, i+1, field, null, err)
+			}
+		}
+
+		// the fields written by the format are read back the same
+		record := f.AppendRecord(nil, fields, nulls)
+		fields2, nulls2, _ := f.GetFields(record)
+		if !reflect.DeepEqual(fields2, fields) || !reflect.DeepEqual(nulls2, nulls) {
+			t.Errorf("AppendRecord(%q) = %q, read back %q %v", got, record, fields2, nulls2)
+		}
+	}
+	if _, _, err := NewTextFormat().GetField([]byte("a\tb\n"), 3); err == nil {
+		t.Errorf("GetField of the missing field, no error")
+	}
+}
+
+func TestTextFindRecordEnd(t *testing.T) {
+	f := NewTextFormat()
+	cases := []recordEndCase{
+		{"a\tb\nc", TEXT_STATE_OUT, 3, TEXT_STATE_OUT},
+		{"a\\\nb\n", TEXT_STATE_OUT, 4, TEXT_STATE_OUT},
+		{"a\\\\\nb\n", TEXT_STATE_OUT, 3, TEXT_STATE_OUT},
+		{"a\\\\\\\nb\n", TEXT_STATE_OUT, 6, TEXT_STATE_OUT},
+		{"a\\", TEXT_STATE_OUT, -1, TEXT_STATE_ESC},
+		{"a\\\\", TEXT_STATE_OUT, -1, TEXT_STATE_OUT},
+		// the chunk starts right after the backslash
+		{"\nb\n", TEXT_STATE_ESC, 2, TEXT_STATE_OUT},
+		{"\\\n", TEXT_STATE_ESC, 1, TEXT_STATE_OUT},
+		{"", TEXT_STATE_ESC, -1, TEXT_STATE_ESC},
+	}
+	for _, c := range cases {
+		state := c.state
+		end := f.FindRecordEnd([]byte(c.buf), &state)
+		if end != c.end || state != c.after {
+			t.Errorf("FindRecordEnd(%q, %d) = %d, state %d, want %d, state %d",
+				c.buf, c.state, end, state, c.end, c.after)
+		}
+	}
+}
+
+// TestTextStates the state at each offset by the backslashes before it, from
+// the scan of the chunks and from the file, is the same as the one from the
+// record scan
+func TestTextStates(t *testing.T) {
+	f := NewTextFormat()
+	data := []byte("a\\\\\\\nb\\\\\nc\\" + strings.Repeat("\\", 5000) + "\nd\\\\")
+	state := TEXT_STATE_OUT
+	for offset := 0; offset <= len(data); offset++ {
+		got, err := textStateAt(bytes.NewReader(data), int64(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != state {
+			t.Fatalf("textStateAt(%d) = %d, want %d", offset, got, state)
+		}
+		states := [FORMAT_STATE_NUM]int{TEXT_STATE_OUT, TEXT_STATE_ESC}
+		f.ScanStates(data[:offset], &states)
+		if states[TEXT_STATE_OUT] != state {
+			t.Fatalf("ScanStates(%d) = %v, want %d", offset, states, state)
+		}
+		if offset < len(data) {
+			if state == TEXT_STATE_ESC {
+				state = TEXT_STATE_OUT
+			} else if data[offset] == '\\' {
+				state = TEXT_STATE_ESC
+			}
+		}
+	}
+	// the chunk of all backslashes goes on from the state before it
+	states := [FORMAT_STATE_NUM]int{TEXT_STATE_OUT, TEXT_STATE_ESC}
+	f.ScanStates([]byte("\\\\\\"), &states)
+	if states[TEXT_STATE_OUT] != TEXT_STATE_ESC || states[TEXT_STATE_ESC] != TEXT_STATE_OUT {
+		t.Errorf("ScanStates of the backslashes = %v", states)
+	}
+}
+
+func TestTextFormatConflicts(t *testing.T) {
+	cases := []loadconfig.Table{
+		{Quote: "'"},
+		{Escape: `\`},
+		{ForceNull: []string{"a"}},
+		{Delimiter: `\`},
+		{Delimiter: "."},
+		{Delimiter: "a"},
+		{Delimiter: "1"},
+		{Delimiter: "\n"},
+		{Delimiter: "||"},
+		{Null: strptr("a\nb")},
+		{Delimiter: "|", Null: strptr("|")},
+	}
+	for _, c := range cases {
+		c.Format = "text"
+		if _, err := NewTextFormatFromConfig(&c); err == nil {
+			t.Errorf("%+v is not rejected", c)
+		}
+	}
+}
+
+// textRecords the output of pg_dump, the escaped newlines are split by the
+// chunks, and the data ends at the end marker \.
+var textRecords = []string{
+	"1\tplain\t\\N\n",
+	"2\tline1\\\nline2\t\\\\\n",
+	"3\t\\\\\\\n\\\\\tx\\ty\n",
+	"4\t\\x41\\101\\n\t\\\\N\n",
+	"5\t\\\n\\\n\t\\\t\n",
+	"6\tcrlf\t\\r\r\n",
+}
+
+func TestTextChunks(t *testing.T) {
+	for _, end := range []string{"\\.\n", "\\.\r\n", "\\."} {
+		data := strings.Join(textRecords, "") + end
+		path := writeTemp(t, data)
+		want := append([]string{}, textRecords...)
+		sort.Strings(want)
+
+		for readers := 1; readers <= len(data); readers++ {
+			setReaders(t, readers, 1+readers%5)
+			f := NewTextFormat()
+			tinfo := &TableInfo{name: "t", datapath: []string{path}, partitionField: []int{2},
+				partitionFieldType: []string{"text"}, format: f, input: f, dbinfos: make([]DBInfo, 3)}
+			got := readTable(t, tinfo)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("end %q, %d readers\n got %q\nwant %q", end, readers, got, want)
+			}
+		}
+	}
+}
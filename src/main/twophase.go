@@ -0,0 +1,376 @@
+package main
+
+// the atomic mode, a table is loaded on all nodes or none of them. each
+// sender copies in an explicit transaction, and the job waits until all the
+// copies return, if all of them are done, the transactions are prepared
+// (PREPARE TRANSACTION) and then committed (COMMIT PREPARED) on every node,
+// otherwise they are rolled back everywhere.
+//
+// the gids are written to the journal before the prepare, and the decision
+// before the commit, so a run crashed in between can be resolved by
+//
+//   main recover load.yml
+//
+// which commits the prepared transactions of a decided commit, and rolls
+// back the others. the journal is a text file, one record per line:
+//
+//   prepare <txn> <table> <gid> <host> <port> <dbname>   for each node
+//   commit <txn> or rollback <txn>                        the decision
+//   done <txn>                                            all nodes resolved
+//
+// the nodes should allow the prepared transactions (max_prepared_transactions).
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"loadconfig"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+)
+
+// the prefix of the gids of the prepared transactions
+const GID_PREFIX = "pgload"
+
+type Journal struct {
+	path string
+	fd *os.File
+	mux sync.Mutex
+}
+
+func NewJournal(path string) *Journal {
+	return &Journal{path: path}
+}
+
+// Write append a record to the journal, it is synced to the disk before it
+// returns
+func (this *Journal) Write(fields ...string) error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+
+	if this.fd == nil {
+		fd, err := os.OpenFile(this.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("fail to open journal %s, %s", this.path, err.Error())
+		}
+		this.fd = fd
+	}
+	if _, err := this.fd.WriteString(strings.Join(fields, "\t") + "\n"); err != nil {
+		return fmt.Errorf("fail to write journal %s, %s", this.path, err.Error())
+	}
+	return this.fd.Sync()
+}
+
+func (this *Journal) Close() {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if this.fd != nil {
+		this.fd.Close()
+		this.fd = nil
+	}
+}
+
+// the prepared transaction of a node in the journal
+type PreparedNode struct {
+	gid string
+	host string
+	port int
+	dbname string
+}
+
+// JournalTxn is the transactions of a job on all nodes
+type JournalTxn struct {
+	name string
+	table string
+	nodes []PreparedNode
+	decision string // commit, rollback, or empty if not decided
+	done bool
+}
+
+// readJournal get the transactions of the journal in the order of them
+func readJournal(path string) ([]*JournalTxn, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	txns := make([]*JournalTxn, 0)
+	index := make(map[string]*JournalTxn)
+	scanner := bufio.NewScanner(fd)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 2 {
+			// the last record is cut by a crash
+			continue
+		}
+		txn, ok := index[fields[1]]
+		if !ok {
+			txn = &JournalTxn{name: fields[1]}
+			index[txn.name] = txn
+			txns = append(txns, txn)
+		}
+		switch fields[0] {
+		case "prepare":
+			if len(fields) != 7 {
+				continue
+			}
+			port, err := strconv.Atoi(fields[5])
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid port %s", path, line, fields[5])
+			}
+			txn.table = fields[2]
+			txn.nodes = append(txn.nodes, PreparedNode{fields[3], fields[4], port, fields[6]})
+		case "commit", "rollback":
+			txn.decision = fields[0]
+		case "done":
+			txn.done = true
+		}
+	}
+	return txns, scanner.Err()
+}
+
+// compactJournal drop the resolved transactions from the journal, the
+// journal is removed if all of them are resolved, the same as the checkpoint
+// files of the loaded tables, the others are kept for the recover
+func compactJournal(path string) error {
+	txns, err := readJournal(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	journal := NewJournal(tmp)
+	kept := 0
+	for _, txn := range txns {
+		if txn.done || len(txn.nodes) == 0 {
+			continue
+		}
+		kept++
+		for _, n := range txn.nodes {
+			err = journal.Write("prepare", txn.name, txn.table, n.gid, n.host, strconv.Itoa(n.port), n.dbname)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil && txn.decision != "" {
+			err = journal.Write(txn.decision, txn.name)
+		}
+		if err != nil {
+			journal.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	journal.Close()
+	if kept == 0 {
+		return os.Remove(path)
+	}
+	return os.Rename(tmp, path)
+}
+
+// execSenders run the function for each sender in parallel, the error of
+// each sender is returned
+func (this *Job) execSenders(f func(s *Sender) error) []error {
+	errs := make([]error, len(this.senderlist))
+	var wg sync.WaitGroup
+	for i, s := range this.senderlist {
+		wg.Add(1)
+		go func(i int, s *Sender) {
+			defer wg.Done()
+			errs[i] = f(s)
+		}(i, s)
+	}
+	wg.Wait()
+	return errs
+}
+
+// twoPhaseCommit wait for the copies on all nodes, then prepare and commit
+// the transactions of them, or roll back all of them if any node fails
+func (this *Job) twoPhaseCommit() {
+	// the barrier, the copies are done or aborted
+	for _, s := range this.senderlist {
+		<-s.copyEnd
+	}
+	if this.ctx.Err() != nil {
+		this.execSenders(func(s *Sender) error {
+			return s.exec("ROLLBACK")
+		})
+		logger.Info("%s rolled back on all nodes", this.displayName)
+		return
+	}
+
+	txn := fmt.Sprintf("%s_%d_%d_%d", GID_PREFIX, time.Now().Unix(), os.Getpid(), this.jobid)
+	gids := make(map[*Sender]string)
+	for _, s := range this.senderlist {
+		gids[s] = fmt.Sprintf("%s_%d", txn, s.remainder)
+		err := g_journal.Write("prepare", txn, this.tableinfo.name, gids[s], s.dbi.host,
+			strconv.Itoa(s.dbi.port), s.dbi.dbname)
+		if err != nil {
+			this.fail(&JobError{stage: "journal", err: err})
+			this.execSenders(func(s *Sender) error {
+				return s.exec("ROLLBACK")
+			})
+			return
+		}
+	}
+
+	prepared := make(map[*Sender]bool)
+	var mux sync.Mutex
+	errs := this.execSenders(func(s *Sender) error {
+		err := s.exec("PREPARE TRANSACTION " + QuoteLiteral(gids[s]))
+		if err == nil {
+			mux.Lock()
+			prepared[s] = true
+			mux.Unlock()
+		}
+		return err
+	})
+	for i, err := range errs {
+		if err != nil {
+			this.fail(&JobError{stage: "prepare transaction", node: this.senderlist[i].dbi.address(), err: err})
+		}
+	}
+	decision := "commit"
+	if this.ctx.Err() != nil {
+		decision = "rollback"
+	}
+	if err := g_journal.Write(decision, txn); err != nil {
+		// the commit is not recorded, so it can not be recovered
+		this.fail(&JobError{stage: "journal", err: err})
+		decision = "rollback"
+	}
+
+	if decision == "rollback" {
+		// a failed prepare has ended the transaction already
+		errs = this.execSenders(func(s *Sender) error {
+			if prepared[s] {
+				return s.exec("ROLLBACK PREPARED " + QuoteLiteral(gids[s]))
+			}
+			return nil
+		})
+	} else {
+		errs = this.execSenders(func(s *Sender) error {
+			err := s.exec("COMMIT PREPARED " + QuoteLiteral(gids[s]))
+			s.committed = err == nil
+			return err
+		})
+	}
+	resolved := true
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		resolved = false
+		s := this.senderlist[i]
+		err = fmt.Errorf("%s, run recover to resolve %s", err.Error(), gids[s])
+		if decision == "commit" {
+			this.fail(&JobError{stage: "commit prepared", node: s.dbi.address(), err: err})
+		} else {
+			logger.Error("%s rollback prepared on %s, %s", this.displayName, s.dbi.address(), err.Error())
+		}
+	}
+	if resolved {
+		if err := g_journal.Write("done", txn); err != nil {
+			logger.Warn("%s %s", this.displayName, err.Error())
+		}
+	}
+	if decision == "commit" && resolved {
+		logger.Info("%s committed on all nodes, %s", this.displayName, txn)
+	} else if decision == "rollback" {
+		logger.Info("%s rolled back on all nodes, %s", this.displayName, txn)
+	}
+}
+
+// resolvePrepared commit or roll back the prepared transaction on the node,
+// it is done if the transaction is not there
+func resolvePrepared(node PreparedNode, decision string, conf *loadconfig.Config) error {
+	dbi := DBInfo{host: node.host, port: node.port, dbname: node.dbname, user: conf.User,
+		password: conf.Password}
+	db, err := pgconn.Connect(context.Background(), dbi.MakeConnectionString())
+	if err != nil {
+		return err
+	}
+	defer db.Close(context.Background())
+
+	results, err := db.Exec(context.Background(),
+		"SELECT 1 FROM pg_prepared_xacts WHERE gid = " + QuoteLiteral(node.gid)).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 || len(results[0].Rows) == 0 {
+		logger.Info("%s is not prepared on %s", node.gid, dbi.address())
+		return nil
+	}
+	sql := "ROLLBACK PREPARED " + QuoteLiteral(node.gid)
+	if decision == "commit" {
+		sql = "COMMIT PREPARED " + QuoteLiteral(node.gid)
+	}
+	if _, err := db.Exec(context.Background(), sql).ReadAll(); err != nil {
+		return err
+	}
+	logger.Info("%s on %s", sql, dbi.address())
+	return nil
+}
+
+// recoverJournal resolve the transactions of the journal which are not done,
+// the transactions without the commit decision are rolled back, the number
+// of the transactions still not resolved is returned
+func recoverJournal(conf *loadconfig.Config, path string) int {
+	txns, err := readJournal(path)
+	if os.IsNotExist(err) {
+		// the journal is removed once all the transactions are resolved
+		fmt.Printf("no journal %s, nothing to resolve\n", path)
+		return 0
+	} else if err != nil {
+		logger.Error("fail to read journal %s, %s", path, err.Error())
+		return 1
+	}
+	journal := NewJournal(path)
+
+	failed := 0
+	for _, txn := range txns {
+		if txn.done {
+			continue
+		}
+		decision := txn.decision
+		if decision != "commit" {
+			decision = "rollback"
+		}
+		resolved := true
+		for _, node := range txn.nodes {
+			if err := resolvePrepared(node, decision, conf); err != nil {
+				logger.Error("%s of table %s on %s:%d, %s", node.gid, txn.table, node.host, node.port,
+					err.Error())
+				resolved = false
+			}
+		}
+		if !resolved {
+			failed++
+			continue
+		}
+		if txn.decision != decision {
+			journal.Write(decision, txn.name)
+		}
+		if err := journal.Write("done", txn.name); err != nil {
+			logger.Error("%s", err.Error())
+		}
+		fmt.Printf("%s %s: %s on %d nodes\n", txn.name, txn.table, decision, len(txn.nodes))
+	}
+	journal.Close()
+	if err := compactJournal(path); err != nil {
+		logger.Warn("fail to compact journal %s, %s", path, err.Error())
+	}
+	if failed > 0 {
+		fmt.Printf("%d transactions are not resolved, run recover again\n", failed)
+	}
+	return failed
+}
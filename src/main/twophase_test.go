@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompactJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "load.yml.journal")
+
+	// no journal, nothing is prepared
+	if err := compactJournal(path); err != nil {
+		t.Fatalf("compact no journal: %s", err)
+	}
+
+	records := [][]string{
+		{"prepare", "t1", "a", "t1_0", "h1", "5432", "db"},
+		{"prepare", "t1", "a", "t1_1", "h2", "5433", "db"},
+		{"commit", "t1"},
+		{"prepare", "t2", "b", "t2_0", "h1", "5432", "db"},
+		{"prepare", "t2", "b", "t2_1", "h2", "5433", "db"},
+		{"commit", "t2"},
+		{"prepare", "t3", "c", "t3_0", "h1", "5432", "db"},
+		{"done", "t1"},
+		{"rollback", "t4"},
+		{"done", "t4"},
+	}
+	journal := NewJournal(path)
+	for _, r := range records {
+		if err := journal.Write(r...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal.Close()
+	want, _ := readJournal(path)
+	want = []*JournalTxn{want[1], want[2]}
+
+	if err := compactJournal(path); err != nil {
+		t.Fatalf("compact: %s", err)
+	}
+	got, err := readJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("compacted journal %+v, want %+v", got, want)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary journal is left, %v", err)
+	}
+
+	// all resolved, the journal is removed
+	journal = NewJournal(path)
+	journal.Write("done", "t2")
+	journal.Write("rollback", "t3")
+	journal.Write("done", "t3")
+	journal.Close()
+	if err := compactJournal(path); err != nil {
+		t.Fatalf("compact resolved: %s", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the resolved journal is not removed, %v", err)
+	}
+}
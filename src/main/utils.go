@@ -1,5 +1,9 @@
 package main
 
+import (
+	"strings"
+)
+
 func sizeConvert(l int64) (int64, string) {
 	var sizes []string = []string{ "B", "KB", "MB", "GB", "TB" };
 	var order = 0;
@@ -9,3 +13,15 @@ func sizeConvert(l int64) (int64, string) {
 	}
 	return l, sizes[order]
 }
+
+// split the comma separated configuration item, and trim the spaces
+func splitList(s string) []string {
+	var r = make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			r = append(r, item)
+		}
+	}
+	return r
+}
@@ -0,0 +1,166 @@
+package pghash
+
+// the date and timestamp(without time zone) input of postgresql, only the ISO
+// 8601 style (what COPY TO and pg_dump output with the default DateStyle) is
+// supported. a date is stored as days from 2000-01-01, and a timestamp as
+// microseconds from 2000-01-01 00:00:00, which is what the hash functions see
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DATEVAL_NOBEGIN int32 = math.MinInt32
+	DATEVAL_NOEND   int32 = math.MaxInt32
+	DT_NOBEGIN      int64 = math.MinInt64
+	DT_NOEND        int64 = math.MaxInt64
+
+	USECS_PER_SEC int64 = 1000000
+)
+
+// unix seconds of 2000-01-01 00:00:00, the postgres epoch
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+// parseISODate parse "YYYY-MM-DD" with an optional " BC" suffix, return the
+// unix seconds of the midnight of the day
+func parseISODate(s string) (int64, error) {
+	bc := false
+	if strings.HasSuffix(strings.ToUpper(s), " BC") {
+		bc = true
+		s = strings.TrimSpace(s[:len(s)-3])
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("not iso date")
+	}
+	y, err := strconv.Atoi(parts[0])
+	if err != nil || y < 1 {
+		return 0, fmt.Errorf("invalid year")
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 1 || m > 12 {
+		return 0, fmt.Errorf("invalid month")
+	}
+	d, err := strconv.Atoi(parts[2])
+	if err != nil || d < 1 || d > 31 {
+		return 0, fmt.Errorf("invalid day")
+	}
+	if bc {
+		// there is no year 0, 1 BC is year 0 in the proleptic calendar
+		y = -(y - 1)
+	}
+	t := time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+	if t.Day() != d {
+		return 0, fmt.Errorf("date out of range")
+	}
+	return t.Unix(), nil
+}
+
+// parseTime parse "HH:MM[:SS[.ffffff]]" to microseconds of the day, the
+// fraction more than 6 digits is rounded as postgresql does
+func parseTime(s string) (int64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time")
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid hour")
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid minute")
+	}
+	var usec int64 = 0
+	if len(parts) == 3 {
+		sec, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil || sec < 0 || sec >= 61 {
+			return 0, fmt.Errorf("invalid second")
+		}
+		usec = int64(math.RoundToEven(sec * float64(USECS_PER_SEC)))
+	}
+	return (int64(h)*60+int64(m))*60*USECS_PER_SEC + usec, nil
+}
+
+// ParseDate parse the date text form to days from 2000-01-01
+func ParseDate(str string) (int32, error) {
+	s := strings.TrimSpace(str)
+	switch strings.ToLower(s) {
+	case "-infinity":
+		return DATEVAL_NOBEGIN, nil
+	case "infinity":
+		return DATEVAL_NOEND, nil
+	}
+	secs, err := parseISODate(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid input syntax for type date: \"%s\"", str)
+	}
+	return int32((secs - postgresEpoch) / 86400), nil
+}
+
+// ParseTimestamp parse the timestamp text form to microseconds from
+// 2000-01-01 00:00:00, the date and time can be separated by a space or 'T',
+// a trailing time zone is ignored as timestamp without time zone does
+func ParseTimestamp(str string) (int64, error) {
+	s := strings.TrimSpace(str)
+	switch strings.ToLower(s) {
+	case "-infinity":
+		return DT_NOBEGIN, nil
+	case "infinity":
+		return DT_NOEND, nil
+	}
+	bad := fmt.Errorf("invalid input syntax for type timestamp: \"%s\"", str)
+
+	bc := false
+	if strings.HasSuffix(strings.ToUpper(s), " BC") {
+		bc = true
+		s = strings.TrimSpace(s[:len(s)-3])
+	}
+
+	datepart, timepart := s, ""
+	if i := strings.IndexAny(s, " T"); i >= 0 {
+		datepart, timepart = s[:i], strings.TrimSpace(s[i+1:])
+	}
+	if bc {
+		datepart += " BC"
+	}
+	secs, err := parseISODate(datepart)
+	if err != nil {
+		return 0, bad
+	}
+
+	var usec int64 = 0
+	if len(timepart) > 0 {
+		// cut off the time zone, like "+08", "-05:30" or "Z"
+		if i := strings.IndexAny(timepart, "+-Z "); i > 0 {
+			timepart = timepart[:i]
+		}
+		usec, err = parseTime(timepart)
+		if err != nil {
+			return 0, bad
+		}
+	}
+	return (secs-postgresEpoch)*USECS_PER_SEC + usec, nil
+}
+
+// HashDate hash a date as hashint4extended
+func HashDate(key string) (uint64, error) {
+	d, err := ParseDate(key)
+	if err != nil {
+		return 0, err
+	}
+	return HashInt(d), nil
+}
+
+// HashTimestamp hash a timestamp as hashint8extended
+func HashTimestamp(key string) (uint64, error) {
+	ts, err := ParseTimestamp(key)
+	if err != nil {
+		return 0, err
+	}
+	return HashBigint(ts), nil
+}
@@ -0,0 +1,185 @@
+package pghash
+
+// the golden table of the partition remainders, the rows are generated once
+// by the c hash functions of postgresql (src/hashcheck, run: hashcheck golden),
+// so the go port is checked by go test without cgo, regenerate it only when
+// the c code is updated
+
+import (
+	"strconv"
+	"testing"
+)
+
+type goldenCase struct {
+	kind      string
+	value     string
+	modulus   int
+	remainder int
+}
+
+var goldenCases = []goldenCase{
+	{"int", "0", 3, 2},
+	{"int", "0", 8, 0},
+	{"int", "0", 1024, 432},
+	{"int", "1", 3, 2},
+	{"int", "1", 8, 0},
+	{"int", "1", 1024, 952},
+	{"int", "-1", 3, 2},
+	{"int", "-1", 8, 5},
+	{"int", "-1", 1024, 933},
+	{"int", "4321", 3, 1},
+	{"int", "4321", 8, 2},
+	{"int", "4321", 1024, 250},
+	{"int", "2147483647", 3, 1},
+	{"int", "2147483647", 8, 7},
+	{"int", "2147483647", 1024, 383},
+	{"int", "-2147483648", 3, 0},
+	{"int", "-2147483648", 8, 6},
+	{"int", "-2147483648", 1024, 630},
+	{"bigint", "0", 3, 2},
+	{"bigint", "0", 8, 0},
+	{"bigint", "0", 1024, 432},
+	{"bigint", "1", 3, 2},
+	{"bigint", "1", 8, 0},
+	{"bigint", "1", 1024, 952},
+	{"bigint", "-1", 3, 2},
+	{"bigint", "-1", 8, 5},
+	{"bigint", "-1", 1024, 933},
+	{"bigint", "222222222222", 3, 0},
+	{"bigint", "222222222222", 8, 3},
+	{"bigint", "222222222222", 1024, 459},
+	{"bigint", "-222222222222", 3, 1},
+	{"bigint", "-222222222222", 8, 1},
+	{"bigint", "-222222222222", 1024, 481},
+	{"bigint", "9223372036854775807", 3, 0},
+	{"bigint", "9223372036854775807", 8, 6},
+	{"bigint", "9223372036854775807", 1024, 630},
+	{"bigint", "-9223372036854775808", 3, 1},
+	{"bigint", "-9223372036854775808", 8, 7},
+	{"bigint", "-9223372036854775808", 1024, 383},
+	{"text", "", 3, 2},
+	{"text", "", 8, 6},
+	{"text", "", 1024, 166},
+	{"text", "a", 3, 2},
+	{"text", "a", 8, 6},
+	{"text", "a", 1024, 862},
+	{"text", "dennytest", 3, 2},
+	{"text", "dennytest", 8, 0},
+	{"text", "dennytest", 1024, 424},
+	{"text", "bmsql_item", 3, 0},
+	{"text", "bmsql_item", 8, 0},
+	{"text", "bmsql_item", 1024, 672},
+	{"text", "中文测试", 3, 1},
+	{"text", "中文测试", 8, 3},
+	{"text", "中文测试", 1024, 931},
+	{"text", "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx", 3, 1},
+	{"text", "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx", 8, 2},
+	{"text", "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx", 1024, 970},
+	{"numeric", "0", 3, 2},
+	{"numeric", "0", 8, 7},
+	{"numeric", "0", 1024, 479},
+	{"numeric", "-0", 3, 2},
+	{"numeric", "-0", 8, 7},
+	{"numeric", "-0", 1024, 479},
+	{"numeric", "0.000", 3, 2},
+	{"numeric", "0.000", 8, 7},
+	{"numeric", "0.000", 1024, 479},
+	{"numeric", "1", 3, 1},
+	{"numeric", "1", 8, 1},
+	{"numeric", "1", 1024, 833},
+	{"numeric", "-1", 3, 1},
+	{"numeric", "-1", 8, 1},
+	{"numeric", "-1", 1024, 833},
+	{"numeric", "10000", 3, 2},
+	{"numeric", "10000", 8, 2},
+	{"numeric", "10000", 1024, 834},
+	{"numeric", "00012.3400", 3, 1},
+	{"numeric", "00012.3400", 8, 4},
+	{"numeric", "00012.3400", 1024, 692},
+	{"numeric", "1e10", 3, 1},
+	{"numeric", "1e10", 8, 3},
+	{"numeric", "1e10", 1024, 587},
+	{"numeric", "1.5E-7", 3, 1},
+	{"numeric", "1.5E-7", 8, 0},
+	{"numeric", "1.5E-7", 1024, 984},
+	{"numeric", "-98765.4321", 3, 2},
+	{"numeric", "-98765.4321", 8, 1},
+	{"numeric", "-98765.4321", 1024, 9},
+	{"numeric", "12345678901234567890.0987654321", 3, 2},
+	{"numeric", "12345678901234567890.0987654321", 8, 4},
+	{"numeric", "12345678901234567890.0987654321", 1024, 932},
+	{"date", "2000-01-01", 3, 2},
+	{"date", "2000-01-01", 8, 0},
+	{"date", "2000-01-01", 1024, 432},
+	{"date", "1999-12-31", 3, 2},
+	{"date", "1999-12-31", 8, 5},
+	{"date", "1999-12-31", 1024, 933},
+	{"date", "2020-02-29", 3, 1},
+	{"date", "2020-02-29", 8, 3},
+	{"date", "2020-02-29", 1024, 235},
+	{"date", "1900-03-01", 3, 2},
+	{"date", "1900-03-01", 8, 5},
+	{"date", "1900-03-01", 1024, 429},
+	{"date", "2099-12-31", 3, 0},
+	{"date", "2099-12-31", 8, 2},
+	{"date", "2099-12-31", 1024, 834},
+	{"timestamp", "2000-01-01 00:00:00.000000", 3, 2},
+	{"timestamp", "2000-01-01 00:00:00.000000", 8, 0},
+	{"timestamp", "2000-01-01 00:00:00.000000", 1024, 432},
+	{"timestamp", "1969-12-31 23:59:59.999999", 3, 0},
+	{"timestamp", "1969-12-31 23:59:59.999999", 8, 3},
+	{"timestamp", "1969-12-31 23:59:59.999999", 1024, 763},
+	{"timestamp", "2021-03-02 12:34:56.789012", 3, 1},
+	{"timestamp", "2021-03-02 12:34:56.789012", 8, 2},
+	{"timestamp", "2021-03-02 12:34:56.789012", 1024, 666},
+	{"uuid", "00000000-0000-0000-0000-000000000000", 3, 0},
+	{"uuid", "00000000-0000-0000-0000-000000000000", 8, 5},
+	{"uuid", "00000000-0000-0000-0000-000000000000", 1024, 933},
+	{"uuid", "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", 3, 1},
+	{"uuid", "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", 8, 0},
+	{"uuid", "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", 1024, 464},
+	{"uuid", "ffffffff-ffff-ffff-ffff-ffffffffffff", 3, 1},
+	{"uuid", "ffffffff-ffff-ffff-ffff-ffffffffffff", 8, 1},
+	{"uuid", "ffffffff-ffff-ffff-ffff-ffffffffffff", 1024, 385},
+}
+
+// goldenHash the row hash of the single column key of the kind
+func goldenHash(t *testing.T, kind string, value string) uint64 {
+	var h uint64
+	var err error
+	switch kind {
+	case "int":
+		var v int64
+		v, err = strconv.ParseInt(value, 10, 32)
+		h = HashInt(int32(v))
+	case "bigint":
+		var v int64
+		v, err = strconv.ParseInt(value, 10, 64)
+		h = HashBigint(v)
+	case "text":
+		h = HashString([]byte(value))
+	case "numeric":
+		h, err = HashNumeric(value)
+	case "date":
+		h, err = HashDate(value)
+	case "timestamp":
+		h, err = HashTimestamp(value)
+	case "uuid":
+		h, err = HashUUID(value)
+	default:
+		t.Fatalf("unknown kind %s", kind)
+	}
+	if err != nil {
+		t.Fatalf("%s %q: %s", kind, value, err)
+	}
+	return PartitionRowHash(h)
+}
+
+func TestGoldenRemainders(t *testing.T) {
+	for _, c := range goldenCases {
+		got := MatchingHashBound(goldenHash(t, c.kind, c.value), c.modulus)
+		if got != c.remainder {
+			t.Errorf("%s %q modulus %d: remainder %d, expect %d", c.kind, c.value, c.modulus, got, c.remainder)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package pghash
+
+// pure go port of the postgresql generic hash functions (hashfn.c), only the
+// "extended" 64-bit variants are kept, since they are the ones used by hash
+// partitioning. the byte order follows the little-endian code path, which is
+// what a x86/arm postgresql server computes, so the result is the same as the
+// hash value the coordinator uses for partition pruning.
+
+func rot(x uint32, k uint) uint32 {
+	return (x << k) | (x >> (32 - k))
+}
+
+// mix -- mix 3 32-bit values reversibly.
+func mix(a, b, c uint32) (uint32, uint32, uint32) {
+	a -= c
+	a ^= rot(c, 4)
+	c += b
+	b -= a
+	b ^= rot(a, 6)
+	a += c
+	c -= b
+	c ^= rot(b, 8)
+	b += a
+	a -= c
+	a ^= rot(c, 16)
+	c += b
+	b -= a
+	b ^= rot(a, 19)
+	a += c
+	c -= b
+	c ^= rot(b, 4)
+	b += a
+	return a, b, c
+}
+
+// final -- final mixing of 3 32-bit values (a,b,c) into c
+func final(a, b, c uint32) (uint32, uint32, uint32) {
+	c ^= b
+	c -= rot(b, 14)
+	a ^= c
+	a -= rot(c, 11)
+	b ^= a
+	b -= rot(a, 25)
+	c ^= b
+	c -= rot(b, 16)
+	a ^= c
+	a -= rot(c, 4)
+	b ^= a
+	b -= rot(a, 14)
+	c ^= b
+	c -= rot(b, 24)
+	return a, b, c
+}
+
+// HashAnyExtended hash a variable-length key into a 64-bit value, using an
+// optional seed (0 means no seed), same as hash_any_extended()
+func HashAnyExtended(k []byte, seed uint64) uint64 {
+	var a, b, c uint32
+	length := uint32(len(k))
+
+	a = 0x9e3779b9 + length + 3923095
+	b, c = a, a
+
+	// if the seed is non-zero, use it to perturb the internal state.
+	if seed != 0 {
+		a += uint32(seed >> 32)
+		b += uint32(seed)
+		a, b, c = mix(a, b, c)
+	}
+
+	// handle most of the key
+	for len(k) >= 12 {
+		a += uint32(k[0]) | uint32(k[1])<<8 | uint32(k[2])<<16 | uint32(k[3])<<24
+		b += uint32(k[4]) | uint32(k[5])<<8 | uint32(k[6])<<16 | uint32(k[7])<<24
+		c += uint32(k[8]) | uint32(k[9])<<8 | uint32(k[10])<<16 | uint32(k[11])<<24
+		a, b, c = mix(a, b, c)
+		k = k[12:]
+	}
+
+	// handle the last 11 bytes, the lowest byte of c is reserved for the
+	// length, the fall through order is the same as the c code
+	switch len(k) {
+	case 11:
+		c += uint32(k[10]) << 24
+		fallthrough
+	case 10:
+		c += uint32(k[9]) << 16
+		fallthrough
+	case 9:
+		c += uint32(k[8]) << 8
+		fallthrough
+	case 8:
+		b += uint32(k[7]) << 24
+		fallthrough
+	case 7:
+		b += uint32(k[6]) << 16
+		fallthrough
+	case 6:
+		b += uint32(k[5]) << 8
+		fallthrough
+	case 5:
+		b += uint32(k[4])
+		fallthrough
+	case 4:
+		a += uint32(k[3]) << 24
+		fallthrough
+	case 3:
+		a += uint32(k[2]) << 16
+		fallthrough
+	case 2:
+		a += uint32(k[1]) << 8
+		fallthrough
+	case 1:
+		a += uint32(k[0])
+	}
+
+	_, b, c = final(a, b, c)
+
+	return (uint64(b) << 32) | uint64(c)
+}
+
+// HashUint32Extended hash a 32-bit value to a 64-bit value with a seed, it
+// has the same result as HashAnyExtended on the 4 bytes of k
+func HashUint32Extended(k uint32, seed uint64) uint64 {
+	var a, b, c uint32
+
+	a = 0x9e3779b9 + 4 + 3923095
+	b, c = a, a
+
+	if seed != 0 {
+		a += uint32(seed >> 32)
+		b += uint32(seed)
+		a, b, c = mix(a, b, c)
+	}
+
+	a += k
+
+	_, b, c = final(a, b, c)
+
+	return (uint64(b) << 32) | uint64(c)
+}
+
+// HashCombine64 combine two 64-bit hash values, resulting in another hash
+// value, using the same kind of technique as boost::hash_combine
+func HashCombine64(a uint64, b uint64) uint64 {
+	a ^= b + 0x49a0f4dd15e5a8e3 + (a << 54) + (a >> 7)
+	return a
+}
@@ -0,0 +1,190 @@
+package pghash
+
+// port of the numeric_in() and hash_numeric_extended() of postgresql, the
+// numeric value is kept in the NBASE(10000) digits form which is what the
+// server hashes, no arithmetic is supported
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	NBASE      = 10000
+	DEC_DIGITS = 4 // decimal digits per NBASE digit
+)
+
+type Numeric struct {
+	nan    bool
+	neg    bool
+	weight int     // weight of first digit
+	dscale int     // display scale
+	digits []int16 // base-NBASE digits, leading and trailing zeroes stripped
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// ParseNumeric parse the text form of numeric to the NBASE digits form, the
+// same as numeric_in() with default typmod
+func ParseNumeric(str string) (*Numeric, error) {
+	cp := strings.TrimSpace(str)
+	if strings.EqualFold(cp, "nan") {
+		return &Numeric{nan: true}, nil
+	}
+
+	n := &Numeric{}
+	haveDP := false
+	dweight := -1
+	dscale := 0
+
+	if len(cp) > 0 && (cp[0] == '+' || cp[0] == '-') {
+		n.neg = cp[0] == '-'
+		cp = cp[1:]
+	}
+
+	if len(cp) > 0 && cp[0] == '.' {
+		haveDP = true
+		cp = cp[1:]
+	}
+
+	if len(cp) == 0 || !isDigit(cp[0]) {
+		return nil, fmt.Errorf("invalid input syntax for type numeric: \"%s\"", str)
+	}
+
+	// leading padding for digit alignment later
+	decdigits := make([]byte, DEC_DIGITS, len(cp)+DEC_DIGITS*2)
+	for len(cp) > 0 {
+		if isDigit(cp[0]) {
+			decdigits = append(decdigits, cp[0]-'0')
+			if !haveDP {
+				dweight++
+			} else {
+				dscale++
+			}
+		} else if cp[0] == '.' {
+			if haveDP {
+				return nil, fmt.Errorf("invalid input syntax for type numeric: \"%s\"", str)
+			}
+			haveDP = true
+		} else {
+			break
+		}
+		cp = cp[1:]
+	}
+	ddigits := len(decdigits) - DEC_DIGITS
+	// trailing padding for digit alignment later
+	decdigits = append(decdigits, make([]byte, DEC_DIGITS-1)...)
+
+	// handle exponent, if any
+	if len(cp) > 0 && (cp[0] == 'e' || cp[0] == 'E') {
+		exponent, err := strconv.ParseInt(cp[1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input syntax for type numeric: \"%s\"", str)
+		}
+		if exponent >= math.MaxInt32/2 || exponent <= -(math.MaxInt32/2) {
+			return nil, fmt.Errorf("value overflows numeric format")
+		}
+		dweight += int(exponent)
+		dscale -= int(exponent)
+		if dscale < 0 {
+			dscale = 0
+		}
+		cp = ""
+	}
+
+	if len(cp) != 0 {
+		return nil, fmt.Errorf("invalid input syntax for type numeric: \"%s\"", str)
+	}
+
+	// convert the pure-decimal representation to base NBASE, offset is the
+	// number of decimal zeroes to insert before the first given digit to
+	// have a correctly aligned first NBASE digit.
+	var weight int
+	if dweight >= 0 {
+		weight = (dweight+1+DEC_DIGITS-1)/DEC_DIGITS - 1
+	} else {
+		weight = -((-dweight-1)/DEC_DIGITS + 1)
+	}
+	offset := (weight+1)*DEC_DIGITS - (dweight + 1)
+	ndigits := (ddigits + offset + DEC_DIGITS - 1) / DEC_DIGITS
+
+	digits := make([]int16, ndigits)
+	i := DEC_DIGITS - offset
+	for d := 0; d < ndigits; d++ {
+		digits[d] = int16(((int(decdigits[i])*10+int(decdigits[i+1]))*10+
+			int(decdigits[i+2]))*10 + int(decdigits[i+3]))
+		i += DEC_DIGITS
+	}
+
+	// strip any leading/trailing zeroes, and normalize weight if zero
+	for len(digits) > 0 && digits[0] == 0 {
+		digits = digits[1:]
+		weight--
+	}
+	for len(digits) > 0 && digits[len(digits)-1] == 0 {
+		digits = digits[:len(digits)-1]
+	}
+	if len(digits) == 0 {
+		n.neg = false
+		weight = 0
+	}
+
+	n.weight = weight
+	n.dscale = dscale
+	n.digits = digits
+	return n, nil
+}
+
+// HashNumericExtended hash the numeric value to 64-bit, as
+// hash_numeric_extended(), the digits are hashed as the little-endian int16
+// storage form, and the weight is folded in after that
+func HashNumericExtended(n *Numeric, seed uint64) uint64 {
+	if n.nan {
+		return seed
+	}
+
+	// the digits are already stripped, so a zero value has no digits left
+	if len(n.digits) == 0 {
+		return seed - 1
+	}
+
+	buf := make([]byte, len(n.digits)*2)
+	for i, d := range n.digits {
+		binary.LittleEndian.PutUint16(buf[i*2:], uint16(d))
+	}
+
+	return HashAnyExtended(buf, seed) ^ uint64(int64(n.weight))
+}
+
+const (
+	NUMERIC_POS = 0x0000
+	NUMERIC_NEG = 0x4000
+	NUMERIC_NAN = 0xC000
+)
+
+// AppendBinary append the binary form of the numeric to buf, the same as
+// numeric_send(), ndigits, weight, sign, dscale and the digits, all in
+// network byte order
+func (n *Numeric) AppendBinary(buf []byte) []byte {
+	var sign uint16 = NUMERIC_POS
+	if n.nan {
+		sign = NUMERIC_NAN
+	} else if n.neg {
+		sign = NUMERIC_NEG
+	}
+	var b [2]byte
+	for _, v := range []uint16{uint16(len(n.digits)), uint16(int16(n.weight)), sign, uint16(n.dscale)} {
+		binary.BigEndian.PutUint16(b[:], v)
+		buf = append(buf, b[:]...)
+	}
+	for _, d := range n.digits {
+		binary.BigEndian.PutUint16(b[:], uint16(d))
+		buf = append(buf, b[:]...)
+	}
+	return buf
+}
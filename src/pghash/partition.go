@@ -0,0 +1,78 @@
+package pghash
+
+// the partition bound math of postgresql hash partitioning, each partition
+// key column is hashed with its type's extended hash function using the
+// HASH_PARTITION_SEED, the column hashes are combined to the row hash, and
+// the row hash modulo the greatest modulus is the remainder of the partition
+
+const (
+	HASH_PARTITION_SEED uint64 = 0x7A5B22367996DCFD
+)
+
+// PartitionRowHash combine the column hashes of a partition key to the row
+// hash, same as compute_partition_hash_value(), null columns should not be
+// passed in since they are skipped by postgresql
+func PartitionRowHash(hashes ...uint64) uint64 {
+	var rowHash uint64 = 0
+	for _, h := range hashes {
+		rowHash = HashCombine64(rowHash, h)
+	}
+	return rowHash
+}
+
+// MatchingHashBound get the remainder which the row hash belongs to
+func MatchingHashBound(rowHash uint64, greatestModulus int) int {
+	if greatestModulus == 0 {
+		greatestModulus = 1
+	}
+	return int(rowHash % uint64(greatestModulus))
+}
+
+func HashInt(key int32) uint64 {
+	return HashUint32Extended(uint32(key), HASH_PARTITION_SEED)
+}
+
+// HashBigint hash the int8 value, the high half is folded into the low half
+// so that the values in int4 range hash the same as int4
+func HashBigint(key int64) uint64 {
+	lohalf := uint32(key)
+	hihalf := uint32(key >> 32)
+	if key >= 0 {
+		lohalf ^= hihalf
+	} else {
+		lohalf ^= ^hihalf
+	}
+	return HashUint32Extended(lohalf, HASH_PARTITION_SEED)
+}
+
+func HashString(key []byte) uint64 {
+	return HashAnyExtended(key, HASH_PARTITION_SEED)
+}
+
+func HashNumeric(key string) (uint64, error) {
+	n, err := ParseNumeric(key)
+	if err != nil {
+		return 0, err
+	}
+	return HashNumericExtended(n, HASH_PARTITION_SEED), nil
+}
+
+func GetMatchingHashBoundsInt(key int32, greatestModulus int) int {
+	return MatchingHashBound(PartitionRowHash(HashInt(key)), greatestModulus)
+}
+
+func GetMatchingHashBoundsBigint(key int64, greatestModulus int) int {
+	return MatchingHashBound(PartitionRowHash(HashBigint(key)), greatestModulus)
+}
+
+func GetMatchingHashBoundsString(key []byte, greatestModulus int) int {
+	return MatchingHashBound(PartitionRowHash(HashString(key)), greatestModulus)
+}
+
+func GetMatchingHashBoundsNumeric(key string, greatestModulus int) (int, error) {
+	h, err := HashNumeric(key)
+	if err != nil {
+		return -1, err
+	}
+	return MatchingHashBound(PartitionRowHash(h), greatestModulus), nil
+}
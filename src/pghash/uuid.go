@@ -0,0 +1,37 @@
+package pghash
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const UUID_LEN = 16
+
+// ParseUUID parse the uuid text form to the 16 bytes, the standard form, the
+// form without hyphens and the form wrapped by braces are accepted
+func ParseUUID(str string) ([]byte, error) {
+	s := strings.TrimSpace(str)
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+		s = s[1 : len(s)-1]
+	}
+	s = strings.Replace(s, "-", "", -1)
+	if len(s) != UUID_LEN*2 {
+		return nil, fmt.Errorf("invalid input syntax for type uuid: \"%s\"", str)
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid input syntax for type uuid: \"%s\"", str)
+	}
+	return b, nil
+}
+
+// HashUUID hash a uuid as uuid_hash_extended, which is the hash of its 16
+// bytes
+func HashUUID(key string) (uint64, error) {
+	b, err := ParseUUID(key)
+	if err != nil {
+		return 0, err
+	}
+	return HashAnyExtended(b, HASH_PARTITION_SEED), nil
+}